@@ -8,3 +8,20 @@ type ConfigMeta struct {
 	Site    string
 	Comment string
 }
+
+// Log is the logging of the process. Level is the least severe level logged, of debug, info, warn or error, and may be set per driver by log_level.
+// Format is logfmt or json, and a warning or error repeated with the same message is logged at most once per rate_limit_ms, defaulting to 10s.
+type Log struct {
+	Level       string `yaml:"level"`
+	Format      string `yaml:"format"`
+	RateLimitMs int    `yaml:"rate_limit_ms"`
+}
+
+// FailSafe is the action taken on the values of a driver on loss of communication
+type FailSafe string
+
+const (
+	FailSafeHold    FailSafe = "hold"
+	FailSafeDefault FailSafe = "default"
+	FailSafeBad     FailSafe = "bad"
+)
@@ -6,27 +6,29 @@ package config
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
-
-	"gopkg.in/yaml.v2"
 )
 
+// Each loader decodes a configuration file and validates it, returning Errors listing every problem found with its position
+
 func LoadTagList(path string) (TagList, error) {
 
 	c := TagList{}
 
-	f, err := os.Open(filepath.Clean(path))
+	src, err := decode(path, &c)
 	if err != nil {
-		return TagList{}, fmt.Errorf("failed to open file: %w", err)
+		return TagList{}, fmt.Errorf("failed to load taglist: %w", err)
 	}
-	defer f.Close()
+	c.source = src
 
-	y := yaml.NewDecoder(f)
-	y.SetStrict(true)
-	err = y.Decode(&c)
+	c.Tags, c.origins, err = expandTags(c.source, "tags", c.Tags)
 	if err != nil {
-		return TagList{}, fmt.Errorf("failed to load taglist: %w", err)
+		return TagList{}, err
+	}
+
+	err = c.validate()
+	if err != nil {
+		return TagList{}, err
 	}
 	return c, nil
 }
@@ -35,27 +37,20 @@ func LoadModbus(path string) (Modbus, error) {
 
 	c := Modbus{}
 
-	f, err := os.Open(filepath.Clean(path))
+	src, err := decode(path, &c)
 	if err != nil {
-		return Modbus{}, fmt.Errorf("failed to open file: %w", err)
+		return Modbus{}, fmt.Errorf("failed to load modbus: %w", err)
 	}
-	defer f.Close()
-
-	y := yaml.NewDecoder(f)
-	y.SetStrict(true)
+	c.source = src
 
-	err = y.Decode(&c)
+	c.Modbus.Tags, c.origins, err = expandModbusTags(c.source, "modbus.tags", c.Modbus.Tags)
 	if err != nil {
-		return Modbus{}, fmt.Errorf("failed to load modbus: %w", err)
+		return Modbus{}, err
 	}
 
-	for _, v := range c.Modbus.Tags {
-		switch v.Type {
-		case ModbusCoil, ModbusDiscrete, ModbusHolding, ModbusInput:
-			continue
-		default:
-			return Modbus{}, fmt.Errorf("invalid type, expected one of [%v, %v, %v, %v] for: %+v", ModbusCoil, ModbusDiscrete, ModbusHolding, ModbusInput, v)
-		}
+	err = c.validate()
+	if err != nil {
+		return Modbus{}, err
 	}
 	return c, nil
 }
@@ -64,20 +59,16 @@ func LoadMqtt(path string) (MQTT, error) {
 
 	c := MQTT{}
 
-	f, err := os.Open(filepath.Clean(path))
+	src, err := decode(path, &c)
 	if err != nil {
-		return MQTT{}, fmt.Errorf("failed to open file: %w", err)
+		return MQTT{}, fmt.Errorf("failed to load mqtt: %w", err)
 	}
-	defer f.Close()
-
-	y := yaml.NewDecoder(f)
-	y.SetStrict(true)
+	c.source = src
 
-	err = y.Decode(&c)
+	err = c.validate()
 	if err != nil {
-		return MQTT{}, fmt.Errorf("failed to load mqtt: %w", err)
+		return MQTT{}, err
 	}
-
 	return c, nil
 }
 
@@ -85,19 +76,78 @@ func LoadGoose(path string) (Goose, error) {
 
 	c := Goose{}
 
-	f, err := os.Open(filepath.Clean(path))
+	src, err := decode(path, &c)
+	if err != nil {
+		return Goose{}, fmt.Errorf("failed to load goose: %w", err)
+	}
+	c.source = src
+
+	err = c.validate()
 	if err != nil {
-		return Goose{}, fmt.Errorf("failed to open file: %w", err)
+		return Goose{}, err
 	}
-	defer f.Close()
+	return c, nil
+}
+
+func LoadRuntime(path string) (Runtime, error) {
 
-	y := yaml.NewDecoder(f)
-	y.SetStrict(true)
+	c := Runtime{}
 
-	err = y.Decode(&c)
+	src, err := decode(path, &c)
 	if err != nil {
-		return Goose{}, fmt.Errorf("failed to load goose: %w", err)
+		return Runtime{}, fmt.Errorf("failed to load runtime: %w", err)
 	}
+	c.source = src
 
+	c.Tags, c.origins, err = expandTags(c.source, "tags", c.Tags)
+	if err != nil {
+		return Runtime{}, err
+	}
+
+	// the tags of the included taglist precede those of the runtime configuration
+	if c.TagList != "" {
+		c.TagList = relative(path, c.TagList)
+		t, err := LoadTagList(c.TagList)
+		if err != nil {
+			return Runtime{}, fmt.Errorf("failed to include %v: %w", c.TagList, err)
+		}
+		c.Tags = append(t.Tags, c.Tags...)
+		c.origins = append(t.origins, c.origins...)
+	}
+
+	err = c.validate()
+	if err != nil {
+		return Runtime{}, err
+	}
+
+	for i, v := range c.Drivers {
+		c.Drivers[i].Config = relative(path, v.Config)
+	}
+	return c, nil
+}
+
+func LoadOpc(path string) (OPC, error) {
+
+	c := OPC{}
+
+	src, err := decode(path, &c)
+	if err != nil {
+		return OPC{}, fmt.Errorf("failed to load opc: %w", err)
+	}
+	c.source = src
+
+	err = c.validate()
+	if err != nil {
+		return OPC{}, err
+	}
 	return c, nil
 }
+
+// relative resolves path relative to the directory of the configuration file at config, unless path is absolute
+func relative(config string, path string) string {
+
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(config), path)
+}
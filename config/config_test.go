@@ -5,12 +5,22 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"gopkg.in/yaml.v2"
 )
 
 func TestLoadConfig(t *testing.T) {
 
+	t.Setenv("MQTT_TOKEN", "token")
+
 	tags, err := LoadTagList("taglist.yml")
 	if err != nil {
 		t.Fatalf("failed to load: %v", err)
@@ -31,6 +41,43 @@ func TestLoadConfig(t *testing.T) {
 		t.Fatalf("failed to load: %v", err)
 	}
 
+	op, err := LoadOpc("opc.yml")
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	srv, err := LoadOpc("opc_server.yml")
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	rt, err := LoadRuntime("runtime.yml")
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if rt.Drivers[0].Config != "modbus.yml" {
+		t.Fatalf("expected config relative to the runtime, got %v", rt.Drivers[0].Config)
+	}
+
+	single, err := LoadRuntime("tel.yml")
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if single.Server.Endpoint != "opc.tcp://127.0.0.1:4840" || len(single.Tags) != len(tags.Tags)+1 {
+		t.Fatalf("expected default port, and the included taglist with one further tag, got %v with %v tags", single.Server.Endpoint, len(single.Tags))
+	}
+
+	if mods.Modbus.Device.FailSafe != FailSafeBad || mods.Modbus.Device.FailSafeOutputs != FailSafeDefault {
+		t.Fatalf("expected modbus failsafe bad with outputs default, got %v %v", mods.Modbus.Device.FailSafe, mods.Modbus.Device.FailSafeOutputs)
+	}
+
+	for _, refs := range [][]TagRef{mods.TagRefs(), mq.TagRefs(), gs.TagRefs()} {
+		err = CheckTags(tags.Tags, refs)
+		if err != nil {
+			t.Fatalf("expected driver tags within the taglist: %v", err)
+		}
+	}
+
 	for _, v := range tags.Tags {
 		log.Printf("tags: %+v", v)
 	}
@@ -47,4 +94,433 @@ func TestLoadConfig(t *testing.T) {
 		log.Printf("goose: %+v", v)
 	}
 
+	log.Printf("opc: %+v", op.Opc)
+	log.Printf("opc server: %+v", srv.Server)
+
+}
+
+func TestFailSafe(t *testing.T) {
+
+	err := failsafe("", FailSafeHold, FailSafeDefault)
+	if err != nil {
+		t.Fatalf("expected unset failsafe to be valid: %v", err)
+	}
+
+	err = failsafe(FailSafeBad, FailSafeHold, FailSafeDefault)
+	if err == nil {
+		t.Fatalf("expected bad to be invalid for outputs")
+	}
+}
+
+func TestExpand(t *testing.T) {
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "token"), []byte("s3cr\"et\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+
+	t.Setenv("TEL_HOST", "broker")
+
+	in := "# ${UNSET} in a comment\ntarget: ssl://${TEL_HOST}:${TEL_PORT:-8883}\ntoken: file:token\nusers:\n  - file:token\nliteral: $${TEL_HOST}\n"
+	expected := "# ${UNSET} in a comment\ntarget: ssl://broker:8883\ntoken: \"s3cr\\\"et\"\nusers:\n  - \"s3cr\\\"et\"\nliteral: ${TEL_HOST}\n"
+
+	out, err := expand([]byte(in), dir)
+	if err != nil {
+		t.Fatalf("failed to expand: %v", err)
+	}
+	if string(out) != expected {
+		t.Fatalf("expected:\n%v\ngot:\n%v", expected, string(out))
+	}
+
+	t.Setenv("TEL_TOKEN", `*a: b #c "d" 'e'`)
+	t.Setenv("TEL_PORT", "8883")
+
+	in = "token: ${TEL_TOKEN} # a comment ${UNSET}\nport: ${TEL_PORT}\nusers:\n  - x${TEL_TOKEN}\ndouble: \"${TEL_TOKEN}\"\nsingle: '${TEL_TOKEN}'\n"
+	expected = `token: "*a: b #c \"d\" 'e'" # a comment ${UNSET}` + "\n" + `port: 8883` + "\n" + `users:` + "\n" + `  - "x*a: b #c \"d\" 'e'"` + "\n" +
+		`double: "*a: b #c \"d\" 'e'"` + "\n" + `single: '*a: b #c "d" ''e'''` + "\n"
+
+	out, err = expand([]byte(in), dir)
+	if err != nil {
+		t.Fatalf("failed to expand: %v", err)
+	}
+	if string(out) != expected {
+		t.Fatalf("expected:\n%v\ngot:\n%v", expected, string(out))
+	}
+
+	decoded := struct {
+		Token  string
+		Port   int
+		Users  []string
+		Double string
+		Single string
+	}{}
+	err = yaml.Unmarshal(out, &decoded)
+	if err != nil {
+		t.Fatalf("failed to decode expanded values: %v", err)
+	}
+	value := `*a: b #c "d" 'e'`
+	if decoded.Token != value || decoded.Port != 8883 || decoded.Users[0] != "x"+value || decoded.Double != value || decoded.Single != value {
+		t.Fatalf("expected expanded values to be read literally, got %+v", decoded)
+	}
+
+	// a variable holding file:<path> is read literally, while a file reference may hold a variable, and a comment following a quoted scalar is not expanded
+	t.Setenv("TEL_FILE", "file:token")
+	t.Setenv("TEL_SECRET", "token")
+
+	in = "literal: ${TEL_FILE}\nsecret: file:${TEL_SECRET}\nquoted: \"${TEL_HOST}\" # ${UNSET}\n"
+	expected = "literal: file:token\nsecret: \"s3cr\\\"et\"\nquoted: \"broker\" # ${UNSET}\n"
+
+	out, err = expand([]byte(in), dir)
+	if err != nil {
+		t.Fatalf("failed to expand: %v", err)
+	}
+	if string(out) != expected {
+		t.Fatalf("expected:\n%v\ngot:\n%v", expected, string(out))
+	}
+
+	_, err = expand([]byte("a: 1\ntoken: ${TEL_UNSET}\n"), dir)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected unset variable to fail on line 2, got %v", err)
+	}
+
+	_, err = expand([]byte("token: file:missing\n"), dir)
+	if err == nil {
+		t.Fatalf("expected missing file to fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"taglist.yml": "tags:\n  - name: A\n    type: bool\n  - name: B\n    type: uint17\n  - name: A\n",
+		"modbus.yml": "modbus:\n  device:\n    mode: tcp\n    scantime_ms: 0\n    timeout_ms: 1000\n  tags:\n" +
+			"    - name: A\n      type: coil\n      index: 1\n    - name: C\n      type: coil\n      index: 1\n",
+		"opc.yml":   "opc:\n  endpoint: opc.tcp://localhost:4840\n  security_policy: Basic256Sha256\n  security_mode: SignAndEncrypt\n",
+		"goose.yml": "goose:\n  endpoints:\n    - filter_mac: 01-0c-cd\n      datasets:\n        - name: D\n          tags: 1\n",
+	}
+	for k, v := range files {
+		err := os.WriteFile(filepath.Join(dir, k), []byte(v), 0600)
+		if err != nil {
+			t.Fatalf("failed to write %v: %v", k, err)
+		}
+	}
+
+	expect := func(err error, expected ...string) {
+		t.Helper()
+
+		errs := Errors{}
+		if !errors.As(err, &errs) {
+			t.Fatalf("expected configuration errors, got %v", err)
+		}
+		if len(errs) != len(expected) {
+			t.Fatalf("expected %v errors, got %v", len(expected), err)
+		}
+		for i, v := range expected {
+			if !strings.HasPrefix(errs[i].Error(), filepath.Join(dir, v)) {
+				t.Fatalf("expected error %v at %v, got %v", i, v, errs[i])
+			}
+		}
+	}
+
+	_, err := LoadTagList(filepath.Join(dir, "taglist.yml"))
+	expect(err, "taglist.yml:5: tag B has unknown type", "taglist.yml:6: duplicate tag name A, first defined at "+filepath.Join(dir, "taglist.yml:2"))
+
+	_, err = LoadModbus(filepath.Join(dir, "modbus.yml"))
+	expect(err, "modbus.yml:4: scantime_ms", "modbus.yml:12: duplicate address coil 1 of C")
+
+	_, err = LoadGoose(filepath.Join(dir, "goose.yml"))
+	expect(err, "goose.yml:3: invalid filter_mac")
+
+	_, err = LoadOpc(filepath.Join(dir, "opc.yml"))
+	expect(err, "opc.yml:3: trusted_certificates must be set")
+
+	mods := Modbus{
+		Modbus: ModbusDriver{Tags: []ModbusTag{{Name: "A"}, {Name: "C"}}},
+		source: &source{file: filepath.Join(dir, "modbus.yml"), lines: map[string]int{"modbus.tags[1].name": 10}},
+	}
+	err = CheckTags([]TagListTag{{Name: "A"}}, mods.TagRefs())
+	expect(err, "modbus.yml:10: tag C was not found")
+}
+
+func TestIndex(t *testing.T) {
+
+	doc := "# comment\nmeta:\n  site: x\ntags:\n- name: A\n  type: bool\n- name: B\ngoose:\n  endpoints:\n    - filter_mac: x\n      datasets:\n        -\n          name: D\n"
+
+	lines := index([]byte(doc))
+	expected := map[string]int{
+		"meta.site":                           3,
+		"tags[0].name":                        5,
+		"tags[0].type":                        6,
+		"tags[1]":                             7,
+		"goose.endpoints[0].filter_mac":       10,
+		"goose.endpoints[0].datasets[0]":      12,
+		"goose.endpoints[0].datasets[0].name": 13,
+	}
+	for k, v := range expected {
+		if lines[k] != v {
+			t.Fatalf("expected %v at line %v, got %v: %v", k, v, lines[k], lines)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+
+	examples := map[string][]string{
+		"taglist": {"taglist.yml"},
+		"modbus":  {"modbus.yml"},
+		"mqtt":    {"mqtt.yml"},
+		"goose":   {"goose.yml"},
+		"opc":     {"opc.yml", "opc_server.yml"},
+		"runtime": {"runtime.yml", "tel.yml"},
+	}
+
+	for _, name := range SchemaNames() {
+
+		b, err := Schema(name)
+		if err != nil {
+			t.Fatalf("failed to generate schema: %v", err)
+		}
+
+		// the schemas within the repository are regenerated by tel schema -o config/schema
+		committed, err := os.ReadFile(filepath.Join("schema", name+".json"))
+		if err != nil {
+			t.Fatalf("failed to read schema: %v", err)
+		}
+		if string(committed) != string(b) {
+			t.Fatalf("schema/%v.json is out of date with the config types, regenerate it with tel schema -o config/schema", name)
+		}
+
+		s := map[string]interface{}{}
+		err = json.Unmarshal(b, &s)
+		if err != nil {
+			t.Fatalf("failed to decode schema: %v", err)
+		}
+
+		for _, file := range examples[name] {
+			y, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read example: %v", err)
+			}
+			var v interface{}
+			err = yaml.Unmarshal(y, &v)
+			if err != nil {
+				t.Fatalf("failed to decode example: %v", err)
+			}
+			err = conforms(s, v, "")
+			if err != nil {
+				t.Fatalf("%v does not conform to the %v schema: %v", file, name, err)
+			}
+		}
+	}
+
+	var v interface{}
+	err := yaml.Unmarshal([]byte("modbus:\n  tags:\n    - name: X\n      type: register\n"), &v)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	b, _ := Schema("modbus")
+	s := map[string]interface{}{}
+	_ = json.Unmarshal(b, &s)
+
+	err = conforms(s, v, "")
+	if err == nil || !strings.Contains(err.Error(), "modbus.tags[0].type") {
+		t.Fatalf("expected invalid register type to not conform, got %v", err)
+	}
+}
+
+// conforms checks v against the subset of JSON Schema generated by Schema
+func conforms(s map[string]interface{}, v interface{}, path string) error {
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v: %v is not one of %v", path, v, enum)
+	}
+
+	switch s["type"] {
+	case "object":
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("%v: expected an object", path)
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		for k, item := range m {
+			p, ok := properties[fmt.Sprint(k)]
+			if additional, isSchema := s["additionalProperties"].(map[string]interface{}); !ok && isSchema {
+				p, ok = additional, true
+			}
+			if !ok {
+				return fmt.Errorf("%v: unknown property %v", path, k)
+			}
+			err := conforms(p.(map[string]interface{}), item, strings.TrimPrefix(fmt.Sprintf("%v.%v", path, k), "."))
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%v: expected an array", path)
+		}
+		for i, item := range a {
+			err := conforms(s["items"].(map[string]interface{}), item, fmt.Sprintf("%v[%v]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%v: expected a string", path)
+		}
+	case "integer":
+		if _, ok := v.(int); !ok {
+			return fmt.Errorf("%v: expected an integer", path)
+		}
+	case "number":
+		switch v.(type) {
+		case int, float64:
+		default:
+			return fmt.Errorf("%v: expected a number", path)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%v: expected a boolean", path)
+		}
+	}
+	return nil
+}
+
+func TestCSV(t *testing.T) {
+
+	t.Setenv("MQTT_TOKEN", "token")
+
+	dir := t.TempDir()
+	files := PointList{}
+	for _, v := range []struct {
+		name string
+		path *string
+	}{{"taglist.yml", &files.TagList}, {"modbus.yml", &files.Modbus}, {"mqtt.yml", &files.MQTT}, {"goose.yml", &files.Goose}} {
+		b, err := os.ReadFile(v.name)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		*v.path = filepath.Join(dir, v.name)
+		err = os.WriteFile(*v.path, b, 0644)
+		if err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	exported := strings.Builder{}
+	err := ExportCSV(&exported, files)
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	// the example taglist holds templates, which an import would replace, so is refused
+	err = ImportCSV(strings.NewReader(exported.String()), "points.csv", files)
+	errs := Errors{}
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+	if errs[0].Line != 66 || !strings.Contains(errs[0].Msg, "is a template") {
+		t.Fatalf("expected template at line 66, got %v", errs[0])
+	}
+
+	expanded, err := LoadTagList(files.TagList)
+	if err != nil {
+		t.Fatalf("failed to load taglist: %v", err)
+	}
+	b, err := yaml.Marshal(expanded)
+	if err != nil {
+		t.Fatalf("failed to marshal taglist: %v", err)
+	}
+	err = os.WriteFile(files.TagList, append([]byte("# expanded taglist\n"), b...), 0644)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	err = ImportCSV(strings.NewReader(exported.String()), "points.csv", files)
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+
+	// the imported configuration retains the tags and mappings of the examples, and environment variables unexpanded
+	tags, err := LoadTagList(files.TagList)
+	if err != nil {
+		t.Fatalf("failed to load imported taglist: %v", err)
+	}
+	original, _ := LoadTagList("taglist.yml")
+	if fmt.Sprint(tags.Tags) != fmt.Sprint(original.Tags) {
+		t.Fatalf("expected imported tags to match the example, got %+v", tags.Tags)
+	}
+
+	mods, err := LoadModbus(files.Modbus)
+	if err != nil {
+		t.Fatalf("failed to load imported modbus: %v", err)
+	}
+	originalMods, _ := LoadModbus("modbus.yml")
+	if fmt.Sprint(mods.Modbus) != fmt.Sprint(originalMods.Modbus) {
+		t.Fatalf("expected imported modbus to match the example, got %+v", mods.Modbus)
+	}
+
+	gs, err := LoadGoose(files.Goose)
+	if err != nil {
+		t.Fatalf("failed to load imported goose: %v", err)
+	}
+	originalGs, _ := LoadGoose("goose.yml")
+	if fmt.Sprint(gs.Goose) != fmt.Sprint(originalGs.Goose) {
+		t.Fatalf("expected imported goose to match the example, got %+v", gs.Goose)
+	}
+
+	b, _ = os.ReadFile(files.MQTT)
+	if !strings.Contains(string(b), "${MQTT_TOKEN}") || !strings.HasPrefix(string(b), "# SPDX-FileCopyrightText") {
+		t.Fatalf("expected mqtt configuration to retain its header and unexpanded token, got %s", b)
+	}
+
+	// only the tags are rewritten, retaining the comments of other settings
+	for file, comment := range map[string]string{
+		files.TagList: "# expanded taglist",
+		files.Modbus:  "    # on loss of the device, discretes and inputs hold their last value",
+		files.Goose:   "    # once the time allowed to live of a dataset expires",
+	} {
+		b, _ := os.ReadFile(file)
+		if !strings.Contains(string(b), comment) {
+			t.Fatalf("expected %v to retain %q, got %s", file, comment, b)
+		}
+	}
+
+	reexported := strings.Builder{}
+	err = ExportCSV(&reexported, files)
+	if err != nil {
+		t.Fatalf("failed to export imported configuration: %v", err)
+	}
+	if reexported.String() != exported.String() {
+		t.Fatalf("expected the imported configuration to export the same point list, got %v", reexported.String())
+	}
+
+	invalid := "name,type,driver,register,index\n" +
+		"A,bool,modbus,coil,1\n" +
+		"B,bool,modbus,coil,1\n" +
+		"C,double,modbus,register,1\n"
+
+	err = ImportCSV(strings.NewReader(invalid), "points.csv", files)
+	errs = Errors{}
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", err)
+	}
+	if errs[0].Line != 3 || !strings.Contains(errs[0].Msg, "duplicate address") {
+		t.Fatalf("expected duplicate address at line 3, got %v", errs[0])
+	}
+
+	after, _ := os.ReadFile(files.MQTT)
+	if string(after) != string(b) {
+		t.Fatalf("expected no file to be written on an invalid import")
+	}
 }
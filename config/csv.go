@@ -0,0 +1,706 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CSVColumns are the columns of a point list, a row of which is a taglist tag, with its mapping to a driver if set.
+// A tag used by several drivers is repeated on a row per driver. Modbus tags map to a register and index, mqtt tags to a topic,
+// and goose tags to the index within a dataset, and must be named <dataset>/<index>.
+var CSVColumns = []string{"name", "node_id", "namespace", "description", "type", "default_value", "driver", "register", "index", "topic", "dataset"}
+
+// PointList is the taglist and driver configuration files a point list is exported from and imported to, the drivers of which may be unset
+type PointList struct {
+	TagList string
+	Modbus  string
+	MQTT    string
+	Goose   string
+}
+
+// ExportCSV writes the point list of the taglist and driver configurations as CSV, with a row per tag and driver using it.
+// The driver configurations are read without expanding environment variables and file references, which the mappings do not use.
+func ExportCSV(w io.Writer, files PointList) error {
+
+	tags, err := LoadTagList(files.TagList)
+	if err != nil {
+		return err
+	}
+
+	rows := map[string][][]string{}
+	refs := []TagRef{}
+
+	if files.Modbus != "" {
+		c := Modbus{}
+		src, err := decodeRaw(files.Modbus, &c)
+		if err != nil {
+			return err
+		}
+		c.source = src
+		c.Modbus.Tags, c.origins, err = expandModbusTags(c.source, "modbus.tags", c.Modbus.Tags)
+		if err != nil {
+			return err
+		}
+		for _, v := range c.Modbus.Tags {
+			rows[v.Name] = append(rows[v.Name], []string{"modbus", string(v.Type), strconv.Itoa(int(v.Index)), "", ""})
+		}
+		refs = append(refs, c.TagRefs()...)
+	}
+
+	if files.MQTT != "" {
+		c := MQTT{}
+		src, err := decodeRaw(files.MQTT, &c)
+		if err != nil {
+			return err
+		}
+		c.source = src
+		for _, v := range c.Mqtt.Tags {
+			rows[v.Name] = append(rows[v.Name], []string{"mqtt", "", "", v.Topic, ""})
+		}
+		refs = append(refs, c.TagRefs()...)
+	}
+
+	if files.Goose != "" {
+		c := Goose{}
+		src, err := decodeRaw(files.Goose, &c)
+		if err != nil {
+			return err
+		}
+		c.source = src
+		for _, e := range c.Goose.Endpoints {
+			for _, d := range e.Datasets {
+				for t := 0; t < d.Tags; t++ {
+					name := fmt.Sprintf("%v/%v", d.Name, t)
+					rows[name] = append(rows[name], []string{"goose", "", strconv.Itoa(t), "", d.Name})
+				}
+			}
+		}
+		refs = append(refs, c.TagRefs()...)
+	}
+
+	err = CheckTags(tags.Tags, refs)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	err = cw.Write(CSVColumns)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tags.Tags {
+
+		tag := []string{t.Name, t.Node, t.Namespace, t.Description, t.Type, strconv.FormatFloat(t.DefaultValue, 'g', -1, 64)}
+
+		mappings := rows[t.Name]
+		if len(mappings) == 0 {
+			mappings = [][]string{{"", "", "", "", ""}}
+		}
+		for _, m := range mappings {
+			err := cw.Write(append(append([]string{}, tag...), m...))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvTag is a tag of an imported point list, with the line of the first row defining it
+type csvTag struct {
+	tag  TagListTag
+	line int
+}
+
+// csvIndex is the index of a goose tag within its dataset, and the line of its row
+type csvIndex struct {
+	index int
+	line  int
+}
+
+// ImportCSV reads a point list as CSV from r, named file, and replaces the tags of the taglist and of each driver configuration with those of the point list.
+// The columns are identified by the header row, and may be in any order. Every row is validated, and no file is written if any row is invalid.
+// Only the tags of each file are rewritten, and every other line, including comments, is retained without expanding environment variables and file references.
+// As the point list holds a row per tag, an import over a taglist or modbus configuration holding a tag template is refused, until the template is expanded.
+func ImportCSV(r io.Reader, file string, files PointList) error {
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+
+	columns := map[string]int{}
+	known := map[string]bool{}
+	for _, v := range CSVColumns {
+		known[v] = true
+	}
+
+	p := problems{}
+	for i, v := range header {
+		v = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(v, "\ufeff")))
+		if !known[v] {
+			p.addAt(Position{File: file, Line: 1}, "unknown column %q, expected columns of %v", v, CSVColumns)
+			continue
+		}
+		columns[v] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		p.addAt(Position{File: file, Line: 1}, "name column is not set")
+	}
+	if len(p.errs) != 0 {
+		return p.err()
+	}
+
+	configured := map[string]bool{"modbus": files.Modbus != "", "mqtt": files.MQTT != "", "goose": files.Goose != ""}
+
+	tags := []*csvTag{}
+	byName := map[string]*csvTag{}
+	modbus := []ModbusTag{}
+	mqtt := []MQTTTag{}
+	datasets := map[string][]csvIndex{}
+
+	addresses := map[string]int{}
+	mapped := map[string]int{}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %v: %w", file, err)
+		}
+
+		line, _ := cr.FieldPos(0)
+		at := Position{File: file, Line: line}
+
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		name := field("name")
+		if name == "" {
+			if strings.TrimSpace(strings.Join(record, "")) != "" {
+				p.addAt(at, "name is not set")
+			}
+			continue
+		}
+
+		tag := TagListTag{
+			Name:        name,
+			Node:        field("node_id"),
+			Namespace:   field("namespace"),
+			Description: field("description"),
+			Type:        field("type"),
+		}
+		if v := field("default_value"); v != "" {
+			tag.DefaultValue, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				p.addAt(at, "invalid default_value %q of %v, expected a number", v, name)
+			}
+		}
+
+		// a tag repeated on a row per driver may leave its attributes empty, else they must match
+		if first, ok := byName[name]; ok {
+			merged, err := mergeTag(first.tag, tag)
+			if err != nil {
+				p.addAt(at, "%v conflicts with its definition at %v: %v", name, Position{File: file, Line: first.line}, err)
+			}
+			first.tag = merged
+		} else {
+			t := &csvTag{tag: tag, line: line}
+			tags = append(tags, t)
+			byName[name] = t
+		}
+
+		driver := field("driver")
+		if driver == "" {
+			continue
+		}
+		if _, ok := configured[driver]; !ok {
+			p.addAt(at, "unknown driver %q, expected one of [modbus mqtt goose]", driver)
+			continue
+		}
+		if !configured[driver] {
+			p.addAt(at, "%v is mapped to %v, but no %v configuration is set", name, driver, driver)
+			continue
+		}
+
+		// a tag may be mapped to a driver more than once, such as to several topics, but not repeated
+		key := strings.Join([]string{driver, name, field("register"), field("index"), field("topic"), field("dataset")}, " ")
+		if first, ok := mapped[key]; ok {
+			p.addAt(at, "%v is repeated, first at %v", name, Position{File: file, Line: first})
+			continue
+		}
+		mapped[key] = line
+
+		switch driver {
+		case "modbus":
+
+			register := ModbusRegister(field("register"))
+			switch register {
+			case ModbusCoil, ModbusDiscrete, ModbusInput, ModbusHolding:
+			default:
+				p.addAt(at, "invalid register %q of %v, expected one of [%v %v %v %v]", register, name, ModbusCoil, ModbusDiscrete, ModbusInput, ModbusHolding)
+				continue
+			}
+
+			index, err := strconv.ParseUint(field("index"), 10, 16)
+			if err != nil {
+				p.addAt(at, "invalid index %q of %v, expected 0 to 65535", field("index"), name)
+				continue
+			}
+
+			address := fmt.Sprintf("%v %v", register, index)
+			if first, ok := addresses[address]; ok {
+				p.addAt(at, "duplicate address %v of %v, also used at %v", address, name, Position{File: file, Line: first})
+				continue
+			}
+			addresses[address] = line
+
+			modbus = append(modbus, ModbusTag{Name: name, Type: register, Index: uint16(index)})
+
+		case "mqtt":
+
+			topic := field("topic")
+			if topic == "" {
+				p.addAt(at, "topic of %v is not set", name)
+				continue
+			}
+			mqtt = append(mqtt, MQTTTag{Name: name, Topic: topic})
+
+		case "goose":
+
+			dataset := field("dataset")
+			index, err := strconv.Atoi(field("index"))
+			if dataset == "" || err != nil || index < 0 {
+				p.addAt(at, "dataset and index of %v must be set", name)
+				continue
+			}
+			if name != fmt.Sprintf("%v/%v", dataset, index) {
+				p.addAt(at, "goose tag %v must be named %v/%v", name, dataset, index)
+				continue
+			}
+			datasets[dataset] = append(datasets[dataset], csvIndex{index: index, line: line})
+		}
+	}
+
+	list := []TagListTag{}
+	for _, v := range tags {
+		list = append(list, v.tag)
+	}
+	checkTags(&p, list, func(i int, field string) Position {
+		return Position{File: file, Line: tags[i].line}
+	})
+
+	// the tags of the taglist and modbus configuration may be templates, which the point list would replace
+	existing := TagList{}
+	src, err := decodeRaw(files.TagList, &existing)
+	if err == nil {
+		names, overrides := []string{}, []bool{}
+		for _, v := range existing.Tags {
+			names = append(names, v.Name)
+			overrides = append(overrides, len(v.Overrides) != 0)
+		}
+		checkTemplates(&p, src, "tags", names, overrides)
+	}
+
+	if files.Modbus != "" {
+		existing := Modbus{}
+		src, err := decodeRaw(files.Modbus, &existing)
+		if err == nil {
+			names := []string{}
+			for _, v := range existing.Modbus.Tags {
+				names = append(names, v.Name)
+			}
+			checkTemplates(&p, src, "modbus.tags", names, make([]bool, len(names)))
+		}
+	}
+
+	writes := map[string][]byte{}
+
+	b, err := rewrite(files.TagList, true, func(doc yaml.MapSlice) (map[string]interface{}, error) {
+		return map[string]interface{}{"tags": tagsYAML(list)}, nil
+	})
+	if err != nil {
+		p.addAt(Position{File: files.TagList}, "%v", err)
+	}
+	writes[files.TagList] = b
+
+	if files.Modbus != "" {
+		b, err := rewrite(files.Modbus, false, func(doc yaml.MapSlice) (map[string]interface{}, error) {
+			return setDriverTags(doc, "modbus", modbus)
+		})
+		if err != nil {
+			p.addAt(Position{File: files.Modbus}, "%v", err)
+		}
+		writes[files.Modbus] = b
+	}
+
+	if files.MQTT != "" {
+		b, err := rewrite(files.MQTT, false, func(doc yaml.MapSlice) (map[string]interface{}, error) {
+			return setDriverTags(doc, "mqtt", mqtt)
+		})
+		if err != nil {
+			p.addAt(Position{File: files.MQTT}, "%v", err)
+		}
+		writes[files.MQTT] = b
+	}
+
+	if files.Goose != "" {
+		b, err := rewrite(files.Goose, false, func(doc yaml.MapSlice) (map[string]interface{}, error) {
+			return setDatasetTags(doc, datasets, file)
+		})
+		if err != nil {
+			var errs Errors
+			if errors.As(err, &errs) {
+				p.errs = append(p.errs, errs...)
+			} else {
+				p.addAt(Position{File: files.Goose}, "%v", err)
+			}
+		}
+		writes[files.Goose] = b
+	}
+
+	err = p.err()
+	if err != nil {
+		return err
+	}
+
+	for path, b := range writes {
+		err := os.WriteFile(filepath.Clean(path), b, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write %v: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// mergeTag merges the attributes of a repeated row into the tag, returning an error if an attribute set by both differs
+func mergeTag(tag TagListTag, row TagListTag) (TagListTag, error) {
+
+	merge := func(name string, a *string, b string) error {
+		if b == "" || *a == b {
+			return nil
+		}
+		if *a == "" {
+			*a = b
+			return nil
+		}
+		return fmt.Errorf("%v %q differs from %q", name, b, *a)
+	}
+
+	for _, err := range []error{
+		merge("node_id", &tag.Node, row.Node),
+		merge("namespace", &tag.Namespace, row.Namespace),
+		merge("description", &tag.Description, row.Description),
+		merge("type", &tag.Type, row.Type),
+	} {
+		if err != nil {
+			return tag, err
+		}
+	}
+
+	if row.DefaultValue != 0 && tag.DefaultValue != row.DefaultValue {
+		if tag.DefaultValue != 0 {
+			return tag, fmt.Errorf("default_value %v differs from %v", row.DefaultValue, tag.DefaultValue)
+		}
+		tag.DefaultValue = row.DefaultValue
+	}
+	return tag, nil
+}
+
+// tagsYAML returns the tags as YAML mappings, omitting unset attributes
+func tagsYAML(tags []TagListTag) []yaml.MapSlice {
+
+	result := []yaml.MapSlice{}
+	for _, t := range tags {
+		m := yaml.MapSlice{{Key: "name", Value: t.Name}}
+		for _, v := range []yaml.MapItem{
+			{Key: "node_id", Value: t.Node},
+			{Key: "namespace", Value: t.Namespace},
+			{Key: "description", Value: t.Description},
+			{Key: "type", Value: t.Type},
+		} {
+			if v.Value != "" {
+				m = append(m, v)
+			}
+		}
+		m = append(m, yaml.MapItem{Key: "default_value", Value: t.DefaultValue})
+		result = append(result, m)
+	}
+	return result
+}
+
+// setDriverTags sets the tags of the driver within a driver configuration
+func setDriverTags(doc yaml.MapSlice, driver string, tags interface{}) (map[string]interface{}, error) {
+
+	if _, ok := getKey(doc, driver).(yaml.MapSlice); !ok {
+		return nil, fmt.Errorf("%v is not set", driver)
+	}
+	return map[string]interface{}{driver + ".tags": tags}, nil
+}
+
+// setDatasetTags sets the number of tags of each goose dataset to the number imported.
+// The tags of a dataset must be indexed from 0 without gaps, and a dataset must be configured within an endpoint.
+func setDatasetTags(doc yaml.MapSlice, datasets map[string][]csvIndex, file string) (map[string]interface{}, error) {
+
+	g, ok := getKey(doc, "goose").(yaml.MapSlice)
+	if !ok {
+		return nil, fmt.Errorf("goose is not set")
+	}
+	endpoints, _ := getKey(g, "endpoints").([]interface{})
+
+	p := problems{}
+	found := map[string]bool{}
+	values := map[string]interface{}{}
+
+	for i, e := range endpoints {
+		endpoint, _ := e.(yaml.MapSlice)
+		sets, _ := getKey(endpoint, "datasets").([]interface{})
+		for j, s := range sets {
+			dataset, _ := s.(yaml.MapSlice)
+			name := fmt.Sprint(getKey(dataset, "name"))
+			found[name] = true
+			values[fmt.Sprintf("goose.endpoints[%v].datasets[%v].tags", i, j)] = len(datasets[name])
+		}
+	}
+
+	for name, rows := range datasets {
+		if !found[name] {
+			p.addAt(Position{File: file, Line: rows[0].line}, "goose dataset %v is not configured within an endpoint", name)
+		}
+	}
+	if len(p.errs) != 0 {
+		return nil, p.err()
+	}
+
+	// the indexes of a dataset are unique, as each tag is named by its index, so a gap leaves an index at or above the number of tags
+	for name, rows := range datasets {
+		for _, v := range rows {
+			if v.index >= len(rows) {
+				p.addAt(Position{File: file, Line: v.line}, "goose dataset %v has %v tags, which must be indexed from 0 without gaps, but has index %v", name, len(rows), v.index)
+			}
+		}
+	}
+	return values, p.err()
+}
+
+// checkTemplates adds a problem for each tag template within a taglist or driver configuration, named by names at path within src.
+// An import would replace a template with the tags expanded from it, as the point list holds a row per tag, so is refused until the template is expanded.
+func checkTemplates(p *problems, src *source, path string, names []string, overrides []bool) {
+
+	for i, v := range names {
+		if rangePattern.MatchString(v) || overrides[i] {
+			p.addAt(src.at(fmt.Sprintf("%v[%v].name", path, i)), "%v is a template, which an import would replace with the tags expanded from it, expand the template before importing", v)
+		}
+	}
+}
+
+// rewrite reads the YAML file at path without expansion, and returns the file with the value of each key set by update, by path such as modbus.tags.
+// Only the lines of the keys set are replaced, and every other line, including comments, is retained. A key not set is appended to its parent mapping.
+// A missing file is created from an empty document if create is set.
+func rewrite(path string, create bool, update func(doc yaml.MapSlice) (map[string]interface{}, error)) ([]byte, error) {
+
+	b, err := os.ReadFile(filepath.Clean(path))
+	if err != nil && !(create && errors.Is(err, os.ErrNotExist)) {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	doc := yaml.MapSlice{}
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := update(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for k := range values {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+
+	for _, k := range paths {
+		b, err = splice(b, k, values[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// commentPattern matches the trailing comment of a line holding a plain scalar
+var commentPattern = regexp.MustCompile(`^[^"'#]*?(\s+#.*)$`)
+
+// splice returns the block style YAML file b with the value of the key at path replaced by value, retaining every other line.
+// A key not set is inserted after the last line of its parent mapping, or at the end of the file if at the top level.
+func splice(b []byte, path string, value interface{}) ([]byte, error) {
+
+	lines := strings.Split(string(b), "\n")
+	at := index(b)
+
+	key, parent := path, ""
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		key, parent = path[i+1:], path[:i]
+	}
+
+	start, end, indent := 0, 0, 0
+	comment := ""
+
+	if line, ok := at[path]; ok {
+
+		start = line - 1
+		indent = keyIndent(lines[start])
+		end = blockEnd(lines, start, indent, true)
+		if end == start+1 {
+			if m := commentPattern.FindStringSubmatch(lines[start]); m != nil {
+				comment = m[1]
+			}
+		}
+
+	} else if parent == "" {
+
+		start = len(lines)
+		if lines[start-1] == "" {
+			start--
+		}
+		end = start
+
+	} else {
+
+		line, ok := at[parent]
+		if !ok {
+			return nil, fmt.Errorf("%v is not set", parent)
+		}
+		raw := lines[line-1]
+		content := strings.TrimLeft(raw, " ")
+
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			// the keys of an item are indented as the key following its dash
+			start = blockEnd(lines, line-1, len(raw)-len(content), false)
+			indent = keyIndent(raw)
+		} else {
+			start = blockEnd(lines, line-1, len(raw)-len(content), true)
+			indent = -1
+			for _, v := range lines[line:start] {
+				c := strings.TrimLeft(v, " ")
+				if c != "" && !strings.HasPrefix(c, "#") {
+					if !strings.HasPrefix(c, "-") {
+						indent = len(v) - len(c)
+					}
+					break
+				}
+			}
+			if indent < 0 {
+				return nil, fmt.Errorf("%v is not a block mapping", parent)
+			}
+		}
+		end = start
+	}
+
+	out, err := yaml.Marshal(yaml.MapSlice{{Key: key, Value: value}})
+	if err != nil {
+		return nil, err
+	}
+
+	block := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	for i := range block {
+		block[i] = strings.Repeat(" ", indent) + block[i]
+	}
+	if at[path] != 0 {
+		// a key following the dash of an item retains its dash
+		block[0] = lines[start][:indent] + strings.TrimLeft(block[0], " ")
+	}
+	if len(block) == 1 {
+		block[0] += comment
+	}
+
+	result := append([]string{}, lines[:start]...)
+	result = append(result, block...)
+	result = append(result, lines[end:]...)
+	return []byte(strings.Join(result, "\n")), nil
+}
+
+// keyIndent returns the indent of the key of a line, following the dash of an item if set
+func keyIndent(raw string) int {
+
+	content := strings.TrimLeft(raw, " ")
+	if content == "-" || strings.HasPrefix(content, "- ") {
+		content = strings.TrimLeft(content[1:], " ")
+	}
+	return len(raw) - len(content)
+}
+
+// blockEnd returns the line following the block of the key or item at start, indented by indent, excluding trailing blank and comment lines.
+// If compact is set, a sequence at the same indent, such as that of a key, is within the block.
+func blockEnd(lines []string, start int, indent int, compact bool) int {
+
+	end := start + 1
+	for i := start + 1; i < len(lines); i++ {
+		content := strings.TrimLeft(lines[i], " ")
+		if content == "" || strings.HasPrefix(content, "#") {
+			continue
+		}
+		n := len(lines[i]) - len(content)
+		if n > indent || compact && n == indent && (content == "-" || strings.HasPrefix(content, "- ")) {
+			end = i + 1
+			continue
+		}
+		break
+	}
+	return end
+}
+
+// decodeRaw reads the YAML file at path into out, without expanding environment variables and file references
+func decodeRaw(path string, out interface{}) (*source, error) {
+
+	b, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	err = yaml.Unmarshal(b, out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %w", path, err)
+	}
+	return &source{file: path, lines: index(b)}, nil
+}
+
+// getKey returns the value of key within m, or nil
+func getKey(m yaml.MapSlice, key string) interface{} {
+
+	for _, v := range m {
+		if v.Key == key {
+			return v.Value
+		}
+	}
+	return nil
+}
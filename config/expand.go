@@ -0,0 +1,193 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// scalarPrefix matches the indentation, list item and key preceding the scalar value of a line
+const scalarPrefix = `^([ \t]*(?:-[ \t]+)?(?:[^\s#][^:#\n]*:[ \t]+)?)`
+
+var (
+	// envPattern matches ${NAME} and ${NAME:-default}, or the escape $${
+	envPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+	// plainPattern matches an unquoted scalar value, of a key or of a list item, and any trailing comment
+	plainPattern = regexp.MustCompile(scalarPrefix + `([^\s"'\[{|>#].*?)([ \t]+#.*)?[ \t]*$`)
+	// quotedPattern matches a single or double quoted scalar value, of a key or of a list item
+	quotedPattern = regexp.MustCompile(scalarPrefix + `(["'])(.*)$`)
+	// filePattern matches an unquoted scalar value of file:<path>, of a key or of a list item
+	filePattern = regexp.MustCompile(scalarPrefix + `file:(\S+)[ \t]*$`)
+)
+
+// decode reads the YAML file at path into out, rejecting unknown fields, after expanding environment variables and file references.
+// The source returned locates the paths of the file, for validation.
+func decode(path string, out interface{}) (*source, error) {
+
+	b, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	b, err = expand(b, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	y := yaml.NewDecoder(bytes.NewReader(b))
+	y.SetStrict(true)
+
+	err = y.Decode(out)
+	if err != nil {
+		return nil, err
+	}
+	return &source{file: path, lines: index(b)}, nil
+}
+
+// expand replaces ${NAME} with the environment variable NAME, or the default of ${NAME:-default} if NAME is unset, and $${ with ${.
+// An unquoted scalar is quoted after expansion if it would otherwise not be read as the expanded string, such as a value containing ": " or " #",
+// and a value substituted within a quoted scalar is escaped, such that the value of a variable is always read literally, including a value of file:<path>.
+// An unquoted scalar of file:<path> within the file is replaced with the contents of the file, trimmed of surrounding whitespace, such as a docker secret,
+// where path may hold environment variables, and a relative path is relative to dir.
+// Comments are not expanded, and each line is expanded in place, such that line numbers are retained.
+func expand(b []byte, dir string) ([]byte, error) {
+
+	lines := strings.Split(string(b), "\n")
+
+	for i, line := range lines {
+
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		if sub := filePattern.FindStringSubmatch(line); sub != nil {
+
+			path, err := expandEnv(sub[2], i+1, nil)
+			if err != nil {
+				return nil, err
+			}
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+
+			content, err := os.ReadFile(filepath.Clean(path))
+			if err != nil {
+				return nil, fmt.Errorf("line %v: failed to read file reference: %w", i+1, err)
+			}
+			lines[i] = sub[1] + strconv.Quote(strings.TrimSpace(string(content)))
+			continue
+		}
+
+		var err error
+		switch {
+		case !strings.Contains(line, "${"):
+		case quotedPattern.MatchString(line):
+			sub := quotedPattern.FindStringSubmatch(line)
+
+			// the text following the closing quote, such as a comment, is not expanded
+			value, rest := sub[3], ""
+			if j := closing(value, sub[2]); j >= 0 {
+				value, rest = value[:j], value[j:]
+			}
+
+			var v string
+			v, err = expandEnv(value, i+1, func(s string) string {
+				if sub[2] == "'" {
+					return strings.ReplaceAll(s, "'", "''")
+				}
+				q := strconv.Quote(s)
+				return q[1 : len(q)-1]
+			})
+			line = sub[1] + sub[2] + v + rest
+		case plainPattern.MatchString(line):
+			sub := plainPattern.FindStringSubmatch(line)
+			var v string
+			v, err = expandEnv(sub[2], i+1, nil)
+			if !plain(v) {
+				v = strconv.Quote(v)
+			}
+			line = sub[1] + v + sub[3]
+		default:
+			line, err = expandEnv(line, i+1, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		lines[i] = line
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// expandEnv replaces the environment variables of s, on line, with each value passed through escape if set
+func expandEnv(s string, line int, escape func(string) string) (string, error) {
+
+	var err error
+	s = envPattern.ReplaceAllStringFunc(s, func(m string) string {
+
+		if m == "$${" {
+			return "${"
+		}
+
+		sub := envPattern.FindStringSubmatch(m)
+		v, ok := os.LookupEnv(sub[1])
+		if !ok && sub[2] != "" {
+			v = sub[3]
+		} else if !ok && err == nil {
+			err = fmt.Errorf("line %v: environment variable %v is not set", line, sub[1])
+		}
+		if escape != nil {
+			return escape(v)
+		}
+		return v
+	})
+	return s, err
+}
+
+// closing returns the index of the quote closing a scalar opened by quote, within s following the opening quote, or -1 if it continues onto the next line.
+// A double quoted scalar escapes a quote with a backslash, and a single quoted scalar by repeating the quote.
+func closing(s string, quote string) int {
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote == `"` && s[i] == '\\':
+			i++
+		case s[i] != quote[0]:
+		case quote == "'" && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+// plain returns true if v is read unchanged as an unquoted scalar, or as a number, bool or null
+func plain(v string) bool {
+
+	m := map[string]interface{}{}
+	err := yaml.Unmarshal([]byte("v: "+v), &m)
+	if err != nil || len(m) != 1 {
+		return false
+	}
+
+	switch x := m["v"].(type) {
+	case string:
+		return x == v
+	case map[interface{}]interface{}, []interface{}:
+		return false
+	default:
+		return true
+	}
+}
@@ -5,8 +5,9 @@
 package config
 
 type Goose struct {
-	Meta  ConfigMeta
-	Goose GooseDriver
+	Meta   ConfigMeta
+	Goose  GooseDriver
+	source *source
 }
 
 type GooseDriver struct {
@@ -17,8 +18,13 @@ type GooseDriver struct {
 type GooseDevice struct {
 	Label     string `yaml:"label"`
 	Interface string `yaml:"interface"`
-	LogHeader bool   `yaml:"log_header"`
-	LogValues bool   `yaml:"log_values"`
+	// LogHeader logs the header of each message received, and LogValues also its values
+	LogHeader bool `yaml:"log_header"`
+	LogValues bool `yaml:"log_values"`
+	// FailSafe applies to the tags of a dataset once the time allowed to live of its last message has expired
+	FailSafe FailSafe `yaml:"failsafe"`
+	// LogLevel is the least severe level logged by the driver, in place of that of the process
+	LogLevel string `yaml:"log_level"`
 }
 
 type GooseEndpoint struct {
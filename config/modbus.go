@@ -20,8 +20,10 @@ const (
 )
 
 type Modbus struct {
-	Meta   ConfigMeta
-	Modbus ModbusDriver
+	Meta    ConfigMeta
+	Modbus  ModbusDriver
+	source  *source
+	origins []origin
 }
 
 type ModbusDriver struct {
@@ -36,8 +38,17 @@ type ModbusDevice struct {
 	ScantimeMs int   `yaml:"scantime_ms"`
 	TimeoutMs  int   `yaml:"timeout_ms"`
 	Slave      uint8 `yaml:"slave_id"`
+	// FailSafe applies to discrete and input tags on loss of the device, FailSafeOutputs to coils and holding registers on loss of OPC,
+	// or to a single coil or holding register of which the OPC value is not good, and also on shutdown if FailSafeShutdown is set
+	FailSafe         FailSafe `yaml:"failsafe"`
+	FailSafeOutputs  FailSafe `yaml:"failsafe_outputs"`
+	FailSafeShutdown bool     `yaml:"failsafe_shutdown"`
+	// LogLevel is the least severe level logged by the driver, in place of that of the process
+	LogLevel string `yaml:"log_level"`
 }
 
+// ModbusTag is a register mapped to a tag, or a template of registers where the name holds a range such as X/{0..25},
+// which is expanded to a tag per value of the range from index, incremented for each tag
 type ModbusTag struct {
 	Name  string
 	Type  ModbusRegister
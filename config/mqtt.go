@@ -5,8 +5,9 @@
 package config
 
 type MQTT struct {
-	Meta ConfigMeta
-	Mqtt MQTTDriver
+	Meta   ConfigMeta
+	Mqtt   MQTTDriver
+	source *source
 }
 
 type MQTTDriver struct {
@@ -22,6 +23,8 @@ type MQTTDevice struct {
 	Token          string
 	SubscriptionMs int `yaml:"subscription_ms"`
 	KeepAliveMs    int `yaml:"keepalive_ms"`
+	// LogLevel is the least severe level logged by the driver, in place of that of the process
+	LogLevel string `yaml:"log_level"`
 }
 
 type MQTTTag struct {
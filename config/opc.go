@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+type OPCAuthMode string
+
+const (
+	OPCAuthAnonymous   OPCAuthMode = "anonymous"
+	OPCAuthUsername    OPCAuthMode = "username"
+	OPCAuthCertificate OPCAuthMode = "certificate"
+)
+
+type OPC struct {
+	Meta   ConfigMeta
+	Opc    OPCClient
+	Server OPCServer
+	source *source
+}
+
+// OPCClient configures the connection to the OPC server.
+// If only one of security_policy and security_mode is set, the most secure endpoint of the server matching it is selected.
+// Under a security policy other than None, the server certificate must be one of trusted_certificates, or be valid and issued by one of them.
+// A server certificate is only accepted unverified if trusted_certificates is empty and insecure_skip_verify is set.
+type OPCClient struct {
+	Endpoint            string   `yaml:"endpoint"`
+	SecurityPolicy      string   `yaml:"security_policy"`
+	SecurityMode        string   `yaml:"security_mode"`
+	Certificate         string   `yaml:"certificate"`
+	PrivateKey          string   `yaml:"private_key"`
+	TrustedCertificates []string `yaml:"trusted_certificates"`
+	InsecureSkipVerify  bool     `yaml:"insecure_skip_verify"`
+	Auth                OPCAuth  `yaml:"auth"`
+	KeepAliveMs         int      `yaml:"keepalive_ms"`
+	ReconnectMinMs      int      `yaml:"reconnect_min_ms"`
+	ReconnectMaxMs      int      `yaml:"reconnect_max_ms"`
+	Provision           bool     `yaml:"provision"`
+}
+
+type OPCAuth struct {
+	Mode        OPCAuthMode `yaml:"mode"`
+	Username    string      `yaml:"username"`
+	Password    string      `yaml:"password"`
+	Certificate string      `yaml:"certificate"`
+}
+
+// OPCServer configures the embedded OPC server, which is enabled if endpoint is set.
+// As the server does not enforce security, the endpoint must be a loopback address, and an endpoint without a host is bound to loopback.
+type OPCServer struct {
+	Endpoint     string `yaml:"endpoint"`
+	NamespaceURI string `yaml:"namespace_uri"`
+}
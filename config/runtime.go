@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+// Runtime lists the driver instances to run within a single process, sharing the taglist and OPC configuration.
+// It may also set the OPC configuration and taglist, in place of CONFIG_OPC and CONFIG_TAGLIST, as a single configuration.
+// The taglist file is included, followed by any tags set within the runtime configuration.
+type Runtime struct {
+	Meta    ConfigMeta
+	Opc     OPCClient       `yaml:"opc"`
+	Server  OPCServer       `yaml:"server"`
+	TagList string          `yaml:"taglist"`
+	Tags    []TagListTag    `yaml:"tags"`
+	Drivers []RuntimeDriver `yaml:"drivers"`
+	Restart RuntimeRestart  `yaml:"restart"`
+	// ShutdownMs is the time allowed for the drivers to stop once a shutdown is signalled
+	ShutdownMs int         `yaml:"shutdown_ms"`
+	Log        Log         `yaml:"log"`
+	HTTP       RuntimeHTTP `yaml:"http"`
+	source     *source
+	// origins locates each tag, within the included taglist or the runtime configuration
+	origins []origin
+}
+
+// RuntimeDriver is a driver instance, with the configuration file of the driver. A relative config path is relative to the runtime configuration.
+type RuntimeDriver struct {
+	Name   string `yaml:"name"`
+	Driver string `yaml:"driver"`
+	Config string `yaml:"config"`
+}
+
+// RuntimeRestart is the restart policy of each driver instance. A failed instance is restarted with a backoff between backoff_min_ms and backoff_max_ms,
+// and is marked as failed and no longer restarted once it has been restarted max_restarts times within window_ms. A max_restarts of 0 restarts without limit.
+type RuntimeRestart struct {
+	BackoffMinMs int `yaml:"backoff_min_ms"`
+	BackoffMaxMs int `yaml:"backoff_max_ms"`
+	MaxRestarts  int `yaml:"max_restarts"`
+	WindowMs     int `yaml:"window_ms"`
+}
+
+// RuntimeHTTP is the HTTP server of tel, serving the metrics of the drivers on /metrics, and their health and readiness on /healthz and /readyz.
+// Listen is the address served, such as :9100, and the server is disabled if unset. A driver is unhealthy once it has completed no cycle
+// within health_factor times its scan time, or has been disconnected from OPC for health_factor times the longer of its scan time
+// and the OPC keepalive interval. A driver without a scan time, of which cycles follow changes, is instead unhealthy once no OPC
+// keepalive has succeeded within health_factor times the keepalive interval. health_factor defaults to 10.
+type RuntimeHTTP struct {
+	Listen       string `yaml:"listen"`
+	HealthFactor int    `yaml:"health_factor"`
+}
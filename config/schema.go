@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"tel/logging"
+)
+
+// schemas are the configuration files for which a JSON Schema is generated, by name
+var schemas = map[string]interface{}{
+	"taglist": TagList{},
+	"modbus":  Modbus{},
+	"mqtt":    MQTT{},
+	"goose":   Goose{},
+	"opc":     OPC{},
+	"runtime": Runtime{},
+}
+
+// schemaEnums are the values of string types with a fixed set of values
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(FailSafe("")):       {string(FailSafeHold), string(FailSafeDefault), string(FailSafeBad)},
+	reflect.TypeOf(ModbusRegister("")): {ModbusCoil, ModbusDiscrete, ModbusInput, ModbusHolding},
+	reflect.TypeOf(OPCAuthMode("")):    {string(OPCAuthAnonymous), string(OPCAuthUsername), string(OPCAuthCertificate)},
+}
+
+// schemaField constrains a field beyond its type
+type schemaField struct {
+	enum     []string
+	required bool
+}
+
+// schemaFields are the constraints of fields, by <type>.<field>
+var schemaFields = map[string]schemaField{
+	"TagListTag.Name":        {required: true},
+	"TagListTag.Type":        {enum: TagTypes},
+	"TagListOverride.Type":   {enum: TagTypes},
+	"ModbusDevice.Mode":      {enum: []string{string(ModbusModeTCP)}},
+	"ModbusTag.Name":         {required: true},
+	"ModbusTag.Type":         {required: true},
+	"MQTTTag.Name":           {required: true},
+	"MQTTTag.Topic":          {required: true},
+	"GooseDataset.Name":      {required: true},
+	"OPCClient.SecurityMode": {enum: []string{"None", "Sign", "SignAndEncrypt"}},
+	"RuntimeDriver.Name":     {required: true},
+	"RuntimeDriver.Driver":   {required: true},
+	"RuntimeDriver.Config":   {required: true},
+	"Log.Level":              {enum: logging.Levels},
+	"Log.Format":             {enum: logging.Formats},
+	"ModbusDevice.LogLevel":  {enum: logging.Levels},
+	"MQTTDevice.LogLevel":    {enum: logging.Levels},
+	"GooseDevice.LogLevel":   {enum: logging.Levels},
+}
+
+// SchemaNames returns the names of the configuration files for which a JSON Schema is generated, in order
+func SchemaNames() []string {
+
+	names := []string{}
+	for k := range schemas {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Schema returns the JSON Schema of the configuration file name, such as taglist, generated from its type.
+// Properties are named as decoded from YAML, and unknown properties are rejected as by the strict decoding of the file.
+// A value set by an environment variable is validated as written, so ${NAME} within a number is reported as invalid.
+func Schema(name string) ([]byte, error) {
+
+	v, ok := schemas[name]
+	if !ok {
+		return nil, fmt.Errorf("no schema for %v, expected one of %v", name, SchemaNames())
+	}
+
+	s := schemaOf(reflect.TypeOf(v))
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = fmt.Sprintf("tel %v configuration", name)
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// schemaOf returns the schema of a value of type t
+func schemaOf(t reflect.Type) map[string]interface{} {
+
+	if enum, ok := schemaEnums[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": enum}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.Struct:
+		return schemaObject(t)
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		s := map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+		if t.Key().Kind() == reflect.Int {
+			s["propertyNames"] = map[string]interface{}{"pattern": "^[0-9]+$"}
+		}
+		return s
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint8:
+		return map[string]interface{}{"type": "integer", "minimum": 0, "maximum": math.MaxUint8}
+	case reflect.Uint16:
+		return map[string]interface{}{"type": "integer", "minimum": 0, "maximum": math.MaxUint16}
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// schemaObject returns the schema of a struct, with a property per exported field, named by its yaml tag or else its lowercased name
+func schemaObject(t reflect.Type) map[string]interface{} {
+
+	properties := map[string]interface{}{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		s := schemaOf(f.Type)
+		c := schemaFields[t.Name()+"."+f.Name]
+		if c.enum != nil {
+			s["enum"] = c.enum
+		}
+		if c.required {
+			required = append(required, name)
+		}
+		properties[name] = s
+	}
+
+	s := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) != 0 {
+		s["required"] = required
+	}
+	return s
+}
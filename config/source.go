@@ -0,0 +1,196 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Position is a line within a configuration file, the line is 0 if unknown
+type Position struct {
+	File string
+	Line int
+}
+
+func (p Position) String() string {
+
+	if p.Line == 0 {
+		return p.File
+	}
+	return fmt.Sprintf("%v:%v", p.File, p.Line)
+}
+
+// Error is a problem within a configuration file
+type Error struct {
+	Position
+	Msg string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Position, e.Msg)
+}
+
+// Errors is every problem found within a configuration, each with its position
+type Errors []Error
+
+func (e Errors) Error() string {
+
+	lines := []string{}
+	for _, v := range e {
+		lines = append(lines, v.Error())
+	}
+	return fmt.Sprintf("%v configuration errors:\n  %v", len(e), strings.Join(lines, "\n  "))
+}
+
+// source is a configuration file, with the line of each path within it, such as tags[2].name
+type source struct {
+	file  string
+	lines map[string]int
+}
+
+// at returns the position of path, or of its nearest parent if path is not set within the file
+func (s *source) at(path string) Position {
+
+	if s == nil {
+		return Position{}
+	}
+
+	for path != "" {
+		if line, ok := s.lines[path]; ok {
+			return Position{File: s.file, Line: line}
+		}
+
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return Position{File: s.file}
+}
+
+// has returns whether path is set within the file
+func (s *source) has(path string) bool {
+
+	if s == nil {
+		return false
+	}
+	_, ok := s.lines[path]
+	return ok
+}
+
+// problems collects the errors of a configuration file
+type problems struct {
+	src  *source
+	errs Errors
+}
+
+// add adds a problem at path within the source
+func (p *problems) add(path string, format string, a ...interface{}) {
+	p.addAt(p.src.at(path), format, a...)
+}
+
+// addAt adds a problem at pos, such as within an included file
+func (p *problems) addAt(pos Position, format string, a ...interface{}) {
+	p.errs = append(p.errs, Error{Position: pos, Msg: fmt.Sprintf(format, a...)})
+}
+
+// err returns the collected errors, or nil if there are none
+func (p *problems) err() error {
+
+	if len(p.errs) == 0 {
+		return nil
+	}
+	return p.errs
+}
+
+// frame is a mapping key or sequence item enclosing the lines that follow it
+type frame struct {
+	indent int
+	path   string
+	items  int
+	item   bool
+}
+
+// index returns the line of each mapping key and sequence item within a block style YAML document, by path such as modbus.tags[2].index.
+// Flow style collections and multi-line scalars are not indexed, and a path within them resolves to its nearest indexed parent.
+func index(b []byte) map[string]int {
+
+	lines := map[string]int{}
+	stack := []*frame{{indent: -1}}
+
+	for n, raw := range strings.Split(string(b), "\n") {
+
+		content := strings.TrimLeft(raw, " ")
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+		indent := len(raw) - len(content)
+
+		if content == "-" || strings.HasPrefix(content, "- ") {
+
+			// pop deeper frames, and any sibling item, leaving the key of the sequence
+			for len(stack) > 1 {
+				top := stack[len(stack)-1]
+				if top.indent < indent || top.indent == indent && !top.item {
+					break
+				}
+				stack = stack[:len(stack)-1]
+			}
+
+			parent := stack[len(stack)-1]
+			path := fmt.Sprintf("%v[%v]", parent.path, parent.items)
+			parent.items++
+
+			lines[path] = n + 1
+			stack = append(stack, &frame{indent: indent, path: path, item: true})
+
+			// the first key of a mapping may follow the dash
+			content = strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+			indent = len(raw) - len(content)
+			if content == "" {
+				continue
+			}
+		}
+
+		key, ok := mappingKey(content)
+		if !ok {
+			continue
+		}
+
+		for len(stack) > 1 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		path := key
+		if parent := stack[len(stack)-1].path; parent != "" {
+			path = parent + "." + key
+		}
+
+		lines[path] = n + 1
+		stack = append(stack, &frame{indent: indent, path: path})
+	}
+
+	return lines
+}
+
+// mappingKey returns the key of a line of the form key: value, or key:
+func mappingKey(content string) (string, bool) {
+
+	i := strings.Index(content, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(content, ":") {
+			return "", false
+		}
+		i = len(content) - 1
+	}
+
+	key := content[:i]
+	if key == "" || strings.ContainsAny(key, "\"'{}[],#") {
+		return "", false
+	}
+	return key, true
+}
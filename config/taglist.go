@@ -11,24 +11,54 @@ import (
 )
 
 type TagList struct {
-	Meta ConfigMeta   `yaml:"meta"`
-	Tags []TagListTag `yaml:"tags"`
+	Meta    ConfigMeta   `yaml:"meta"`
+	Tags    []TagListTag `yaml:"tags"`
+	source  *source
+	origins []origin
 }
 
+// TagListTag is a tag, or a template of tags where the name holds a range such as X/{0..25}, which is expanded to a tag per value of the range when loaded.
+// The node_id, namespace and description of a template may hold {}, which is replaced by the value, or a range of their own of the same length.
 type TagListTag struct {
 	Name         string  `yaml:"name"`
+	Node         string  `yaml:"node_id"`
 	Namespace    string  `yaml:"namespace"`
 	Description  string  `yaml:"description"`
 	Type         string  `yaml:"type"`
 	DefaultValue float64 `yaml:"default_value"`
+	// Overrides sets the attributes of the tags of a template by value of the range, and is not set once expanded
+	Overrides map[int]TagListOverride `yaml:"overrides,omitempty"`
 }
 
-func (t TagListTag) NodeID() (ua.NodeID, error) {
+// TagListOverride sets attributes of a tag expanded from a template, in place of those of the template
+type TagListOverride struct {
+	Node         *string  `yaml:"node_id"`
+	Namespace    *string  `yaml:"namespace"`
+	Description  *string  `yaml:"description"`
+	Type         *string  `yaml:"type"`
+	DefaultValue *float64 `yaml:"default_value"`
+}
+
+// NodeID returns the OPC node ID of the tag, parsed from node_id if set, else defaulting to ns=1;s=<name>.
+// Numeric (i=), string (s=), GUID (g=) and opaque (b=) identifiers are supported, and a namespace URI (nsu=) is resolved
+// to its index within namespaces, the NamespaceArray of the server.
+func (t TagListTag) NodeID(namespaces []string) (ua.NodeID, error) {
 
-	id, err := ua.ParseNodeID("ns=1;s=" + t.Name)
+	if t.Node == "" {
+		id, err := ua.ParseNodeID("ns=1;s=" + t.Name)
+		if err != nil {
+			return ua.NodeID{}, fmt.Errorf("node id could not be parsed: %v", err)
+		}
+		return *id, nil
+	}
+
+	id, err := ua.ParseExpandedNodeID(t.Node, namespaces)
 	if err != nil {
-		return ua.NodeID{}, fmt.Errorf("node id could not be parsed: %v", err)
+		return ua.NodeID{}, fmt.Errorf("node id %v could not be parsed: %v", t.Node, err)
+	}
+	if id.HasServerIndex() {
+		return ua.NodeID{}, fmt.Errorf("node id %v has a server index, which is not supported", t.Node)
 	}
 
-	return *id, nil
+	return *id.NodeID, nil
 }
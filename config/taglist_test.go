@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagNodeID(t *testing.T) {
+
+	namespaces := []string{"http://opcfoundation.org/UA/", "urn:tel", "urn:vendor:plc"}
+
+	cases := []struct {
+		tag    TagListTag
+		expect string
+	}{
+		{tag: TagListTag{Name: "VALVE_OPEN"}, expect: "ns=1;s=VALVE_OPEN"},
+		{tag: TagListTag{Name: "A", Node: "ns=3;i=1001"}, expect: "ns=3;i=1001"},
+		{tag: TagListTag{Name: "B", Node: "ns=2;s=Line1.Valve"}, expect: "ns=2;s=Line1.Valve"},
+		{tag: TagListTag{Name: "C", Node: "ns=2;g=72962B91-FA75-4AE6-8D28-B404DC7DAF63"}, expect: "ns=2;g=72962B91-FA75-4AE6-8D28-B404DC7DAF63"},
+		{tag: TagListTag{Name: "D", Node: "ns=2;b=dGVs"}, expect: "ns=2;b=dGVs"},
+		{tag: TagListTag{Name: "E", Node: "nsu=urn:vendor:plc;i=42"}, expect: "ns=2;i=42"},
+	}
+
+	for _, c := range cases {
+		nid, err := c.tag.NodeID(namespaces)
+		if err != nil {
+			t.Fatalf("failed to resolve %v: %v", c.tag.Name, err)
+		}
+		if nid.String() != c.expect {
+			t.Fatalf("%v: expected %v, got %v", c.tag.Name, c.expect, nid.String())
+		}
+	}
+
+	_, err := TagListTag{Name: "F", Node: "nsu=urn:missing;i=1"}.NodeID(namespaces)
+	if err == nil {
+		t.Fatalf("expected unknown namespace uri to fail")
+	}
+
+	_, err = TagListTag{Name: "G", Node: "nsu=urn:tel;i=1"}.NodeID(nil)
+	if err == nil {
+		t.Fatalf("expected namespace uri without namespaces to fail")
+	}
+}
+
+func TestTagTemplate(t *testing.T) {
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"taglist.yml": "tags:\n  - name: A\n  - name: X/{08..11}\n    node_id: ns=2;i={1008..1011}\n    description: X {}\n    type: uint16\n" +
+			"    overrides:\n      10:\n        type: bool\n        description: breaker\n",
+		"modbus.yml": "modbus:\n  device:\n    mode: tcp\n    scantime_ms: 100\n    timeout_ms: 1000\n  tags:\n" +
+			"    - name: X/{08..11}\n      type: input\n      index: 20\n    - name: A\n      type: input\n      index: 22\n",
+		"invalid.yml": "tags:\n  - name: Y/{0..3}\n    node_id: ns=2;i={0..1}\n    overrides:\n      4:\n        type: bool\n",
+	}
+	for k, v := range files {
+		err := os.WriteFile(filepath.Join(dir, k), []byte(v), 0600)
+		if err != nil {
+			t.Fatalf("failed to write %v: %v", k, err)
+		}
+	}
+
+	tags, err := LoadTagList(filepath.Join(dir, "taglist.yml"))
+	if err != nil {
+		t.Fatalf("failed to load taglist: %v", err)
+	}
+	expect := []TagListTag{
+		{Name: "A"},
+		{Name: "X/08", Node: "ns=2;i=1008", Description: "X 08", Type: "uint16"},
+		{Name: "X/09", Node: "ns=2;i=1009", Description: "X 09", Type: "uint16"},
+		{Name: "X/10", Node: "ns=2;i=1010", Description: "breaker", Type: "bool"},
+		{Name: "X/11", Node: "ns=2;i=1011", Description: "X 11", Type: "uint16"},
+	}
+	if !reflect.DeepEqual(tags.Tags, expect) {
+		t.Fatalf("expected %+v, got %+v", expect, tags.Tags)
+	}
+
+	mods, err := LoadModbus(filepath.Join(dir, "modbus.yml"))
+	if err == nil {
+		t.Fatalf("expected the duplicate address of A to fail, got %+v", mods.Modbus.Tags)
+	}
+	if !strings.HasPrefix(err.Error(), "1 configuration errors:\n  "+filepath.Join(dir, "modbus.yml:12: duplicate address input 22 of A, also used by X/10 at "+filepath.Join(dir, "modbus.yml:7"))) {
+		t.Fatalf("expected the duplicate address to be located, got %v", err)
+	}
+
+	_, err = LoadTagList(filepath.Join(dir, "invalid.yml"))
+	errs := Errors{}
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected 2 configuration errors, got %v", err)
+	}
+	if errs[0].Line != 3 || errs[1].Line != 5 {
+		t.Fatalf("expected errors at lines 3 and 5, got %v", err)
+	}
+
+	// the attributes of an override are located within the override
+	err = os.WriteFile(filepath.Join(dir, "invalid.yml"), []byte("tags:\n  - name: Z/{0..1}\n    overrides:\n      1:\n        type: uint17\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write invalid.yml: %v", err)
+	}
+	_, err = LoadTagList(filepath.Join(dir, "invalid.yml"))
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Line != 5 {
+		t.Fatalf("expected the unknown type of Z/1 at line 5, got %v", err)
+	}
+}
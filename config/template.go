@@ -0,0 +1,247 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rangePattern matches a range {from..to} within a tag template, such as X/{0..25}
+var rangePattern = regexp.MustCompile(`\{([0-9]+)\.\.([0-9]+)\}`)
+
+// maxExpansion is the most tags a single template may expand to
+const maxExpansion = 65536
+
+// origin locates a tag within its configuration file, by the path of the entry it was expanded from, and of the override applied to it if any
+type origin struct {
+	src      *source
+	entry    string
+	override string
+}
+
+// at returns the position of field of the tag, within its override if the override sets field
+func (o origin) at(field string) Position {
+
+	if o.override != "" && o.src.has(o.override+"."+field) {
+		return o.src.at(o.override + "." + field)
+	}
+	return o.src.at(o.entry + "." + field)
+}
+
+// tagRange is a range {from..to} within a template, between prefix and suffix. Each value is zero padded to width digits,
+// where from is written with a leading zero, such that {00..25} expands to 00, 01 ... 25
+type tagRange struct {
+	prefix string
+	suffix string
+	from   int
+	to     int
+	width  int
+}
+
+// parseRange returns the range within s, or false if s holds no range
+func parseRange(s string) (tagRange, bool, error) {
+
+	m := rangePattern.FindAllStringSubmatchIndex(s, -1)
+	if len(m) == 0 {
+		return tagRange{}, false, nil
+	}
+	if len(m) > 1 {
+		return tagRange{}, true, fmt.Errorf("%q holds more than one range", s)
+	}
+
+	f, t := s[m[0][2]:m[0][3]], s[m[0][4]:m[0][5]]
+	from, err := strconv.Atoi(f)
+	if err != nil {
+		return tagRange{}, true, fmt.Errorf("invalid range of %q: %w", s, err)
+	}
+	to, err := strconv.Atoi(t)
+	if err != nil {
+		return tagRange{}, true, fmt.Errorf("invalid range of %q: %w", s, err)
+	}
+	if to < from {
+		return tagRange{}, true, fmt.Errorf("range {%v..%v} of %q must be ascending", f, t, s)
+	}
+	if to-from >= maxExpansion {
+		return tagRange{}, true, fmt.Errorf("range {%v..%v} of %q expands to more than %v tags", f, t, s, maxExpansion)
+	}
+
+	r := tagRange{prefix: s[:m[0][0]], suffix: s[m[0][1]:], from: from, to: to}
+	if len(f) > 1 && f[0] == '0' {
+		r.width = len(f)
+	}
+	return r, true, nil
+}
+
+// count returns the number of values of the range
+func (r tagRange) count() int {
+	return r.to - r.from + 1
+}
+
+// value returns the kth value of the range, formatted to its width
+func (r tagRange) value(k int) string {
+	return fmt.Sprintf("%0*d", r.width, r.from+k)
+}
+
+// expand returns s with the range replaced by its kth value
+func (r tagRange) expand(k int) string {
+	return r.prefix + r.value(k) + r.suffix
+}
+
+// tagField is a string attribute of a template, which is expanded with the name of each tag.
+// An attribute holding {} is expanded to the value of the range of the name, and an attribute holding a range of its own,
+// such as a node_id of ns=2;i={1000..1025}, is expanded in step with the name, and must be of the same length.
+type tagField struct {
+	value string
+	r     tagRange
+	ok    bool
+}
+
+func parseField(name tagRange, value string) (tagField, error) {
+
+	r, ok, err := parseRange(value)
+	if err != nil {
+		return tagField{}, err
+	}
+	if ok && r.count() != name.count() {
+		return tagField{}, fmt.Errorf("range of %q expands to %v values, but the name expands to %v", value, r.count(), name.count())
+	}
+	return tagField{value: value, r: r, ok: ok}, nil
+}
+
+// expand returns the attribute of the kth tag of the name
+func (f tagField) expand(name tagRange, k int) string {
+
+	if f.ok {
+		return f.r.expand(k)
+	}
+	return strings.ReplaceAll(f.value, "{}", name.value(k))
+}
+
+// expandTags expands each tag of which the name holds a range, such as X/{0..25}, to a tag per value of the range, and applies the override of each value.
+// The tags are located at path within src, and the origin of each expanded tag is returned.
+func expandTags(src *source, path string, tags []TagListTag) ([]TagListTag, []origin, error) {
+
+	p := problems{src: src}
+	expanded := []TagListTag{}
+	origins := []origin{}
+
+	for i, v := range tags {
+
+		entry := fmt.Sprintf("%v[%v]", path, i)
+		name, ok, err := parseRange(v.Name)
+		if err != nil {
+			p.add(entry+".name", "%v", err)
+			continue
+		}
+		if !ok {
+			if len(v.Overrides) != 0 {
+				p.add(entry+".overrides", "overrides are set for %v, which is not a template", v.Name)
+			}
+			expanded = append(expanded, v)
+			origins = append(origins, origin{src: src, entry: entry})
+			continue
+		}
+
+		fields := map[string]tagField{}
+		for _, f := range []struct {
+			key   string
+			value string
+		}{{"node_id", v.Node}, {"namespace", v.Namespace}, {"description", v.Description}} {
+			fields[f.key], err = parseField(name, f.value)
+			if err != nil {
+				p.add(entry+"."+f.key, "%v", err)
+			}
+		}
+
+		for k := range v.Overrides {
+			if k < name.from || k > name.to {
+				p.add(fmt.Sprintf("%v.overrides.%v", entry, k), "override %v is outside of the range of %v", k, v.Name)
+			}
+		}
+
+		for k := 0; k < name.count(); k++ {
+
+			tag := TagListTag{
+				Name:         name.expand(k),
+				Node:         fields["node_id"].expand(name, k),
+				Namespace:    fields["namespace"].expand(name, k),
+				Description:  fields["description"].expand(name, k),
+				Type:         v.Type,
+				DefaultValue: v.DefaultValue,
+			}
+			o := origin{src: src, entry: entry}
+
+			if override, ok := v.Overrides[name.from+k]; ok {
+				override.apply(&tag)
+				o.override = fmt.Sprintf("%v.overrides.%v", entry, name.from+k)
+			}
+
+			expanded = append(expanded, tag)
+			origins = append(origins, o)
+		}
+	}
+
+	return expanded, origins, p.err()
+}
+
+// apply sets each attribute of the override on tag
+func (o TagListOverride) apply(tag *TagListTag) {
+
+	if o.Node != nil {
+		tag.Node = *o.Node
+	}
+	if o.Namespace != nil {
+		tag.Namespace = *o.Namespace
+	}
+	if o.Description != nil {
+		tag.Description = *o.Description
+	}
+	if o.Type != nil {
+		tag.Type = *o.Type
+	}
+	if o.DefaultValue != nil {
+		tag.DefaultValue = *o.DefaultValue
+	}
+}
+
+// expandModbusTags expands each tag of which the name holds a range to a tag per value of the range.
+// The index of the template is that of the first tag, and is incremented for each following tag.
+// The tags are located at path within src, and the origin of each expanded tag is returned.
+func expandModbusTags(src *source, path string, tags []ModbusTag) ([]ModbusTag, []origin, error) {
+
+	p := problems{src: src}
+	expanded := []ModbusTag{}
+	origins := []origin{}
+
+	for i, v := range tags {
+
+		entry := fmt.Sprintf("%v[%v]", path, i)
+		name, ok, err := parseRange(v.Name)
+		if err != nil {
+			p.add(entry+".name", "%v", err)
+			continue
+		}
+		if !ok {
+			expanded = append(expanded, v)
+			origins = append(origins, origin{src: src, entry: entry})
+			continue
+		}
+
+		if int(v.Index)+name.count() > maxExpansion {
+			p.add(entry+".index", "indexes of %v from %v exceed the last register %v", v.Name, v.Index, maxExpansion-1)
+			continue
+		}
+
+		for k := 0; k < name.count(); k++ {
+			expanded = append(expanded, ModbusTag{Name: name.expand(k), Type: v.Type, Index: v.Index + uint16(k)})
+			origins = append(origins, origin{src: src, entry: entry})
+		}
+	}
+
+	return expanded, origins, p.err()
+}
@@ -0,0 +1,327 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"tel/logging"
+)
+
+// TagTypes are the supported values of TagListTag.Type, a tag without a type retains the type of the value of the driver
+var TagTypes = []string{"bool", "int8", "uint8", "int16", "uint16", "int32", "uint32", "int64", "uint64", "float32", "float64", "string"}
+
+// TagRef is a reference to a taglist tag by name from a driver configuration
+type TagRef struct {
+	Name string
+	Position
+}
+
+// CheckTags returns Errors listing each reference to a tag that is not within tags
+func CheckTags(tags []TagListTag, refs []TagRef) error {
+
+	names := map[string]bool{}
+	for _, v := range tags {
+		names[v.Name] = true
+	}
+
+	p := problems{}
+	for _, v := range refs {
+		if !names[v.Name] {
+			p.addAt(v.Position, "tag %v was not found in the taglist", v.Name)
+		}
+	}
+	return p.err()
+}
+
+// TagRefs returns the tags referenced by the modbus configuration
+func (c Modbus) TagRefs() []TagRef {
+
+	refs := []TagRef{}
+	for i, v := range c.Modbus.Tags {
+		refs = append(refs, TagRef{Name: v.Name, Position: tagOrigin(c.origins, c.source, "modbus.tags", i).at("name")})
+	}
+	return refs
+}
+
+// TagRefs returns the tags referenced by the mqtt configuration
+func (c MQTT) TagRefs() []TagRef {
+
+	refs := []TagRef{}
+	for i, v := range c.Mqtt.Tags {
+		refs = append(refs, TagRef{Name: v.Name, Position: c.source.at(fmt.Sprintf("mqtt.tags[%v].name", i))})
+	}
+	return refs
+}
+
+// TagRefs returns the tags referenced by the goose configuration, named <dataset>/<index> for each index of each dataset
+func (c Goose) TagRefs() []TagRef {
+
+	refs := []TagRef{}
+	for i, e := range c.Goose.Endpoints {
+		for j, d := range e.Datasets {
+			pos := c.source.at(fmt.Sprintf("goose.endpoints[%v].datasets[%v].tags", i, j))
+			for t := 0; t < d.Tags; t++ {
+				refs = append(refs, TagRef{Name: fmt.Sprintf("%v/%v", d.Name, t), Position: pos})
+			}
+		}
+	}
+	return refs
+}
+
+// tagOrigin returns the origin of the ith tag at path within src, as expanded from a template, or as the ith entry of path if the tags were not expanded
+func tagOrigin(origins []origin, src *source, path string, i int) origin {
+
+	if i < len(origins) {
+		return origins[i]
+	}
+	return origin{src: src, entry: fmt.Sprintf("%v[%v]", path, i)}
+}
+
+// checkTags checks each tag has a unique name, a supported type, and a node_id that can be parsed.
+// The tags are located by at, as tags may be included from another file.
+func checkTags(p *problems, tags []TagListTag, at func(i int, field string) Position) {
+
+	types := map[string]bool{"": true}
+	for _, v := range TagTypes {
+		types[v] = true
+	}
+
+	names := map[string]int{}
+	for i, v := range tags {
+
+		if v.Name == "" {
+			p.addAt(at(i, "name"), "tag name is not set")
+		} else if first, ok := names[v.Name]; ok {
+			p.addAt(at(i, "name"), "duplicate tag name %v, first defined at %v", v.Name, at(first, "name"))
+		} else {
+			names[v.Name] = i
+		}
+
+		if !types[v.Type] {
+			p.addAt(at(i, "type"), "tag %v has unknown type %v, expected one of %v", v.Name, v.Type, TagTypes)
+		}
+
+		// namespace URIs can only be resolved against the server
+		if !strings.HasPrefix(v.Node, "nsu=") {
+			_, err := v.NodeID(nil)
+			if err != nil {
+				p.addAt(at(i, "node_id"), "invalid node_id for %v: %v", v.Name, err)
+			}
+		}
+	}
+}
+
+func (c TagList) validate() error {
+
+	p := problems{src: c.source}
+	checkTags(&p, c.Tags, func(i int, field string) Position {
+		return tagOrigin(c.origins, c.source, "tags", i).at(field)
+	})
+	return p.err()
+}
+
+func (c Modbus) validate() error {
+
+	p := problems{src: c.source}
+	d := c.Modbus.Device
+
+	if d.Mode != string(ModbusModeTCP) {
+		p.add("modbus.device.mode", "invalid mode %v, expected one of [%v]", d.Mode, ModbusModeTCP)
+	}
+	if d.ScantimeMs <= 0 {
+		p.add("modbus.device.scantime_ms", "scantime_ms must be greater than 0")
+	}
+	if d.TimeoutMs <= 0 {
+		p.add("modbus.device.timeout_ms", "timeout_ms must be greater than 0")
+	}
+
+	err := failsafe(d.FailSafe, FailSafeHold, FailSafeDefault, FailSafeBad)
+	if err != nil {
+		p.add("modbus.device.failsafe", "%v", err)
+	}
+
+	// device registers have no quality, so outputs may only hold or be driven to their default
+	err = failsafe(d.FailSafeOutputs, FailSafeHold, FailSafeDefault)
+	if err != nil {
+		p.add("modbus.device.failsafe_outputs", "outputs: %v", err)
+	}
+
+	checkLevel(&p, "modbus.device.log_level", d.LogLevel)
+
+	addresses := map[string]int{}
+	for i, v := range c.Modbus.Tags {
+
+		o := tagOrigin(c.origins, c.source, "modbus.tags", i)
+		switch v.Type {
+		case ModbusCoil, ModbusDiscrete, ModbusHolding, ModbusInput:
+		default:
+			p.addAt(o.at("type"), "invalid type, expected one of [%v, %v, %v, %v] for: %+v", ModbusCoil, ModbusDiscrete, ModbusHolding, ModbusInput, v)
+			continue
+		}
+
+		address := fmt.Sprintf("%v %v", v.Type, v.Index)
+		if first, ok := addresses[address]; ok {
+			p.addAt(o.at("index"), "duplicate address %v of %v, also used by %v at %v", address, v.Name, c.Modbus.Tags[first].Name, c.source.at(tagOrigin(c.origins, c.source, "modbus.tags", first).entry))
+			continue
+		}
+		addresses[address] = i
+	}
+
+	return p.err()
+}
+
+func (c MQTT) validate() error {
+
+	p := problems{src: c.source}
+
+	if c.Mqtt.Device.SubscriptionMs <= 0 {
+		p.add("mqtt.device.subscription_ms", "subscription_ms must be greater than 0")
+	}
+	checkLevel(&p, "mqtt.device.log_level", c.Mqtt.Device.LogLevel)
+
+	for i, v := range c.Mqtt.Tags {
+		if v.Topic == "" {
+			p.add(fmt.Sprintf("mqtt.tags[%v]", i), "topic is not set for %v", v.Name)
+		}
+	}
+
+	return p.err()
+}
+
+func (c Goose) validate() error {
+
+	p := problems{src: c.source}
+
+	err := failsafe(c.Goose.Device.FailSafe, FailSafeHold, FailSafeDefault, FailSafeBad)
+	if err != nil {
+		p.add("goose.device.failsafe", "%v", err)
+	}
+	checkLevel(&p, "goose.device.log_level", c.Goose.Device.LogLevel)
+
+	for i, e := range c.Goose.Endpoints {
+
+		mac, err := hex.DecodeString(strings.ReplaceAll(e.FilterMAC, "-", ""))
+		if err != nil || len(mac) != 6 {
+			p.add(fmt.Sprintf("goose.endpoints[%v].filter_mac", i), "invalid filter_mac %q, expected 6 bytes such as 01-0c-cd-01-00-01", e.FilterMAC)
+		}
+
+		for j, d := range e.Datasets {
+			if d.Name == "" {
+				p.add(fmt.Sprintf("goose.endpoints[%v].datasets[%v]", i, j), "dataset name is not set")
+			}
+		}
+	}
+
+	return p.err()
+}
+
+func (c Runtime) validate() error {
+
+	p := problems{src: c.source}
+
+	if len(c.Drivers) == 0 {
+		p.add("drivers", "no drivers are configured")
+	}
+
+	if c.Restart.BackoffMinMs < 0 || c.Restart.BackoffMaxMs < c.Restart.BackoffMinMs && c.Restart.BackoffMaxMs != 0 {
+		p.add("restart", "backoff_min_ms must be positive, and at most backoff_max_ms")
+	}
+	if c.Restart.MaxRestarts < 0 || c.Restart.WindowMs < 0 {
+		p.add("restart", "max_restarts and window_ms cannot be negative")
+	}
+	if c.ShutdownMs < 0 {
+		p.add("shutdown_ms", "shutdown_ms cannot be negative")
+	}
+
+	checkLevel(&p, "log.level", c.Log.Level)
+	_, err := logging.ParseFormat(c.Log.Format)
+	if err != nil {
+		p.add("log.format", "%v", err)
+	}
+	if c.Log.RateLimitMs < 0 {
+		p.add("log.rate_limit_ms", "rate_limit_ms cannot be negative")
+	}
+	if c.HTTP.Listen != "" {
+		_, _, err := net.SplitHostPort(c.HTTP.Listen)
+		if err != nil {
+			p.add("http.listen", "invalid listen address %v, expected host:port or :port: %v", c.HTTP.Listen, err)
+		}
+	}
+	if c.HTTP.HealthFactor < 0 {
+		p.add("http.health_factor", "health_factor cannot be negative")
+	}
+
+	names := map[string]int{}
+	for i, v := range c.Drivers {
+		if v.Name == "" || v.Driver == "" || v.Config == "" {
+			p.add(fmt.Sprintf("drivers[%v]", i), "name, driver and config must be set for: %+v", v)
+		}
+		if first, ok := names[v.Name]; ok {
+			p.add(fmt.Sprintf("drivers[%v].name", i), "duplicate driver name %v, first defined at %v", v.Name, c.source.at(fmt.Sprintf("drivers[%v].name", first)))
+		}
+		names[v.Name] = i
+	}
+
+	checkOpc(&p, "opc", c.Opc)
+
+	checkTags(&p, c.Tags, func(i int, field string) Position {
+		return tagOrigin(c.origins, c.source, "tags", i).at(field)
+	})
+
+	return p.err()
+}
+
+func (c OPC) validate() error {
+
+	p := problems{src: c.source}
+	checkOpc(&p, "opc", c.Opc)
+	return p.err()
+}
+
+// checkOpc checks the security mode, server verification, and authentication mode of the OPC client at path
+func checkOpc(p *problems, path string, c OPCClient) {
+
+	switch c.SecurityMode {
+	case "", "None", "Sign", "SignAndEncrypt":
+	default:
+		p.add(path+".security_mode", "invalid security_mode, expected one of [None, Sign, SignAndEncrypt] for: %v", c.SecurityMode)
+	}
+
+	if c.SecurityPolicy != "" && c.SecurityPolicy != "None" && len(c.TrustedCertificates) == 0 && !c.InsecureSkipVerify {
+		p.add(path+".security_policy", "trusted_certificates must be set to verify the server under security_policy %v, or insecure_skip_verify to accept any server", c.SecurityPolicy)
+	}
+
+	switch c.Auth.Mode {
+	case "", OPCAuthAnonymous, OPCAuthUsername, OPCAuthCertificate:
+	default:
+		p.add(path+".auth.mode", "invalid auth mode, expected one of [%v, %v, %v] for: %v", OPCAuthAnonymous, OPCAuthUsername, OPCAuthCertificate, c.Auth.Mode)
+	}
+}
+
+// checkLevel checks the log level at path
+func checkLevel(p *problems, path string, level string) {
+
+	_, err := logging.ParseLevel(level)
+	if err != nil {
+		p.add(path, "%v", err)
+	}
+}
+
+// failsafe checks f is one of allowed, an unset fail-safe defaults to hold
+func failsafe(f FailSafe, allowed ...FailSafe) error {
+
+	if f == "" {
+		return nil
+	}
+	for _, v := range allowed {
+		if f == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid failsafe, expected one of %v for: %v", allowed, f)
+}
@@ -3,8 +3,179 @@
 // SPDX-License-Identifier: MIT
 package drivers
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"tel/config"
+	"tel/logging"
+	"tel/opc"
+	"time"
 
+	"github.com/gopcua/opcua/ua"
+)
+
+// Driver is a driver instance, which is run until ctx is cancelled, and may be run again after it returns.
+// Status and Stats may be called while the driver runs.
 type Driver interface {
+	Name() string
 	Run(ctx context.Context) error
+	Tags() []TagUsage
+	Status() Status
+	Stats() Stats
+	// Validate checks the configuration of the driver for problems that would cause it to fail once run
+	Validate() error
+}
+
+// TagUsage is a taglist tag used by a driver, and whether the driver writes the tag to OPC, or only reads it
+type TagUsage struct {
+	Tag   config.TagListTag
+	Write bool
+}
+
+// reconnect runs session until it fails with an error other than an opc.ConnectionError, or ctx is cancelled.
+// A session that fails with an opc.ConnectionError is re-run with backoff, re-establishing the connection and subscriptions.
+// Each error of a session is recorded by mon.
+func reconnect(ctx context.Context, client *opc.Client, mon *monitor, session func(ctx context.Context) error) error {
+
+	backoff := client.Backoff()
+
+	for {
+		start := time.Now()
+		err := session(ctx)
+		mon.opcState(Disconnected)
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("ctx caught")
+		}
+		mon.failed(err)
+
+		lost := opc.ConnectionError{}
+		if !errors.As(err, &lost) {
+			return err
+		}
+
+		if time.Since(start) > backoff.Max {
+			backoff.Reset()
+		}
+		delay := backoff.Next()
+
+		mon.log.Warnf("opc connection lost, reconnecting in %v: %v", delay, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ctx caught")
+		case <-time.After(delay):
+		}
+	}
+}
+
+// newLogger returns the logger of a driver instance, with the name of the instance and the label of its device as fields, logging at level if set
+func newLogger(name string, label string, level string) (*logging.Logger, error) {
+
+	l := logging.Default().With("driver", name)
+	if label != "" {
+		l = l.With("device", label)
+	}
+	if level == "" {
+		return l, nil
+	}
+
+	lvl, err := logging.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	return l.WithLevel(lvl), nil
+}
+
+// tagIndex returns the tags of the taglist by name
+func tagIndex(tags []config.TagListTag) map[string]config.TagListTag {
+
+	index := make(map[string]config.TagListTag, len(tags))
+	for _, v := range tags {
+		if _, ok := index[v.Name]; !ok {
+			index[v.Name] = v
+		}
+	}
+	return index
+}
+
+// validation returns an error listing each problem found by Validate, or nil if there are none
+func validation(problems []string) error {
+
+	if len(problems) != 0 {
+		return fmt.Errorf("%v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// statusErrors maps per node write or read statuses back to their tag names, returning an error listing each failed tag
+func statusErrors(names []string, nodes []*ua.NodeID, results []ua.StatusCode) error {
+
+	failed := []string{}
+	for i, s := range results {
+		if s != ua.StatusOK {
+			failed = append(failed, fmt.Sprintf("%v (%v): %v", names[i], nodes[i], s))
+		}
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("failed for %v of %v tags: %v", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// writeDefaults writes the default value of each tag to OPC, tags without a type have no default and are skipped
+func writeDefaults(ctx context.Context, client *opc.Client, tags []config.TagListTag, nodes []*ua.NodeID) error {
+
+	names := []string{}
+	typed := []*ua.NodeID{}
+	values := []*ua.Variant{}
+
+	for i, t := range tags {
+		if t.Type == "" {
+			continue
+		}
+		v, err := opc.DefaultVariant(t.Type, t.DefaultValue)
+		if err != nil {
+			return fmt.Errorf("failed to encode default value for %v: %w", t.Name, err)
+		}
+		names = append(names, t.Name)
+		typed = append(typed, nodes[i])
+		values = append(values, v)
+	}
+
+	if len(typed) == 0 {
+		return nil
+	}
+
+	results, err := client.WriteValues(ctx, typed, values)
+	if err != nil {
+		return err
+	}
+	return statusErrors(names, typed, results)
+}
+
+// failsafe applies policy to the OPC values of tags, on loss of communication with the device
+func failsafe(ctx context.Context, client *opc.Client, policy config.FailSafe, tags []config.TagListTag, nodes []*ua.NodeID) error {
+
+	switch policy {
+	case config.FailSafeDefault:
+		return writeDefaults(ctx, client, tags, nodes)
+
+	case config.FailSafeBad:
+		names := []string{}
+		for _, t := range tags {
+			names = append(names, t.Name)
+		}
+		results, err := client.WriteStatus(ctx, nodes, ua.StatusBadNoCommunication)
+		if err != nil {
+			return err
+		}
+		return statusErrors(names, nodes, results)
+
+	default:
+		return nil
+	}
 }
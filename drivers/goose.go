@@ -7,48 +7,107 @@ package drivers
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"reflect"
 	"strings"
 	"tel/config"
 	"tel/goose"
+	"tel/logging"
+	"tel/opc"
 	"time"
 
-	"github.com/gopcua/opcua"
 	"github.com/gopcua/opcua/ua"
 )
 
 type Goose struct {
-	device    config.GooseDevice
+	*monitor
+	device config.GooseDevice
+	// loaded is the configuration last accepted by New or Reload, against which a reload is compared, and is only accessed by Reload
+	loaded    config.GooseDriver
+	reloads   chan *Goose
 	endpoints []config.GooseEndpoint
 	tagmap    []gooseMap
-	opc       *opcua.Client
+	// index indexes the tagmap by dataset and index
+	index     map[gooseKey]int
+	opc       *opc.Client
+	defaulted bool
+}
+
+// gooseLink tracks the messages of a subscriber, such that loss of the publisher is detected once the time allowed to live of its last message expires
+type gooseLink struct {
+	stNum   uint32
+	sqNum   uint32
+	seen    time.Time
+	ttl     time.Duration
+	dataset string
+	lost    bool
+	// parseError is the parse error last returned by the subscriber, such that a persisting error is counted once
+	parseError goose.GooseParseError
 }
 
 type gooseMap struct {
 	Dataset string
 	Index   int
 	Tag     config.TagListTag
+	Node    *ua.NodeID
+}
+
+// gooseKey identifies a tag by the index of its value within a dataset
+type gooseKey struct {
+	dataset string
+	index   int
+}
+
+func init() {
+	Register(Registration{
+		Name: "goose",
+		Config: func() interface{} {
+			return config.Goose{}
+		},
+		Load: func(path string) (interface{}, error) {
+			return config.LoadGoose(path)
+		},
+		New: func(name string, tags []config.TagListTag, cfg interface{}, opcConfig config.OPCClient) (Driver, error) {
+			c := cfg.(config.Goose)
+			return NewGoose(name, tags, c.Goose, opcConfig)
+		},
+	})
 }
 
-func NewGoose(tags []config.TagListTag, cfg config.GooseDriver, opc string) (*Goose, error) {
+func NewGoose(name string, tags []config.TagListTag, cfg config.GooseDriver, opcConfig config.OPCClient) (*Goose, error) {
+
+	log, err := newLogger(name, cfg.Device.Label, cfg.Device.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("goose as: %+v", cfg.Device)
 
 	g := Goose{
+		monitor:   newMonitor(name, cfg.Device.Label, log),
 		device:    cfg.Device,
+		loaded:    cfg,
+		reloads:   make(chan *Goose, 1),
 		endpoints: cfg.Endpoints,
 	}
 
-	err := g.tagLoad(tags, cfg.Endpoints)
+	err = g.tagLoad(tags, cfg.Endpoints)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load tags: %w", err)
 	}
 
-	g.opc = opcua.NewClient(opc)
+	g.opc = opc.NewClient(opcConfig)
+	g.opc.SetObserver(g.opcObserver())
+	g.opc.SetLogger(log)
+	g.expect(0, g.opc.KeepAliveInterval())
 	return &g, nil
 }
 
 func (m *Goose) tagLoad(tags []config.TagListTag, endpoints []config.GooseEndpoint) error {
 
+	byName := tagIndex(tags)
+	m.index = map[gooseKey]int{}
+
 	for _, e := range endpoints {
 
 		for _, d := range e.Datasets {
@@ -56,24 +115,9 @@ func (m *Goose) tagLoad(tags []config.TagListTag, endpoints []config.GooseEndpoi
 			for t := 0; t < d.Tags; t++ {
 
 				compoundName := fmt.Sprintf("%v/%v", d.Name, t)
-				tag := config.TagListTag{}
-				found := false
-
-				for _, x := range tags {
-
-					if found {
-						break
-					}
-
-					if compoundName == x.Name {
-						tag = x
-						found = true
-					}
-				}
-
-				if !found {
-					log.Printf("goose tag %v was not found in global tag list, skipped", compoundName)
-					continue
+				tag, ok := byName[compoundName]
+				if !ok {
+					return fmt.Errorf("goose tag %v was not found in global tag list", compoundName)
 				}
 
 				record := gooseMap{
@@ -82,6 +126,7 @@ func (m *Goose) tagLoad(tags []config.TagListTag, endpoints []config.GooseEndpoi
 					Index:   t,
 				}
 
+				m.index[gooseKey{dataset: d.Name, index: t}] = len(m.tagmap)
 				m.tagmap = append(m.tagmap, record)
 			}
 		}
@@ -90,12 +135,17 @@ func (m *Goose) tagLoad(tags []config.TagListTag, endpoints []config.GooseEndpoi
 	return nil
 }
 
-func (m *Goose) Run(ctx context.Context) error {
+// Tags returns the tags of the driver, each of which is written to OPC from received messages
+func (m *Goose) Tags() []TagUsage {
 
-	err := m.opc.Connect(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to connect OPC: %w", err)
+	tags := []TagUsage{}
+	for _, v := range m.tagmap {
+		tags = append(tags, TagUsage{Tag: v.Tag, Write: true})
 	}
+	return tags
+}
+
+func (m *Goose) Run(ctx context.Context) error {
 
 	req := goose.NewReceiver(m.device.Interface)
 
@@ -103,10 +153,9 @@ func (m *Goose) Run(ctx context.Context) error {
 
 	for _, e := range m.endpoints {
 
-		mac := strings.ReplaceAll(e.FilterMAC, "-", "")
-		hmac, err := hex.DecodeString(mac)
+		hmac, err := filterMAC(e.FilterMAC)
 		if err != nil {
-			return fmt.Errorf("failed to decode configured filter_mac: %w", err)
+			return err
 		}
 
 		sub := goose.NewSubscriber(hmac, e.ApplicationID, e.ControlBlockReference)
@@ -125,102 +174,386 @@ func (m *Goose) Run(ctx context.Context) error {
 	req.Start()
 	defer req.StopAndDestroy()
 
+	return reconnect(ctx, m.opc, m.monitor, func(ctx context.Context) error {
+		return m.session(ctx, req, subs)
+	})
+}
+
+// Validate checks the filter MAC of each endpoint, and the type of each tag
+func (m *Goose) Validate() error {
+
+	problems := []string{}
+
+	for _, e := range m.endpoints {
+		_, err := filterMAC(e.FilterMAC)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", e.ControlBlockReference, err))
+		}
+	}
+
+	for _, v := range m.tagmap {
+		if v.Tag.Type != "" {
+			_, err := opc.DataType(v.Tag.Type)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", v.Tag.Name, err))
+			}
+		}
+	}
+
+	return validation(problems)
+}
+
+// filterMAC decodes a destination MAC address, such as 01-0C-CD-01-00-01
+func filterMAC(mac string) ([]byte, error) {
+
+	hmac, err := hex.DecodeString(strings.ReplaceAll(mac, "-", ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode configured filter_mac: %w", err)
+	}
+	if len(hmac) != 6 {
+		return nil, fmt.Errorf("configured filter_mac %v is not 6 bytes", mac)
+	}
+	return hmac, nil
+}
+
+// session receives messages and writes them to a single OPC connection, until the connection is lost or ctx is cancelled
+func (m *Goose) session(ctx context.Context, req *goose.Receiver, subs []goose.Subscriber) error {
+
+	err := m.opc.Connect(ctx)
+	defer m.opc.Close()
+	if err != nil {
+		return fmt.Errorf("failed to connect OPC: %w", err)
+	}
+	m.opcState(Connected)
+
+	// the defaults of all tags are written on the first connection, and of those added by a reload received while not running
+	previous := m.names()
+	if !m.defaulted {
+		previous = map[string]bool{}
+	}
+
+	select {
+	case n := <-m.reloads:
+		m.apply(n)
+	default:
+	}
+
+	err = m.resolve()
+	if err != nil {
+		return err
+	}
+
+	tags, nodes := m.datasetTags("")
+	tags, nodes = added(previous, tags, nodes)
+	err = writeDefaults(ctx, m.opc, tags, nodes)
+	if err != nil {
+		return fmt.Errorf("failed to write defaults: %w", err)
+	}
+	m.defaulted = true
+
+	links := make([]gooseLink, len(subs))
+	keepalive := time.Now()
+
 	for {
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("ctx caught")
+		}
+
+		select {
+		case n := <-m.reloads:
+			err := m.reload(ctx, n)
+			if err != nil {
+				return fmt.Errorf("failed to reload: %w", err)
+			}
+		default:
+		}
+
+		if time.Since(keepalive) > m.opc.KeepAliveInterval() {
+			err := m.opc.KeepAlive(ctx)
+			if err != nil {
+				return fmt.Errorf("opc keepalive failed: %w", err)
+			}
+			keepalive = time.Now()
+			m.keptAlive()
+		}
+
+		for i := range links {
+			err := m.expire(ctx, &links[i])
+			if errors.As(err, &opc.ConnectionError{}) {
+				return fmt.Errorf("failed to apply failsafe: %w", err)
+			}
+			if err != nil {
+				m.log.With("dataset", links[i].dataset).Errorf("failed to apply failsafe %v: %v", m.device.FailSafe, err)
+			}
+		}
+
+		if lost(links) {
+			m.deviceState(Disconnected)
+		}
+
 		ticked := req.Tick()
 		if !ticked {
 			time.Sleep(1 * time.Millisecond)
 		} else {
 
-			for _, s := range subs {
+			for i, s := range subs {
 
 				msg, err := s.GetCurrentMessage()
 				if err != nil {
-					log.Printf("failed to get message: %v", err)
+					m.parseFailed(&links[i], err)
+					m.log.Warnf("failed to get message: %v", err)
+					continue
+				}
+				m.received(&links[i], msg.Header)
+
+				// the values of a lost publisher are not written until it publishes again
+				if !links[i].update(msg.Header, m.log) {
 					continue
 				}
+				m.deviceState(Connected)
 
 				if m.device.LogHeader && m.device.LogValues {
-					log.Printf("%+v", msg)
+					m.log.With("dataset", msg.Header.Dataset, "header", msg.Header, "values", msg.Value).Infof("message received")
 				} else if m.device.LogHeader {
-					log.Printf("%+v", msg.Header)
+					m.log.With("dataset", msg.Header.Dataset, "header", msg.Header).Infof("message received")
 				}
 
 				if msg.Value.IsNull() {
 					continue
 				}
 
-				err = m.write(msg, msg.Value, 0)
+				start := time.Now()
+				written, err := m.write(ctx, msg)
+				if errors.As(err, &opc.ConnectionError{}) {
+					return fmt.Errorf("failed to write: %w", err)
+				}
 				if err != nil {
-					log.Printf("failed to write: %v", err)
+					m.failed(err)
+					m.log.With("dataset", msg.Header.Dataset).Errorf("failed to write: %v", err)
+					continue
 				}
+				m.cycle(start, written, written)
 
 			}
 		}
 	}
 }
 
-func (m *Goose) write(message goose.Message, value goose.MMSValue, index int) error {
+// Reload applies the tags of each dataset, the fail-safe policy and logging of next to the running driver.
+// A change to the interface, or to the endpoints and datasets subscribed to, cannot be applied live, and returns ErrRestart.
+func (m *Goose) Reload(next Driver) error {
+
+	n, ok := next.(*Goose)
+	if !ok {
+		return ErrRestart
+	}
+
+	if m.loaded.Device.Interface != n.loaded.Device.Interface || !reflect.DeepEqual(subscribed(m.loaded.Endpoints), subscribed(n.loaded.Endpoints)) {
+		return ErrRestart
+	}
+
+	m.loaded = n.loaded
+
+	// a reload not yet applied is superseded
+	select {
+	case <-m.reloads:
+	default:
+	}
+	m.reloads <- n
+	return nil
+}
+
+// apply applies the configuration of a reload within the session, including the number of tags of each dataset of the endpoints
+func (m *Goose) apply(n *Goose) {
+
+	m.device, m.endpoints, m.tagmap, m.index = n.device, n.endpoints, n.tagmap, n.index
+	m.setLogger(n.log)
+	m.opc.SetLogger(n.log)
+}
+
+// subscribed returns the endpoints without the number of tags of each dataset, which a reload may change
+func subscribed(endpoints []config.GooseEndpoint) []config.GooseEndpoint {
+
+	result := []config.GooseEndpoint{}
+	for _, e := range endpoints {
+		datasets := []config.GooseDataset{}
+		for _, d := range e.Datasets {
+			datasets = append(datasets, config.GooseDataset{Name: d.Name})
+		}
+		e.Datasets = datasets
+		result = append(result, e)
+	}
+	return result
+}
+
+// reload applies the configuration of n within a session, writing the defaults of added tags
+func (m *Goose) reload(ctx context.Context, n *Goose) error {
+
+	previous := m.names()
+	m.apply(n)
+
+	err := m.resolve()
+	if err != nil {
+		return err
+	}
+
+	tags, nodes := m.datasetTags("")
+	tags, nodes = added(previous, tags, nodes)
+	err = writeDefaults(ctx, m.opc, tags, nodes)
+	if err != nil {
+		return fmt.Errorf("failed to write defaults: %w", err)
+	}
+
+	m.log.Infof("reloaded %v tags, %v added", len(m.tagmap), len(tags))
+	return nil
+}
+
+// names returns the name of each tag, as a set
+func (m *Goose) names() map[string]bool {
+
+	names := map[string]bool{}
+	for _, v := range m.tagmap {
+		names[v.Tag.Name] = true
+	}
+	return names
+}
+
+// resolve resolves the node of each tag
+func (m *Goose) resolve() error {
+
+	var err error
+	for i, v := range m.tagmap {
+		m.tagmap[i].Node, err = m.opc.NodeID(v.Tag)
+		if err != nil {
+			return fmt.Errorf("failed to resolve nodeID for %v: %w", v.Tag.Name, err)
+		}
+	}
+	return nil
+}
+
+// update records the header of the current message of the subscriber, returning false if the publisher is lost and the message is not new
+func (l *gooseLink) update(h goose.Header, log *logging.Logger) bool {
+
+	if l.stNum == h.StateNumber && l.sqNum == h.SequenceNumber && !l.seen.IsZero() {
+		return !l.lost
+	}
+
+	if l.lost {
+		log.With("dataset", h.Dataset).Infof("goose dataset restored")
+	}
+
+	l.stNum = h.StateNumber
+	l.sqNum = h.SequenceNumber
+	l.seen = time.Now()
+	l.ttl = time.Duration(h.TTL) * time.Millisecond
+	l.dataset = h.Dataset
+	l.lost = false
+	return true
+}
+
+// lost returns true if every subscriber has received a message, and each publisher has since been lost
+func lost(links []gooseLink) bool {
+
+	for _, l := range links {
+		if !l.lost {
+			return false
+		}
+	}
+	return len(links) != 0
+}
+
+// expire applies the fail-safe policy to the tags of the dataset of link, once the time allowed to live of its last message has expired
+func (m *Goose) expire(ctx context.Context, l *gooseLink) error {
+
+	if l.lost || l.seen.IsZero() || l.ttl == 0 || time.Since(l.seen) < l.ttl {
+		return nil
+	}
+	l.lost = true
+
+	m.log.With("dataset", l.dataset).Warnf("goose dataset lost, no message within %v", l.ttl)
+
+	tags, nodes := m.datasetTags(l.dataset)
+	return failsafe(ctx, m.opc, m.device.FailSafe, tags, nodes)
+}
+
+// datasetTags returns the tags of dataset, or of all datasets if empty
+func (m *Goose) datasetTags(dataset string) ([]config.TagListTag, []*ua.NodeID) {
+
+	tags := []config.TagListTag{}
+	nodes := []*ua.NodeID{}
+	for _, v := range m.tagmap {
+		if dataset == "" || v.Dataset == dataset {
+			tags = append(tags, v.Tag)
+			nodes = append(nodes, v.Node)
+		}
+	}
+	return tags, nodes
+}
+
+// write writes all mapped values within a message to OPC as a single batch, returning the number of values written
+func (m *Goose) write(ctx context.Context, message goose.Message) (int, error) {
+
+	w := gooseWrite{}
+
+	err := m.collect(message, message.Value, 0, &w)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(w.nodes) == 0 {
+		return 0, nil
+	}
+
+	results, err := m.opc.WriteValues(ctx, w.nodes, w.values)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %w", message.Header.Dataset, err)
+	}
+
+	return len(w.nodes), statusErrors(w.names, w.nodes, results)
+}
+
+type gooseWrite struct {
+	names  []string
+	nodes  []*ua.NodeID
+	values []*ua.Variant
+}
+
+// encode adds the value at index within dataset to w, if it is mapped to a tag
+func (m *Goose) encode(dataset string, index int, value interface{}, w *gooseWrite) error {
+
+	i, ok := m.index[gooseKey{dataset: dataset, index: index}]
+	if !ok {
+		return nil
+	}
+	mapper := m.tagmap[i]
+
+	variant, err := opc.Variant(mapper.Tag.Type, value)
+	if err != nil {
+		return fmt.Errorf("failed to encode value for %v (%v): %w", mapper.Tag.Name, mapper.Node, err)
+	}
+
+	w.names = append(w.names, mapper.Tag.Name)
+	w.nodes = append(w.nodes, mapper.Node)
+	w.values = append(w.values, variant)
+	return nil
+}
+
+func (m *Goose) collect(message goose.Message, value goose.MMSValue, index int, w *gooseWrite) error {
 
 	record := value.Read()
 	switch v := record.(type) {
 	case []goose.MMSValue:
 		{
 			for index, i := range v {
-				err := m.write(message, i, index)
+				err := m.collect(message, i, index, w)
 				if err != nil {
 					return err
 				}
 			}
 		}
 	case bool, uint32, int32, float32, float64:
-
-		mapper := config.TagListTag{}
-		found := false
-		for _, v := range m.tagmap {
-			if found {
-				break
-			}
-			if v.Dataset == message.Header.Dataset && v.Index == index {
-				mapper = v.Tag
-				found = true
-			}
-		}
-		if !found {
-			return nil
-		}
-		nid, err := mapper.NodeID()
-		if err != nil {
-			return fmt.Errorf("failed to parse nodeID within %v: %w", message.Header.Dataset, err)
-		}
-
-		pvariant, err := ua.NewVariant(record)
-		if err != nil {
-			return fmt.Errorf("failed to encode value for %v: %w", nid, err)
-		}
-		variant := *pvariant
-		req := &ua.WriteRequest{
-			NodesToWrite: []*ua.WriteValue{
-				{
-					NodeID:      &nid,
-					AttributeID: ua.AttributeIDValue,
-					Value: &ua.DataValue{
-						EncodingMask: ua.DataValueValue,
-						Value:        &variant,
-					},
-				},
-			},
-		}
-
-		resp, err := m.opc.Write(req)
-		if err != nil {
-			return fmt.Errorf("%v: %w", nid.String(), err)
-		}
-		if len(resp.Results) < 1 {
-			return fmt.Errorf("no results returned for %v", nid.String())
-		}
-		if resp.Results[0].Error() != ua.StatusOK.Error() {
-			return fmt.Errorf("%v: %v", nid.String(), resp.Results[0].Error())
-		}
+		return m.encode(message.Header.Dataset, index, record, w)
 
 	case error:
 		return fmt.Errorf("error type within %v, skipped: %v", message, message.Value.Read())
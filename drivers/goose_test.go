@@ -8,12 +8,13 @@ import (
 	"context"
 	"tel/config"
 	"testing"
+	"time"
 )
 
 func TestGoose(t *testing.T) {
 
-	ctx := context.Background()
-	_opc := "opc.tcp://localhost:4840"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
 	tags, err := config.LoadTagList("../config/taglist.yml")
 	if err != nil {
@@ -25,14 +26,24 @@ func TestGoose(t *testing.T) {
 		t.Fatalf("failed to load taglist: %v", err)
 	}
 
-	d, err := NewGoose(tags.Tags, gconfig.Goose, _opc)
+	srv, _ := serve(ctx, t, tags.Tags)
+
+	d, err := NewGoose("goose", tags.Tags, gconfig.Goose, config.OPCClient{Endpoint: srv.Endpoint()})
 	if err != nil {
 		t.Fatalf("failed to create goose driver: %v", err)
 	}
 
-	err = d.Run(ctx)
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Run(ctx)
+	}()
 
+	// the driver runs while no messages are received, until cancelled
+	eventually(t, "the driver to connect to opc", func() bool { return d.Status().OPC == Connected })
+	cancel()
+
+	err = <-done
+	if err == nil || ctx.Err() == nil {
+		t.Fatalf("expected the driver to stop once cancelled, got %v", err)
+	}
 }
@@ -0,0 +1,234 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"tel/config"
+	"tel/opc"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+const benchTags = 5000
+
+// nullClient is a modbus client which accepts every request
+type nullClient struct{}
+
+func (nullClient) ReadCoils(address, quantity uint16) ([]byte, error) { return nil, nil }
+func (nullClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return nil, nil
+}
+func (nullClient) WriteSingleCoil(address, value uint16) ([]byte, error) { return nil, nil }
+func (nullClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	return nil, nil
+}
+func (nullClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return nil, nil
+}
+func (nullClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return nil, nil
+}
+func (nullClient) WriteSingleRegister(address, value uint16) ([]byte, error) { return nil, nil }
+func (nullClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	return nil, nil
+}
+func (nullClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return nil, nil
+}
+func (nullClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return nil, nil
+}
+func (nullClient) ReadFIFOQueue(address uint16) ([]byte, error) { return nil, nil }
+
+// benchTagList returns n tags of the given prefix, named <prefix>/<index>
+func benchTagList(prefix string, n int) []config.TagListTag {
+
+	tags := []config.TagListTag{}
+	for i := 0; i < n; i++ {
+		tags = append(tags, config.TagListTag{Name: fmt.Sprintf("%v/%v", prefix, i), Type: "uint16"})
+	}
+	return tags
+}
+
+// benchNotification returns a data change notification of each handle
+func benchNotification(handles []uint32) *opcua.PublishNotificationData {
+
+	items := []*ua.MonitoredItemNotification{}
+	for _, h := range handles {
+		items = append(items, &ua.MonitoredItemNotification{
+			ClientHandle: h,
+			Value:        &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(uint16(1))},
+		})
+	}
+	return &opcua.PublishNotificationData{Value: &ua.DataChangeNotification{MonitoredItems: items}}
+}
+
+func BenchmarkTagLoad(b *testing.B) {
+
+	tags := benchTagList("T", benchTags)
+
+	mtags := []config.ModbusTag{}
+	qtags := []config.MQTTTag{}
+	for i, v := range tags {
+		mtags = append(mtags, config.ModbusTag{Name: v.Name, Type: config.ModbusHolding, Index: uint16(i)})
+		qtags = append(qtags, config.MQTTTag{Name: v.Name, Topic: "bench"})
+	}
+	endpoints := []config.GooseEndpoint{{Datasets: []config.GooseDataset{{Name: "T", Tags: benchTags}}}}
+
+	b.Run("modbus", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m := Modbus{}
+			err := m.tagLoad(tags, mtags)
+			if err != nil {
+				b.Fatalf("%v", err)
+			}
+		}
+	})
+
+	b.Run("mqtt", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m := MQTT{}
+			err := m.tagLoad(tags, qtags)
+			if err != nil {
+				b.Fatalf("%v", err)
+			}
+		}
+	})
+
+	b.Run("goose", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m := Goose{}
+			err := m.tagLoad(tags, endpoints)
+			if err != nil {
+				b.Fatalf("%v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkModbusUpdate(b *testing.B) {
+
+	tags := benchTagList("T", benchTags)
+	mtags := []config.ModbusTag{}
+	for i, v := range tags {
+		mtags = append(mtags, config.ModbusTag{Name: v.Name, Type: config.ModbusHolding, Index: uint16(i)})
+	}
+
+	m := Modbus{conn: nullClient{}, handles: map[uint32]int{}}
+	err := m.tagLoad(tags, mtags)
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+
+	handles := []uint32{}
+	for i := range m.tagmap {
+		handle := uint32(i + 1)
+		m.handles[handle] = i
+		handles = append(handles, handle)
+	}
+	res := benchNotification(handles)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := m.opcupdate(res)
+		if err != nil {
+			b.Fatalf("%v", err)
+		}
+	}
+}
+
+func BenchmarkMQTTChanged(b *testing.B) {
+
+	tags := benchTagList("T", benchTags)
+	qtags := []config.MQTTTag{}
+	for _, v := range tags {
+		qtags = append(qtags, config.MQTTTag{Name: v.Name, Topic: "bench"})
+	}
+
+	m := MQTT{handles: map[uint32]int{}}
+	err := m.tagLoad(tags, qtags)
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+
+	handles := []uint32{}
+	for i := range m.tagmap {
+		handle := uint32(i + 1)
+		m.handles[handle] = i
+		handles = append(handles, handle)
+	}
+	items := benchNotification(handles).Value.(*ua.DataChangeNotification).MonitoredItems
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := m.changed(items)
+		if err != nil {
+			b.Fatalf("%v", err)
+		}
+	}
+}
+
+// BenchmarkGooseEncode encodes each value of a message, as collect does for each element of a received dataset
+func BenchmarkGooseEncode(b *testing.B) {
+
+	tags := benchTagList("T", benchTags)
+	m := Goose{}
+	err := m.tagLoad(tags, []config.GooseEndpoint{{Datasets: []config.GooseDataset{{Name: "T", Tags: benchTags}}}})
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := gooseWrite{}
+		for index := 0; index < benchTags; index++ {
+			err := m.encode("T", index, uint32(index), &w)
+			if err != nil {
+				b.Fatalf("%v", err)
+			}
+		}
+	}
+}
+
+// serve serves an embedded server of tags to in-process clients until ctx is cancelled, the returned channel is closed once it has stopped
+func serve(ctx context.Context, t *testing.T, tags []config.TagListTag) (*opc.Server, <-chan struct{}) {
+
+	srv, err := opc.NewServer(config.OPCServer{Endpoint: "opc.tcp://127.0.0.1:0"}, tags)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	err = srv.Listen()
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		err := srv.Serve(ctx)
+		if ctx.Err() == nil {
+			t.Errorf("server stopped: %v", err)
+		}
+	}()
+	return srv, stopped
+}
+
+// eventually fails the test unless cond is met within 5 seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package drivers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"tel/goose"
+	"tel/metrics"
+	"tel/modbus"
+	"tel/opc"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// The metrics of each driver are labelled by the name of the driver instance, and the label of its device
+var (
+	driverCycles        = metrics.Default.Counter("tel_driver_cycles_total", "Successful cycles of the driver, a scan for modbus, a published batch of changes for mqtt, and a received message for goose.", "driver", "device")
+	driverCycleDuration = metrics.Default.Histogram("tel_driver_cycle_duration_seconds", "Duration of each successful cycle of the driver.", metrics.DefaultBuckets, "driver", "device")
+	driverErrors        = metrics.Default.Counter("tel_driver_errors_total", "Errors of the driver.", "driver", "device")
+	driverConnected     = metrics.Default.Gauge("tel_driver_connected", "Whether the connection of the driver to OPC or to its device is up.", "driver", "device", "link")
+
+	opcDuration = metrics.Default.Histogram("tel_opc_request_duration_seconds", "Duration of each OPC read or write request of the driver.", metrics.DefaultBuckets, "driver", "device", "operation")
+	opcStatus   = metrics.Default.Counter("tel_opc_status_total", "Results of the nodes read or written by the driver, by OPC status code, or by error if the request failed.", "driver", "device", "operation", "status")
+
+	modbusDuration   = metrics.Default.Histogram("tel_modbus_request_duration_seconds", "Round trip time of each modbus request.", metrics.DefaultBuckets, "driver", "device", "function")
+	modbusExceptions = metrics.Default.Counter("tel_modbus_exceptions_total", "Modbus exception responses, by exception code.", "driver", "device", "function", "code")
+	modbusFailures   = metrics.Default.Counter("tel_modbus_request_failures_total", "Modbus requests that failed without an exception response, such as on timeout.", "driver", "device", "function")
+
+	gooseMessages    = metrics.Default.Counter("tel_goose_messages_total", "GOOSE messages received, by dataset.", "driver", "device", "dataset")
+	gooseStNumGaps   = metrics.Default.Counter("tel_goose_stnum_gaps_total", "GOOSE state changes missed, by the gap between the stNum of consecutive messages received.", "driver", "device", "dataset")
+	gooseSqNumGaps   = metrics.Default.Counter("tel_goose_sqnum_gaps_total", "GOOSE retransmissions missed, by the gap between the sqNum of consecutive messages of the same state received.", "driver", "device", "dataset")
+	gooseParseErrors = metrics.Default.Counter("tel_goose_parse_errors_total", "GOOSE messages that could not be parsed, by GooseParseError.", "driver", "device", "error")
+
+	mqttPublishDuration = metrics.Default.Histogram("tel_mqtt_publish_duration_seconds", "Duration of each MQTT publish, until acknowledged by the broker.", metrics.DefaultBuckets, "driver", "device")
+	mqttPublishFailures = metrics.Default.Counter("tel_mqtt_publish_failures_total", "MQTT publishes that failed or timed out.", "driver", "device")
+)
+
+// opcObserver returns an observer recording the requests of the OPC client of the driver
+func (m *monitor) opcObserver() opc.Observer {
+
+	return func(op string, duration time.Duration, results []ua.StatusCode, err error) {
+
+		opcDuration.Observe(duration.Seconds(), m.name, m.label, op)
+		if err != nil {
+			opcStatus.Inc(m.name, m.label, op, "error")
+			return
+		}
+		for _, s := range results {
+			opcStatus.Inc(m.name, m.label, op, statusName(s))
+		}
+	}
+}
+
+// statusName returns the name of an OPC status code, such as BadNodeIDUnknown
+func statusName(s ua.StatusCode) string {
+
+	if d, ok := ua.StatusCodes[s]; ok {
+		return strings.TrimPrefix(d.Name, "Status")
+	}
+	return fmt.Sprintf("0x%X", uint32(s))
+}
+
+// modbusClient is a modbus client recording the round trip time and result of each request
+type modbusClient struct {
+	modbus.Client
+	mon *monitor
+}
+
+// observe records a request of function started at start
+func (c modbusClient) observe(function string, start time.Time, err error) {
+
+	name, label := c.mon.name, c.mon.label
+	modbusDuration.Observe(time.Since(start).Seconds(), name, label, function)
+
+	exception := &modbus.ModbusError{}
+	switch {
+	case err == nil:
+	case errors.As(err, &exception):
+		modbusExceptions.Inc(name, label, function, strconv.Itoa(int(exception.ExceptionCode)))
+	default:
+		modbusFailures.Inc(name, label, function)
+	}
+}
+
+func (c modbusClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.ReadCoils(address, quantity)
+	c.observe("read_coils", start, err)
+	return results, err
+}
+
+func (c modbusClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.ReadDiscreteInputs(address, quantity)
+	c.observe("read_discrete_inputs", start, err)
+	return results, err
+}
+
+func (c modbusClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.WriteSingleCoil(address, value)
+	c.observe("write_single_coil", start, err)
+	return results, err
+}
+
+func (c modbusClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.WriteMultipleCoils(address, quantity, value)
+	c.observe("write_multiple_coils", start, err)
+	return results, err
+}
+
+func (c modbusClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.ReadInputRegisters(address, quantity)
+	c.observe("read_input_registers", start, err)
+	return results, err
+}
+
+func (c modbusClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.ReadHoldingRegisters(address, quantity)
+	c.observe("read_holding_registers", start, err)
+	return results, err
+}
+
+func (c modbusClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.WriteSingleRegister(address, value)
+	c.observe("write_single_register", start, err)
+	return results, err
+}
+
+func (c modbusClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.WriteMultipleRegisters(address, quantity, value)
+	c.observe("write_multiple_registers", start, err)
+	return results, err
+}
+
+func (c modbusClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity, value)
+	c.observe("read_write_multiple_registers", start, err)
+	return results, err
+}
+
+func (c modbusClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.MaskWriteRegister(address, andMask, orMask)
+	c.observe("mask_write_register", start, err)
+	return results, err
+}
+
+func (c modbusClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+
+	start := time.Now()
+	results, err := c.Client.ReadFIFOQueue(address)
+	c.observe("read_fifo_queue", start, err)
+	return results, err
+}
+
+// received records the message of header h if new to the link, and the gaps in its stNum or sqNum since the previous message received.
+// The link is not updated.
+func (m *monitor) received(l *gooseLink, h goose.Header) {
+
+	l.parseError = goose.GooseParseErrorNone
+	if l.seen.IsZero() {
+		gooseMessages.Inc(m.name, m.label, h.Dataset)
+		return
+	}
+	if l.stNum == h.StateNumber && l.sqNum == h.SequenceNumber {
+		return
+	}
+	gooseMessages.Inc(m.name, m.label, h.Dataset)
+
+	// a stNum or sqNum lower than the last is taken as a restart or roll over of the publisher, rather than a gap
+	switch {
+	case h.StateNumber > l.stNum+1:
+		gooseStNumGaps.Add(float64(h.StateNumber-l.stNum-1), m.name, m.label, h.Dataset)
+	case h.StateNumber == l.stNum && h.SequenceNumber > l.sqNum+1:
+		gooseSqNumGaps.Add(float64(h.SequenceNumber-l.sqNum-1), m.name, m.label, h.Dataset)
+	}
+}
+
+// parseFailed records the parse error of the subscriber of the link, once until a message is next received or the error changes
+func (m *monitor) parseFailed(l *gooseLink, err error) {
+
+	parse := goose.ParseError{}
+	if !errors.As(err, &parse) || parse.Code == l.parseError {
+		return
+	}
+	l.parseError = parse.Code
+	gooseParseErrors.Inc(m.name, m.label, parse.Code.String())
+}
@@ -7,10 +7,12 @@ package drivers
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"tel/config"
 	"tel/modbus"
+	"tel/opc"
 	"time"
 
 	"github.com/gopcua/opcua"
@@ -18,16 +20,28 @@ import (
 )
 
 type Modbus struct {
+	*monitor
 	device config.ModbusDevice
-	tagmap []modbusMap
-	conn   modbus.Client
-	opc    *opcua.Client
-	buffer registerTable
+	// loaded is the device configuration last accepted by New or Reload, against which a reload is compared, and is only accessed by Reload
+	loaded  config.ModbusDevice
+	reloads chan *Modbus
+	tagmap  []modbusMap
+	conn    modbus.Client
+	closer  io.Closer
+	opc     *opc.Client
+	buffer  registerTable
+	// handles indexes the tagmap by the monitor handle of each coil and holding tag
+	handles map[uint32]int
+	// defaulted is set once the defaults of the inputs have been written on the first connection
+	defaulted bool
 }
 
 type modbusMap struct {
-	Modbus config.ModbusTag
-	Tag    config.TagListTag
+	Modbus        config.ModbusTag
+	Tag           config.TagListTag
+	Node          *ua.NodeID
+	MonitorHandle uint32
+	Cached        bool
 }
 
 type registerTable struct {
@@ -37,10 +51,35 @@ type registerTable struct {
 	holding   [65536]uint16
 }
 
-func NewModbus(tags []config.TagListTag, cfg config.ModbusDriver, opc string) (*Modbus, error) {
+func init() {
+	Register(Registration{
+		Name: "modbus",
+		Config: func() interface{} {
+			return config.Modbus{}
+		},
+		Load: func(path string) (interface{}, error) {
+			return config.LoadModbus(path)
+		},
+		New: func(name string, tags []config.TagListTag, cfg interface{}, opcConfig config.OPCClient) (Driver, error) {
+			c := cfg.(config.Modbus)
+			return NewModbus(name, tags, c.Modbus, opcConfig)
+		},
+	})
+}
+
+func NewModbus(name string, tags []config.TagListTag, cfg config.ModbusDriver, opcConfig config.OPCClient) (*Modbus, error) {
+
+	log, err := newLogger(name, cfg.Device.Label, cfg.Device.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("modbus as: %+v", cfg.Device)
 
 	mb := Modbus{
-		device: cfg.Device,
+		monitor: newMonitor(name, cfg.Device.Label, log),
+		device:  cfg.Device,
+		loaded:  cfg.Device,
+		reloads: make(chan *Modbus, 1),
 		buffer: registerTable{
 			coils:     [65536]bool{},
 			discretes: [65536]bool{},
@@ -49,7 +88,7 @@ func NewModbus(tags []config.TagListTag, cfg config.ModbusDriver, opc string) (*
 		},
 	}
 
-	err := mb.tagLoad(tags, cfg.Tags)
+	err = mb.tagLoad(tags, cfg.Tags)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load tags: %w", err)
 	}
@@ -60,7 +99,7 @@ func NewModbus(tags []config.TagListTag, cfg config.ModbusDriver, opc string) (*
 		return nil, fmt.Errorf("timeout cannot be 0")
 	}
 	if mb.device.Slave == 0 {
-		log.Printf("Slave has been provided as 0 (broadcast), this will likely fail")
+		log.Warnf("slave has been provided as 0 (broadcast), this will likely fail")
 	}
 
 	switch mb.device.Mode {
@@ -69,68 +108,274 @@ func NewModbus(tags []config.TagListTag, cfg config.ModbusDriver, opc string) (*
 		tcphandler.Timeout = time.Duration(mb.device.TimeoutMs) * time.Millisecond
 		tcphandler.SlaveId = mb.device.Slave
 		handler = tcphandler
+		mb.closer = tcphandler
 	default:
 		return nil, fmt.Errorf("modbus mode %v is not supported, options are [%v]", mb.device.Mode, config.ModbusModeTCP)
 	}
 
-	mb.conn = modbus.NewClient(handler)
-	mb.opc = opcua.NewClient(opc)
+	mb.conn = modbusClient{Client: modbus.NewClient(handler), mon: mb.monitor}
+	mb.opc = opc.NewClient(opcConfig)
+	mb.opc.SetObserver(mb.opcObserver())
+	mb.opc.SetLogger(log)
+	mb.expect(time.Duration(mb.device.ScantimeMs)*time.Millisecond, mb.opc.KeepAliveInterval())
 	return &mb, nil
 }
 
+// Tags returns the tags of the driver, discrete and input registers are written to OPC, coils and holding registers are read
+func (m *Modbus) Tags() []TagUsage {
+
+	tags := []TagUsage{}
+	for _, v := range m.tagmap {
+		write := v.Modbus.Type == config.ModbusDiscrete || v.Modbus.Type == config.ModbusInput
+		tags = append(tags, TagUsage{Tag: v.Tag, Write: write})
+	}
+	return tags
+}
+
 func (m *Modbus) Run(ctx context.Context) error {
 
+	err := reconnect(ctx, m.opc, m.monitor, func(ctx context.Context) error {
+		err := m.session(ctx)
+		if errors.As(err, &opc.ConnectionError{}) {
+			m.outputFailSafe()
+		}
+		return err
+	})
+
+	if ctx.Err() != nil {
+		m.shutdown()
+	}
+	return err
+}
+
+// shutdown drives the outputs to their fail-safe if configured, and closes the connection to the device
+func (m *Modbus) shutdown() {
+
+	if m.device.FailSafeShutdown {
+		m.outputFailSafe()
+	}
+
+	err := m.closer.Close()
+	if err != nil {
+		m.log.Warnf("failed to close modbus connection: %v", err)
+	}
+}
+
+// session runs the scan against a single OPC connection, until the connection is lost or an error occurs
+func (m *Modbus) session(ctx context.Context) error {
+
 	err := m.opc.Connect(ctx)
+	defer m.opc.Close()
 	if err != nil {
 		return fmt.Errorf("failed to connect OPC: %w", err)
 	}
+	m.opcState(Connected)
+
+	// the defaults of all inputs are written on the first connection, and of those added by a reload received while not running
+	previous := m.names()
+	if !m.defaulted {
+		previous = map[string]bool{}
+	}
+
+	select {
+	case n := <-m.reloads:
+		m.apply(n)
+	default:
+	}
+
+	err = m.resolve()
+	if err != nil {
+		return err
+	}
+
+	tags, nodes := m.inputs()
+	tags, nodes = added(previous, tags, nodes)
+	err = writeDefaults(ctx, m.opc, tags, nodes)
+	if err != nil {
+		return fmt.Errorf("failed to write defaults: %w", err)
+	}
+	m.defaulted = true
+
+	subChan := make(chan *opcua.PublishNotificationData)
+
+	sub, err := m.opcmonitor(ctx, subChan)
+	if err != nil {
+		return fmt.Errorf("failed to monitor: %w", err)
+	}
+	defer func() {
+		sub.Cancel()
+	}()
 
-	ticker := time.NewTicker(10 * time.Millisecond)
 	ioread := time.NewTicker(time.Duration(m.device.ScantimeMs) * time.Millisecond)
+	defer ioread.Stop()
+	m.expect(time.Duration(m.device.ScantimeMs)*time.Millisecond, m.opc.KeepAliveInterval())
+
+	keepalive := time.NewTicker(m.opc.KeepAliveInterval())
+	defer keepalive.Stop()
 
-	for range ticker.C {
+	inputs, _ := m.inputs()
+
+	for {
 		select {
 		case <-ctx.Done():
 			return fmt.Errorf("ctx caught")
-		case <-ioread.C:
 
-			err = m.opcread()
+		case <-keepalive.C:
+
+			err = m.opc.KeepAlive(ctx)
+			if err != nil {
+				return fmt.Errorf("opc keepalive failed: %w", err)
+			}
+			m.keptAlive()
+
+		case n := <-m.reloads:
+
+			sub, err = m.reload(ctx, n, sub, subChan)
+			if err != nil {
+				return fmt.Errorf("failed to reload: %w", err)
+			}
+			ioread.Reset(time.Duration(m.device.ScantimeMs) * time.Millisecond)
+			m.expect(time.Duration(m.device.ScantimeMs)*time.Millisecond, m.opc.KeepAliveInterval())
+			inputs, _ = m.inputs()
+
+		case res := <-subChan:
+
+			// notifications of a subscription replaced by a reload are discarded
+			if res.SubscriptionID != sub.ID {
+				continue
+			}
+
+			err = m.opcupdate(res)
 			if err != nil {
-				return fmt.Errorf("opc read failed: %v", err)
+				return fmt.Errorf("opc update failed: %w", err)
 			}
 
-			err = m.iowrite()
+		case <-ioread.C:
+
+			start := time.Now()
+
+			outputs, err := m.iowrite()
 			if err != nil {
+				m.deviceState(Disconnected)
+				m.inputFailSafe(ctx)
 				return fmt.Errorf("io write failed: %v", err)
 			}
 
-			err := m.ioread()
+			err = m.ioread()
 			if err != nil {
+				m.deviceState(Disconnected)
+				m.inputFailSafe(ctx)
 				return fmt.Errorf("io read file: %v", err)
 			}
+			m.deviceState(Connected)
 
-			err = m.opcwrite()
+			err = m.opcwrite(ctx)
 			if err != nil {
-				return fmt.Errorf("opc write failed: %v", err)
+				return fmt.Errorf("opc write failed: %w", err)
 			}
 
+			m.cycle(start, len(inputs), len(inputs)+outputs)
+
 		}
 	}
-	return fmt.Errorf("unexpected exit")
 }
-func (m *Modbus) tagLoad(tags []config.TagListTag, mtags []config.ModbusTag) error {
 
-	for _, v := range mtags {
+// Reload applies the tags, scan time and fail-safe policies of next to the running driver, replacing its subscription.
+// A change to the connection to the device cannot be applied live, and returns ErrRestart.
+func (m *Modbus) Reload(next Driver) error {
+
+	n, ok := next.(*Modbus)
+	if !ok {
+		return ErrRestart
+	}
+
+	a, b := m.loaded, n.loaded
+	if a.Mode != b.Mode || a.Target != b.Target || a.TimeoutMs != b.TimeoutMs || a.Slave != b.Slave {
+		return ErrRestart
+	}
 
-		tag := config.TagListTag{}
+	m.loaded = n.loaded
 
-		for _, x := range tags {
-			if v.Name == x.Name {
-				tag = x
-			}
+	// a reload not yet applied is superseded
+	select {
+	case <-m.reloads:
+	default:
+	}
+	m.reloads <- n
+	return nil
+}
+
+// apply applies the configuration of a reload within the session
+func (m *Modbus) apply(n *Modbus) {
+
+	m.device, m.tagmap = n.device, n.tagmap
+	m.setLogger(n.log)
+	m.opc.SetLogger(n.log)
+}
+
+// reload applies the configuration of n within a session, writing the defaults of added inputs, and replacing the subscription
+func (m *Modbus) reload(ctx context.Context, n *Modbus, sub *opc.Subscription, subChan chan *opcua.PublishNotificationData) (*opc.Subscription, error) {
+
+	err := sub.Cancel()
+	if err != nil {
+		m.log.Warnf("failed to cancel subscription: %v", err)
+	}
+
+	previous := m.names()
+	m.apply(n)
+
+	err = m.resolve()
+	if err != nil {
+		return sub, err
+	}
+
+	tags, nodes := m.inputs()
+	tags, nodes = added(previous, tags, nodes)
+	err = writeDefaults(ctx, m.opc, tags, nodes)
+	if err != nil {
+		return sub, fmt.Errorf("failed to write defaults: %w", err)
+	}
+
+	next, err := m.opcmonitor(ctx, subChan)
+	if err != nil {
+		return sub, fmt.Errorf("failed to monitor: %w", err)
+	}
+
+	m.log.Infof("reloaded %v tags, %v added, scan time %vms", len(m.tagmap), len(tags), m.device.ScantimeMs)
+	return next, nil
+}
+
+// names returns the name of each tag, as a set
+func (m *Modbus) names() map[string]bool {
+
+	names := map[string]bool{}
+	for _, v := range m.tagmap {
+		names[v.Tag.Name] = true
+	}
+	return names
+}
+
+// resolve resolves the node of each tag
+func (m *Modbus) resolve() error {
+
+	var err error
+	for i, v := range m.tagmap {
+		m.tagmap[i].Node, err = m.opc.NodeID(v.Tag)
+		if err != nil {
+			return fmt.Errorf("failed to resolve nodeID for %v: %w", v.Tag.Name, err)
 		}
+	}
+	return nil
+}
 
-		if tag.Name == "" {
+func (m *Modbus) tagLoad(tags []config.TagListTag, mtags []config.ModbusTag) error {
+
+	byName := tagIndex(tags)
+
+	for _, v := range mtags {
+
+		tag, ok := byName[v.Name]
+		if !ok {
 			return fmt.Errorf("modbus tag %v was not found in global tag list", v)
 		}
 
@@ -145,105 +390,238 @@ func (m *Modbus) tagLoad(tags []config.TagListTag, mtags []config.ModbusTag) err
 	return nil
 }
 
-func (m *Modbus) opcread() error {
+// Validate checks the scan time, and the register and type of each tag
+func (m *Modbus) Validate() error {
+
+	problems := []string{}
+
+	if m.device.ScantimeMs <= 0 {
+		problems = append(problems, "scantime_ms must be greater than 0")
+	}
 
 	for _, v := range m.tagmap {
 
-		nid, err := v.Tag.NodeID()
-		if err != nil {
-			return fmt.Errorf("failed to parse nodeID for: %v: %w", v, err)
+		switch v.Modbus.Type {
+		case config.ModbusCoil, config.ModbusDiscrete, config.ModbusInput, config.ModbusHolding:
+		default:
+			problems = append(problems, fmt.Sprintf("%v: register type %v is not one of [%v %v %v %v]", v.Tag.Name, v.Modbus.Type, config.ModbusCoil, config.ModbusDiscrete, config.ModbusInput, config.ModbusHolding))
 		}
 
-		req := &ua.ReadRequest{
-			MaxAge:             0,
-			NodesToRead:        []*ua.ReadValueID{{NodeID: &nid}},
-			TimestampsToReturn: ua.TimestampsToReturnBoth,
+		if v.Tag.Type != "" {
+			_, err := opc.DataType(v.Tag.Type)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", v.Tag.Name, err))
+			}
 		}
+	}
 
-		resp, err := m.opc.Read(req)
-		if err != nil {
-			return fmt.Errorf("failed to read %v (%v): %w", v.Tag.Name, nid, err)
+	return validation(problems)
+}
+
+// inputs returns the discrete and input tags, which are written to OPC
+func (m *Modbus) inputs() ([]config.TagListTag, []*ua.NodeID) {
+
+	tags := []config.TagListTag{}
+	nodes := []*ua.NodeID{}
+	for _, v := range m.tagmap {
+		if v.Modbus.Type == config.ModbusDiscrete || v.Modbus.Type == config.ModbusInput {
+			tags = append(tags, v.Tag)
+			nodes = append(nodes, v.Node)
 		}
-		if len(resp.Results) < 1 {
-			return fmt.Errorf("no results returned for %v (%v)", v.Tag.Name, nid)
+	}
+	return tags, nodes
+}
+
+// inputFailSafe applies the fail-safe policy to the discrete and input tags, on loss of the device
+func (m *Modbus) inputFailSafe(ctx context.Context) {
+
+	tags, nodes := m.inputs()
+	err := failsafe(ctx, m.opc, m.device.FailSafe, tags, nodes)
+	if err != nil {
+		m.log.Errorf("failed to apply failsafe %v to inputs: %v", m.device.FailSafe, err)
+	}
+}
+
+// outputFailSafe drives the coils and holding registers to their defaults on loss of OPC or on shutdown, if configured
+func (m *Modbus) outputFailSafe() {
+
+	if m.device.FailSafeOutputs != config.FailSafeDefault {
+		return
+	}
+
+	for i := range m.tagmap {
+		m.outputDefault(i)
+	}
+}
+
+// outputDefault drives the ith tag to its default, if a coil or holding register
+func (m *Modbus) outputDefault(i int) {
+
+	v := m.tagmap[i]
+	index := v.Modbus.Index
+	switch v.Modbus.Type {
+	case config.ModbusCoil:
+		value, err := opc.Coerce("bool", v.Tag.DefaultValue)
+		if err != nil {
+			m.log.With("tag", v.Tag.Name).Errorf("invalid default for coil: %v", err)
+			return
 		}
-		if resp.Results[0].Status != ua.StatusOK {
-			return fmt.Errorf("read failed for for %v (%v): %v", v.Tag.Name, nid, resp.Results[0].Status)
+		m.buffer.coils[index] = value.(bool)
+	case config.ModbusHolding:
+		value, err := opc.Coerce("uint16", v.Tag.DefaultValue)
+		if err != nil {
+			m.log.With("tag", v.Tag.Name).Errorf("invalid default for holding register: %v", err)
+			return
 		}
+		m.buffer.holding[index] = value.(uint16)
+	default:
+		return
+	}
+	m.tagmap[i].Cached = true
 
-		variant := resp.Results[0].Value
+	err := m.iowriteTag(v.Modbus)
+	if err != nil {
+		m.log.With("tag", v.Tag.Name).Errorf("failed to write failsafe default: %v", err)
+	}
+}
+
+// opcmonitor registers a monitored item for each coil and holding tag, such that the buffer is kept up to date by the subscription
+func (m *Modbus) opcmonitor(ctx context.Context, subChan chan *opcua.PublishNotificationData) (*opc.Subscription, error) {
+
+	names := []string{}
+	nodes := []*ua.NodeID{}
+	handles := []uint32{}
+	m.handles = map[uint32]int{}
+
+	for i, v := range m.tagmap {
 
 		switch v.Modbus.Type {
-		case config.ModbusCoil:
-			m.buffer.coils[v.Modbus.Index] = variant.Bool()
-		case config.ModbusDiscrete:
-			continue
-		case config.ModbusHolding:
-			m.buffer.holding[v.Modbus.Index] = uint16(variant.Uint())
-		case config.ModbusInput:
+		case config.ModbusCoil, config.ModbusHolding:
+		default:
 			continue
 		}
 
+		monitorHandle := uint32(i + 1)
+		m.tagmap[i].MonitorHandle = monitorHandle
+		m.handles[monitorHandle] = i
+
+		names = append(names, v.Tag.Name)
+		nodes = append(nodes, v.Node)
+		handles = append(handles, monitorHandle)
+	}
+
+	sub, results, err := m.opc.Monitor(ctx, time.Duration(m.device.ScantimeMs)*time.Millisecond, nodes, handles, subChan)
+	if err != nil {
+		return nil, err
+	}
+
+	err = statusErrors(names, nodes, results)
+	if err != nil {
+		sub.Cancel()
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// opcupdate applies a subscription notification to the buffer, and writes the changed coils and holding registers through to the device
+func (m *Modbus) opcupdate(res *opcua.PublishNotificationData) error {
+
+	if res.Error != nil {
+		m.log.Warnf("error in sub: %v", res.Error)
+		return nil
+	}
+
+	switch x := res.Value.(type) {
+	case *ua.DataChangeNotification:
+
+		for _, item := range x.MonitoredItems {
+
+			if item.ClientHandle == 0 {
+				return fmt.Errorf("monitor item returned with ClientHandle 0?: %v", item)
+			}
+
+			i, ok := m.handles[item.ClientHandle]
+			if !ok {
+				return fmt.Errorf("failed to identify map for handle %v: %v", item.ClientHandle, item)
+			}
+			v := m.tagmap[i]
+
+			// a value that is not good, such as one marked bad by the fail-safe of another driver, is not written through to the device,
+			// in place of which the output fail-safe applies to the tag
+			if item.Value.Status != ua.StatusOK {
+				m.log.With("tag", v.Tag.Name).Warnf("value is %v, applying failsafe %v", statusName(item.Value.Status), m.device.FailSafeOutputs)
+				if m.device.FailSafeOutputs == config.FailSafeDefault {
+					m.outputDefault(i)
+				}
+				continue
+			}
+
+			variant := item.Value.Value
+			switch v.Modbus.Type {
+			case config.ModbusCoil:
+				value, err := opc.Coerce("bool", variant.Value())
+				if err != nil {
+					return fmt.Errorf("invalid value for coil %v: %w", v.Tag.Name, err)
+				}
+				m.buffer.coils[v.Modbus.Index] = value.(bool)
+			case config.ModbusHolding:
+				value, err := opc.Coerce("uint16", variant.Value())
+				if err != nil {
+					return fmt.Errorf("invalid value for holding register %v: %w", v.Tag.Name, err)
+				}
+				m.buffer.holding[v.Modbus.Index] = value.(uint16)
+			}
+			m.tagmap[i].Cached = true
+
+			err := m.iowriteTag(v.Modbus)
+			if err != nil {
+				return fmt.Errorf("io write failed for %v: %w", v.Tag.Name, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown change type returned: %T", x)
 	}
 
 	return nil
 }
-func (m *Modbus) opcwrite() error {
+
+func (m *Modbus) opcwrite(ctx context.Context) error {
+
+	names := []string{}
+	nodes := []*ua.NodeID{}
+	values := []*ua.Variant{}
 
 	for _, v := range m.tagmap {
 
-		var variant ua.Variant
+		var value interface{}
 
 		switch v.Modbus.Type {
-		case config.ModbusCoil:
-			continue
 		case config.ModbusDiscrete:
-			pvariant, err := ua.NewVariant(m.buffer.discretes[v.Modbus.Index])
-			if err != nil {
-				return fmt.Errorf("failed to encode value for %+v", v.Tag.Name)
-			}
-			variant = *pvariant
-		case config.ModbusHolding:
-			continue
+			value = m.buffer.discretes[v.Modbus.Index]
 		case config.ModbusInput:
-			pvariant, err := ua.NewVariant(m.buffer.input[v.Modbus.Index])
-			if err != nil {
-				return fmt.Errorf("failed to encode value for %+v", v.Tag.Name)
-			}
-			variant = *pvariant
+			value = m.buffer.input[v.Modbus.Index]
+		default:
+			continue
 		}
 
-		nid, err := v.Tag.NodeID()
+		variant, err := opc.Variant(v.Tag.Type, value)
 		if err != nil {
-			return fmt.Errorf("failed to parse nodeID for: %v: %w", v, err)
+			return fmt.Errorf("failed to encode value for %v: %w", v.Tag.Name, err)
 		}
 
-		req := &ua.WriteRequest{
-			NodesToWrite: []*ua.WriteValue{
-				{
-					NodeID:      &nid,
-					AttributeID: ua.AttributeIDValue,
-					Value: &ua.DataValue{
-						EncodingMask: ua.DataValueValue,
-						Value:        &variant,
-					},
-				},
-			},
-		}
+		names = append(names, v.Tag.Name)
+		nodes = append(nodes, v.Node)
+		values = append(values, variant)
+	}
 
-		resp, err := m.opc.Write(req)
-		if err != nil {
-			return fmt.Errorf("write failed for %v (%v): %w", v.Tag.Name, nid, err)
-		}
-		if len(resp.Results) < 1 {
-			return fmt.Errorf("no results returned for %v (%v)", v.Tag.Name, nid)
-		}
-		if resp.Results[0].Error() != ua.StatusOK.Error() {
-			return fmt.Errorf("write failed for %v (%v): %v", v.Tag.Name, nid, resp.Results[0].Error())
-		}
+	results, err := m.opc.WriteValues(ctx, nodes, values)
+	if err != nil {
+		return fmt.Errorf("write failed: %w", err)
 	}
 
-	return nil
+	return statusErrors(names, nodes, results)
 }
 
 func (m *Modbus) ioread() error {
@@ -277,33 +655,46 @@ func (m *Modbus) ioread() error {
 	return nil
 }
 
-func (m *Modbus) iowrite() error {
+// iowrite writes each output to the device, returning the number of outputs written
+func (m *Modbus) iowrite() (int, error) {
 
+	written := 0
 	for _, v := range m.tagmap {
 
-		index := v.Modbus.Index
-		switch v.Modbus.Type {
-		case config.ModbusCoil:
-			var i uint16
-			if m.buffer.coils[index] {
-				i = 0xFF00
-			} else {
-				i = 0x0000
-			}
-			_, err := m.conn.WriteSingleCoil(index, i)
-			if err != nil {
-				return fmt.Errorf("failed to write coil %v: %w", index, err)
-			}
-		case config.ModbusDiscrete:
-			continue
-		case config.ModbusHolding:
-			_, err := m.conn.WriteSingleRegister(index, m.buffer.holding[index])
-			if err != nil {
-				return fmt.Errorf("failed to write holding register %v: %w", index, err)
-			}
-		case config.ModbusInput:
+		// outputs are not written until the subscription has provided an initial value
+		if !v.Cached {
 			continue
 		}
+
+		err := m.iowriteTag(v.Modbus)
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+func (m *Modbus) iowriteTag(tag config.ModbusTag) error {
+
+	index := tag.Index
+	switch tag.Type {
+	case config.ModbusCoil:
+		var i uint16
+		if m.buffer.coils[index] {
+			i = 0xFF00
+		} else {
+			i = 0x0000
+		}
+		_, err := m.conn.WriteSingleCoil(index, i)
+		if err != nil {
+			return fmt.Errorf("failed to write coil %v: %w", index, err)
+		}
+	case config.ModbusHolding:
+		_, err := m.conn.WriteSingleRegister(index, m.buffer.holding[index])
+		if err != nil {
+			return fmt.Errorf("failed to write holding register %v: %w", index, err)
+		}
 	}
 	return nil
 }
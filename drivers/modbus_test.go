@@ -6,14 +6,22 @@ package drivers
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"tel/config"
+	"tel/logging"
+	"tel/opc"
 	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
 )
 
 func TestModbus(t *testing.T) {
 
-	ctx := context.Background()
-	_opc := "opc.tcp://localhost:4840"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
 	tags, err := config.LoadTagList("../config/taglist.yml")
 	if err != nil {
@@ -24,15 +32,204 @@ func TestModbus(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to load taglist: %v", err)
 	}
+	// no device listens on port 1, such that the driver fails on its first scan
+	mconfig.Modbus.Device.Target = "127.0.0.1:1"
+
+	srv, _ := serve(ctx, t, tags.Tags)
 
-	d, err := NewModbus(tags.Tags, mconfig.Modbus, _opc)
+	d, err := NewModbus("modbus", tags.Tags, mconfig.Modbus, config.OPCClient{Endpoint: srv.Endpoint()})
 	if err != nil {
 		t.Fatalf("failed to create modbus driver: %v", err)
 	}
 
 	err = d.Run(ctx)
+	if err == nil || ctx.Err() != nil || errors.As(err, &opc.ConnectionError{}) {
+		t.Fatalf("expected the driver to connect to opc, and fail on the device, got %v", err)
+	}
+
+	status := d.Status()
+	if status.Device != Disconnected || status.LastError == "" {
+		t.Fatalf("expected the device to be disconnected with an error, got %+v", status)
+	}
+}
+
+// device is a modbus device of a single input register, recording the holding registers written
+type device struct {
+	nullClient
+	mu      sync.Mutex
+	input   uint16
+	holding map[uint16]uint16
+}
+
+func (d *device) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return []byte{byte(d.input >> 8), byte(d.input)}, nil
+}
+
+func (d *device) WriteSingleRegister(address, value uint16) ([]byte, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.holding[address] = value
+	return nil, nil
+}
+
+func (d *device) Close() error {
+	return nil
+}
+
+// set sets the input register, and returns the holding register at address
+func (d *device) set(input uint16, address uint16) uint16 {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.input = input
+	return d.holding[address]
+}
+
+// TestModbusReconnect restarts the OPC server under a running driver, which reconnects and re-establishes its subscription,
+// while a client replays its cached writes to the restarted server
+func TestModbusReconnect(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tags := []config.TagListTag{
+		{Name: "FLOW", Type: "uint16"},
+		{Name: "SETPOINT", Type: "uint16", DefaultValue: 5},
+		{Name: "MODE", Type: "uint16"},
+	}
+
+	first, stop := context.WithCancel(ctx)
+	defer stop()
+	srv, stopped := serve(first, t, tags)
+
+	cfg := config.ModbusDriver{
+		Device: config.ModbusDevice{Mode: string(config.ModbusModeTCP), Target: "127.0.0.1:1", ScantimeMs: 20, TimeoutMs: 100, Slave: 1},
+		Tags:   []config.ModbusTag{{Name: "FLOW", Type: config.ModbusInput, Index: 0}, {Name: "SETPOINT", Type: config.ModbusHolding, Index: 0}},
+	}
+	d, err := NewModbus("wago_1", tags, cfg, config.OPCClient{Endpoint: srv.Endpoint(), KeepAliveMs: 50, ReconnectMinMs: 10, ReconnectMaxMs: 50})
+	if err != nil {
+		t.Fatalf("failed to create modbus driver: %v", err)
+	}
+	dev := &device{input: 7, holding: map[uint16]uint16{}}
+	d.conn = modbusClient{Client: dev, mon: d.monitor}
+	d.closer = dev
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Run(ctx)
+	}()
+
+	c := opc.NewClient(config.OPCClient{Endpoint: srv.Endpoint()})
+	err = c.Connect(ctx)
 	if err != nil {
-		t.Fatalf("%v", err)
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	nodes := []*ua.NodeID{}
+	for _, v := range tags {
+		node, err := c.NodeID(v)
+		if err != nil {
+			t.Fatalf("failed to resolve %v: %v", v.Name, err)
+		}
+		nodes = append(nodes, node)
 	}
 
+	read := func(i int) uint16 {
+		results, err := c.ReadValues(ctx, nodes[i:i+1])
+		if err != nil || results[0].Value == nil {
+			return 0
+		}
+		v, _ := results[0].Value.Value().(uint16)
+		return v
+	}
+	write := func(i int, v uint16) {
+		results, err := c.WriteValues(ctx, nodes[i:i+1], []*ua.Variant{ua.MustVariant(v)})
+		if err != nil || results[0] != ua.StatusOK {
+			t.Fatalf("failed to write %v: %v %v", tags[i].Name, err, results)
+		}
+	}
+
+	eventually(t, "the input to be scanned", func() bool { return read(0) == 7 })
+	write(1, 42)
+	eventually(t, "the output to be written", func() bool { return dev.set(7, 0) == 42 })
+	write(2, 3)
+
+	stop()
+	<-stopped
+	eventually(t, "the driver to lose opc", func() bool { return d.Status().OPC == Disconnected })
+	dev.set(9, 0)
+
+	serve(ctx, t, tags)
+
+	c.Close()
+	err = c.Connect(ctx)
+	if err != nil {
+		t.Fatalf("failed to reconnect: %v", err)
+	}
+	if read(2) != 3 {
+		t.Fatalf("expected the cached write of MODE to be replayed, got %v", read(2))
+	}
+
+	eventually(t, "the driver to reconnect", func() bool { return d.Status().OPC == Connected && read(0) == 9 })
+	write(1, 43)
+	eventually(t, "the output to be written by the new subscription", func() bool { return dev.set(9, 0) == 43 })
+
+	cancel()
+	<-done
+}
+
+// TestModbusQuality updates outputs with values that are not good, which apply the output fail-safe in place of failing the driver
+func TestModbusQuality(t *testing.T) {
+
+	tags := []config.TagListTag{
+		{Name: "SETPOINT", Type: "uint16", DefaultValue: 5},
+		{Name: "RUN", Type: "bool", DefaultValue: 1},
+	}
+
+	for _, policy := range []config.FailSafe{config.FailSafeDefault, config.FailSafeHold} {
+
+		m := &Modbus{
+			monitor: newMonitor("wago_1", "", logging.Default()),
+			device:  config.ModbusDevice{FailSafeOutputs: policy},
+			conn:    nullClient{},
+			handles: map[uint32]int{1: 0, 2: 1},
+		}
+		err := m.tagLoad(tags, []config.ModbusTag{{Name: "SETPOINT", Type: config.ModbusHolding, Index: 10}, {Name: "RUN", Type: config.ModbusCoil, Index: 3}})
+		if err != nil {
+			t.Fatalf("failed to load tags: %v", err)
+		}
+
+		err = m.opcupdate(notification(&ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(uint16(9))}, &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(false)}))
+		if err != nil {
+			t.Fatalf("%v: failed to update: %v", policy, err)
+		}
+
+		err = m.opcupdate(notification(&ua.DataValue{Status: ua.StatusBadNoCommunication}, &ua.DataValue{Status: ua.StatusUncertainLastUsableValue, Value: ua.MustVariant(false)}))
+		if err != nil {
+			t.Fatalf("%v: expected values that are not good not to fail the driver, got %v", policy, err)
+		}
+
+		holding, coil := m.buffer.holding[10], m.buffer.coils[3]
+		if policy == config.FailSafeDefault && (holding != 5 || !coil) {
+			t.Fatalf("%v: expected the defaults 5 and true, got %v and %v", policy, holding, coil)
+		}
+		if policy == config.FailSafeHold && (holding != 9 || coil) {
+			t.Fatalf("%v: expected the last good values 9 and false, got %v and %v", policy, holding, coil)
+		}
+	}
+}
+
+// notification returns a data change notification of each value, of handles from 1
+func notification(values ...*ua.DataValue) *opcua.PublishNotificationData {
+
+	items := []*ua.MonitoredItemNotification{}
+	for i, v := range values {
+		items = append(items, &ua.MonitoredItemNotification{ClientHandle: uint32(i + 1), Value: v})
+	}
+	return &opcua.PublishNotificationData{Value: &ua.DataChangeNotification{MonitoredItems: items}}
 }
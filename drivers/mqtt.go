@@ -8,8 +8,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"tel/config"
+	"tel/opc"
 	"time"
 
 	pahmqtt "github.com/eclipse/paho.mqtt.golang"
@@ -18,31 +18,66 @@ import (
 )
 
 type MQTT struct {
+	*monitor
 	device config.MQTTDevice
-	tagmap []mqttMap
-	opc    *opcua.Client
-	mqc    pahmqtt.Client
+	// loaded is the device configuration last accepted by New or Reload, against which a reload is compared, and is only accessed by Reload
+	loaded  config.MQTTDevice
+	reloads chan *MQTT
+	tagmap  []mqttMap
+	opc     *opc.Client
+	mqc     pahmqtt.Client
+	// handles indexes the tagmap by the monitor handle of each tag
+	handles map[uint32]int
 }
 
 type mqttMap struct {
 	Mqtt          config.MQTTTag
 	Tag           config.TagListTag
+	Node          *ua.NodeID
 	MonitorHandle uint32
 }
 
+// mqttMessage is the message published for a tag. A value that is not good, such as one marked bad by the fail-safe of another driver,
+// is published without a value, and with its quality as the name of its OPC status, such as BadNoCommunication.
 type mqttMessage struct {
 	Timestamp time.Time   `json:"timestamp"`
 	Type      string      `json:"type"`
 	Value     interface{} `json:"value"`
+	Quality   string      `json:"quality,omitempty"`
 }
 
-func NewMQTT(tags []config.TagListTag, cfg config.MQTTDriver, opc string) (*MQTT, error) {
+func init() {
+	Register(Registration{
+		Name: "mqtt",
+		Config: func() interface{} {
+			return config.MQTT{}
+		},
+		Load: func(path string) (interface{}, error) {
+			return config.LoadMqtt(path)
+		},
+		New: func(name string, tags []config.TagListTag, cfg interface{}, opcConfig config.OPCClient) (Driver, error) {
+			c := cfg.(config.MQTT)
+			return NewMQTT(name, tags, c.Mqtt, opcConfig)
+		},
+	})
+}
+
+func NewMQTT(name string, tags []config.TagListTag, cfg config.MQTTDriver, opcConfig config.OPCClient) (*MQTT, error) {
+
+	log, err := newLogger(name, cfg.Device.Label, cfg.Device.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("mqtt as: %+v", cfg.Device.Target)
 
 	mb := MQTT{
-		device: cfg.Device,
+		monitor: newMonitor(name, cfg.Device.Label, log),
+		device:  cfg.Device,
+		loaded:  cfg.Device,
+		reloads: make(chan *MQTT, 1),
 	}
 
-	err := mb.tagLoad(tags, cfg.Tags)
+	err = mb.tagLoad(tags, cfg.Tags)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load tags: %w", err)
 	}
@@ -53,133 +88,271 @@ func NewMQTT(tags []config.TagListTag, cfg config.MQTTDriver, opc string) (*MQTT
 	mqconfig.SetUsername(cfg.Device.Username)
 	mqconfig.SetPassword(cfg.Device.Token)
 	mqconfig.SetKeepAlive(time.Duration(cfg.Device.KeepAliveMs) * time.Millisecond)
+	mqconfig.SetOnConnectHandler(func(pahmqtt.Client) {
+		mb.deviceState(Connected)
+	})
+	mqconfig.SetConnectionLostHandler(func(_ pahmqtt.Client, err error) {
+		mb.deviceState(Disconnected)
+		mb.failed(fmt.Errorf("mqtt connection lost: %w", err))
+		// the handler is called by the client, so uses the logger of the driver as last reloaded
+		mb.logger().Warnf("mqtt connection lost: %v", err)
+	})
 
 	mqc := pahmqtt.NewClient(mqconfig)
 
 	mb.mqc = mqc
-	mb.opc = opcua.NewClient(opc)
+	mb.opc = opc.NewClient(opcConfig)
+	mb.opc.SetObserver(mb.opcObserver())
+	mb.opc.SetLogger(log)
+	mb.expect(0, mb.opc.KeepAliveInterval())
 	return &mb, nil
 }
 
-func (m *MQTT) Run(ctx context.Context) error {
+// Tags returns the tags of the driver, which are read from OPC and published
+func (m *MQTT) Tags() []TagUsage {
 
-	err := m.opc.Connect(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to connect OPC: %w", err)
+	tags := []TagUsage{}
+	for _, v := range m.tagmap {
+		tags = append(tags, TagUsage{Tag: v.Tag})
 	}
-	defer m.opc.CloseSessionWithContext(ctx)
+	return tags
+}
+
+func (m *MQTT) Run(ctx context.Context) error {
 
 	token := m.mqc.Connect()
 	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to connect: %w", token.Error())
+		err := fmt.Errorf("failed to connect: %w", token.Error())
+		m.failed(err)
+		return err
 	}
+	defer func() {
+		m.mqc.Disconnect(250)
+		m.deviceState(Disconnected)
+	}()
 
-	subChan := make(chan *opcua.PublishNotificationData)
+	return reconnect(ctx, m.opc, m.monitor, m.session)
+}
 
-	sub, err := m.opc.Subscribe(&opcua.SubscriptionParameters{
-		Interval:                   time.Duration(m.device.SubscriptionMs) * time.Millisecond,
-		LifetimeCount:              opcua.DefaultSubscriptionLifetimeCount,
-		MaxKeepAliveCount:          opcua.DefaultSubscriptionMaxKeepAliveCount,
-		MaxNotificationsPerPublish: opcua.DefaultSubscriptionMaxNotificationsPerPublish,
-		Priority:                   opcua.DefaultSubscriptionPriority,
-	}, subChan)
+// Validate checks the subscription interval, and the topic and type of each tag
+func (m *MQTT) Validate() error {
 
-	defer sub.Cancel(ctx)
+	problems := []string{}
 
-	if err != nil {
-		return fmt.Errorf("failed to create subscription")
+	if m.device.SubscriptionMs <= 0 {
+		problems = append(problems, "subscription_ms must be greater than 0")
 	}
 
-	for i, v := range m.tagmap {
-		nid, err := v.Tag.NodeID()
-		if err != nil {
-			return fmt.Errorf("failed to get nodeId for %v: %w", v, err)
-		}
-
-		monitorHandle := uint32(i + 1)
-		m.tagmap[i].MonitorHandle = monitorHandle
+	for _, v := range m.tagmap {
 
-		res, err := sub.Monitor(ua.TimestampsToReturnBoth, &ua.MonitoredItemCreateRequest{
-			ItemToMonitor: &ua.ReadValueID{
-				NodeID:       &nid,
-				AttributeID:  ua.AttributeIDValue,
-				DataEncoding: &ua.QualifiedName{},
-			},
-			MonitoringMode: ua.MonitoringModeReporting,
-			RequestedParameters: &ua.MonitoringParameters{
-				ClientHandle:     monitorHandle,
-				DiscardOldest:    true,
-				Filter:           nil,
-				QueueSize:        10,
-				SamplingInterval: 1.0,
-			},
-		})
-		if err != nil {
-			return fmt.Errorf("failed to monitor %v: %w", v.Tag.Name, err)
+		if v.Mqtt.Topic == "" {
+			problems = append(problems, fmt.Sprintf("%v: topic is not set", v.Tag.Name))
 		}
-		if res.Results[0].StatusCode != ua.StatusOK {
-			return fmt.Errorf("bad status code monitoring %v: %v", v.Tag.Name, res.Results[0].StatusCode)
+
+		if v.Tag.Type != "" {
+			_, err := opc.DataType(v.Tag.Type)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", v.Tag.Name, err))
+			}
 		}
 	}
 
+	return validation(problems)
+}
+
+// session subscribes to the tags against a single OPC connection, until the connection is lost or an error occurs
+func (m *MQTT) session(ctx context.Context) error {
+
+	err := m.opc.Connect(ctx)
+	defer m.opc.Close()
+	if err != nil {
+		return fmt.Errorf("failed to connect OPC: %w", err)
+	}
+	m.opcState(Connected)
+
+	// a reload received while not running is applied in full by the session
+	select {
+	case n := <-m.reloads:
+		m.apply(n)
+	default:
+	}
+
+	subChan := make(chan *opcua.PublishNotificationData)
+
+	sub, err := m.subscribe(ctx, subChan)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sub.Cancel()
+	}()
+
+	keepalive := time.NewTicker(m.opc.KeepAliveInterval())
+	defer keepalive.Stop()
+
 	for {
 		select {
 
 		case <-ctx.Done():
 			return fmt.Errorf("ctx done")
 
+		case <-keepalive.C:
+
+			err = m.opc.KeepAlive(ctx)
+			if err != nil {
+				return fmt.Errorf("opc keepalive failed: %w", err)
+			}
+			m.keptAlive()
+
+		case n := <-m.reloads:
+
+			err = sub.Cancel()
+			if err != nil {
+				m.log.Warnf("failed to cancel subscription: %v", err)
+			}
+
+			m.apply(n)
+			next, err := m.subscribe(ctx, subChan)
+			if err != nil {
+				return fmt.Errorf("failed to reload: %w", err)
+			}
+			sub = next
+			m.log.Infof("reloaded %v tags, subscription interval %vms", len(m.tagmap), m.device.SubscriptionMs)
+
 		case res := <-subChan:
 
+			// notifications of a subscription replaced by a reload are discarded
+			if res.SubscriptionID != sub.ID {
+				continue
+			}
+
 			if res.Error != nil {
-				log.Printf("error in sub: %v", res.Error)
+				m.log.Warnf("error in sub: %v", res.Error)
 				continue
 			}
 
 			switch x := res.Value.(type) {
 			case *ua.DataChangeNotification:
 
-				for _, item := range x.MonitoredItems {
-
-					if item.ClientHandle == 0 {
-						return fmt.Errorf("monitor item returned with ClientHandle 0?: %v", item)
-					}
-
-					written := false
-					for _, v := range m.tagmap {
-						if v.MonitorHandle == item.ClientHandle {
-							val := item.Value.Value
-							err := m.writeItem(v.Tag, v.Mqtt, val)
-							if err != nil {
-								return fmt.Errorf("failed to write %v: %w", v.Tag, err)
-							}
-							written = true
-							break
-						}
-					}
-					if !written {
-						return fmt.Errorf("failed to identify map for handle %v: %v", item.ClientHandle, item)
-					}
+				start := time.Now()
+				changed, err := m.changed(x.MonitoredItems)
+				if err != nil {
+					return err
+				}
+
+				err = m.writeItems(ctx, changed)
+				if err != nil {
+					return fmt.Errorf("failed to write: %w", err)
 				}
 
+				m.cycle(start, len(changed), len(changed))
+
 			default:
 				return fmt.Errorf("unknown change type returned: %T", x)
 			}
 		}
 	}
 }
-func (m *MQTT) tagLoad(tags []config.TagListTag, mtags []config.MQTTTag) error {
 
-	for _, v := range mtags {
+// changed returns the tag of each monitored item of a notification, by its handle
+func (m *MQTT) changed(items []*ua.MonitoredItemNotification) ([]mqttMap, error) {
 
-		tag := config.TagListTag{}
+	changed := make([]mqttMap, 0, len(items))
+	for _, item := range items {
 
-		for _, x := range tags {
-			if v.Name == x.Name {
-				tag = x
-			}
+		if item.ClientHandle == 0 {
+			return nil, fmt.Errorf("monitor item returned with ClientHandle 0?: %v", item)
+		}
+
+		i, ok := m.handles[item.ClientHandle]
+		if !ok {
+			return nil, fmt.Errorf("failed to identify map for handle %v: %v", item.ClientHandle, item)
+		}
+		changed = append(changed, m.tagmap[i])
+	}
+	return changed, nil
+}
+
+// subscribe resolves the node of each tag, and subscribes to the changes of each
+func (m *MQTT) subscribe(ctx context.Context, subChan chan *opcua.PublishNotificationData) (*opc.Subscription, error) {
+
+	var err error
+	for i, v := range m.tagmap {
+		m.tagmap[i].Node, err = m.opc.NodeID(v.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve nodeID for %v: %w", v.Tag.Name, err)
 		}
+	}
+
+	names := []string{}
+	nodes := []*ua.NodeID{}
+	handles := []uint32{}
+	m.handles = map[uint32]int{}
+
+	for i, v := range m.tagmap {
+		monitorHandle := uint32(i + 1)
+		m.tagmap[i].MonitorHandle = monitorHandle
+		m.handles[monitorHandle] = i
+
+		names = append(names, v.Tag.Name)
+		nodes = append(nodes, v.Node)
+		handles = append(handles, monitorHandle)
+	}
+
+	sub, results, err := m.opc.Monitor(ctx, time.Duration(m.device.SubscriptionMs)*time.Millisecond, nodes, handles, subChan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to monitor: %w", err)
+	}
+
+	err = statusErrors(names, nodes, results)
+	if err != nil {
+		sub.Cancel()
+		return nil, fmt.Errorf("failed to monitor: %w", err)
+	}
+	return sub, nil
+}
+
+// Reload applies the tags and subscription interval of next to the running driver, replacing its subscription.
+// A change to the connection to the broker cannot be applied live, and returns ErrRestart.
+func (m *MQTT) Reload(next Driver) error {
+
+	n, ok := next.(*MQTT)
+	if !ok {
+		return ErrRestart
+	}
 
-		if tag.Name == "" {
+	a, b := m.loaded, n.loaded
+	if a.Target != b.Target || a.ClientID != b.ClientID || a.Username != b.Username || a.Token != b.Token || a.KeepAliveMs != b.KeepAliveMs {
+		return ErrRestart
+	}
+
+	m.loaded = n.loaded
+
+	// a reload not yet applied is superseded
+	select {
+	case <-m.reloads:
+	default:
+	}
+	m.reloads <- n
+	return nil
+}
+
+// apply applies the configuration of a reload within the session
+func (m *MQTT) apply(n *MQTT) {
+
+	m.device, m.tagmap = n.device, n.tagmap
+	m.setLogger(n.log)
+	m.opc.SetLogger(n.log)
+}
+
+func (m *MQTT) tagLoad(tags []config.TagListTag, mtags []config.MQTTTag) error {
+
+	byName := tagIndex(tags)
+
+	for _, v := range mtags {
+
+		tag, ok := byName[v.Name]
+		if !ok {
 			return fmt.Errorf("mqtt tag %v was not found in global tag list", v)
 		}
 
@@ -194,36 +367,46 @@ func (m *MQTT) tagLoad(tags []config.TagListTag, mtags []config.MQTTTag) error {
 	return nil
 }
 
-func (m *MQTT) writeItem(tag config.TagListTag, mqtt config.MQTTTag, value *ua.Variant) error {
+// writeItems reads the current value of each changed tag in a single batch, and publishes each to the broker
+func (m *MQTT) writeItems(ctx context.Context, items []mqttMap) error {
 
-	nid, err := tag.NodeID()
-	if err != nil {
-		return fmt.Errorf("failed to parse nodeID for: %v: %w", tag, err)
-	}
+	names := []string{}
+	nodes := []*ua.NodeID{}
 
-	req := &ua.ReadRequest{
-		MaxAge:             0,
-		NodesToRead:        []*ua.ReadValueID{{NodeID: &nid}},
-		TimestampsToReturn: ua.TimestampsToReturnBoth,
+	for _, v := range items {
+		names = append(names, v.Tag.Name)
+		nodes = append(nodes, v.Node)
 	}
 
-	resp, err := m.opc.Read(req)
+	results, err := m.opc.ReadValues(ctx, nodes)
 	if err != nil {
-		return fmt.Errorf("failed to read %v (%v): %w", tag.Name, nid, err)
-	}
-	if len(resp.Results) < 1 {
-		return fmt.Errorf("no results returned for %v (%v)", tag.Name, nid)
+		return fmt.Errorf("failed to read: %w", err)
 	}
-	if resp.Results[0].Status != ua.StatusOK {
-		return fmt.Errorf("read failed for for %v (%v): %v", tag.Name, nid, resp.Results[0].Status)
+
+	for i, v := range items {
+		if results[i].Status != ua.StatusOK {
+			m.log.With("tag", names[i]).Warnf("value is %v, publishing its quality", statusName(results[i].Status))
+		}
+		err := m.writeItem(v.Mqtt, results[i])
+		if err != nil {
+			return fmt.Errorf("failed to write %v: %w", v.Tag, err)
+		}
 	}
 
-	variant := resp.Results[0].Value
-	val := variant.Value()
+	return nil
+}
+
+func (m *MQTT) writeItem(mqtt config.MQTTTag, value *ua.DataValue) error {
+
 	p := mqttMessage{
 		Timestamp: time.Now(),
-		Value:     val,
-		Type:      fmt.Sprintf("%T", val),
+	}
+	if value.Status != ua.StatusOK {
+		p.Quality = statusName(value.Status)
+	} else if value.Value != nil {
+		val := value.Value.Value()
+		p.Value = val
+		p.Type = fmt.Sprintf("%T", val)
 	}
 
 	j, err := json.Marshal(p)
@@ -231,15 +414,19 @@ func (m *MQTT) writeItem(tag config.TagListTag, mqtt config.MQTTTag, value *ua.V
 		return fmt.Errorf("failed to marshal: %v", err)
 	}
 
+	start := time.Now()
 	token := m.mqc.Publish(mqtt.Topic+"/"+mqtt.Name, 0x00, true, j)
 
 	tout := token.WaitTimeout(time.Second * 1)
 	if !tout {
+		mqttPublishFailures.Inc(m.name, m.label)
 		return fmt.Errorf("timed out")
 	}
 	err = token.Error()
 	if err != nil {
+		mqttPublishFailures.Inc(m.name, m.label)
 		return fmt.Errorf("failed to publish: %w", err)
 	}
+	mqttPublishDuration.Observe(time.Since(start).Seconds(), m.name, m.label)
 	return nil
 }
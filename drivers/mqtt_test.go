@@ -6,14 +6,23 @@ package drivers
 
 import (
 	"context"
+	"encoding/json"
 	"tel/config"
+	"tel/logging"
+	"tel/opc"
 	"testing"
+	"time"
+
+	pahmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gopcua/opcua/ua"
 )
 
 func TestMQTT(t *testing.T) {
 
-	ctx := context.Background()
-	_opc := "opc.tcp://localhost:4840"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Setenv("MQTT_TOKEN", "test")
 
 	tags, err := config.LoadTagList("../config/taglist.yml")
 	if err != nil {
@@ -24,15 +33,103 @@ func TestMQTT(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to load taglist: %v", err)
 	}
+	// no broker listens on port 1, such that the driver fails to connect
+	gconfig.Mqtt.Device.Target = "tcp://127.0.0.1:1"
 
-	d, err := NewMQTT(tags.Tags, gconfig.Mqtt, _opc)
+	srv, _ := serve(ctx, t, tags.Tags)
+
+	d, err := NewMQTT("mqtt", tags.Tags, gconfig.Mqtt, config.OPCClient{Endpoint: srv.Endpoint()})
 	if err != nil {
 		t.Fatalf("failed to create goose driver: %v", err)
 	}
 
 	err = d.Run(ctx)
+	if err == nil || ctx.Err() != nil {
+		t.Fatalf("expected the driver to fail to connect to the broker, got %v", err)
+	}
+
+	status := d.Status()
+	if status.Device != Disconnected || status.LastError == "" {
+		t.Fatalf("expected the broker to be disconnected with an error, got %+v", status)
+	}
+}
+
+// broker is an MQTT client recording the payload published to each topic
+type broker struct {
+	pahmqtt.Client
+	published map[string][]byte
+}
+
+func (b *broker) Publish(topic string, qos byte, retained bool, payload interface{}) pahmqtt.Token {
+	b.published[topic] = payload.([]byte)
+	return done{}
+}
+
+// done is a completed token
+type done struct{}
+
+func (done) Wait() bool                     { return true }
+func (done) WaitTimeout(time.Duration) bool { return true }
+func (done) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+func (done) Error() error { return nil }
+
+// TestMQTTQuality publishes a tag marked bad, such as by the fail-safe of another driver, which is published with its quality in place of failing the driver
+func TestMQTTQuality(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tags := []config.TagListTag{
+		{Name: "FLOW", Type: "uint16", DefaultValue: 7},
+		{Name: "LEVEL", Type: "uint16", DefaultValue: 3},
+	}
+
+	srv, _ := serve(ctx, t, tags)
+
+	c := opc.NewClient(config.OPCClient{Endpoint: srv.Endpoint()})
+	err := c.Connect(ctx)
 	if err != nil {
-		t.Fatalf("%v", err)
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	items := []mqttMap{}
+	for _, v := range tags {
+		node, err := c.NodeID(v)
+		if err != nil {
+			t.Fatalf("failed to resolve %v: %v", v.Name, err)
+		}
+		items = append(items, mqttMap{Mqtt: config.MQTTTag{Name: v.Name, Topic: "site"}, Tag: v, Node: node})
 	}
 
+	_, err = c.WriteStatus(ctx, []*ua.NodeID{items[0].Node}, ua.StatusBadNoCommunication)
+	if err != nil {
+		t.Fatalf("failed to write status: %v", err)
+	}
+
+	b := &broker{published: map[string][]byte{}}
+	m := MQTT{monitor: newMonitor("telemetry", "", logging.Default()), opc: c, mqc: b}
+
+	err = m.writeItems(ctx, items)
+	if err != nil {
+		t.Fatalf("expected a bad value not to fail the driver, got %v", err)
+	}
+
+	for topic, expect := range map[string]mqttMessage{
+		"site/FLOW":  {Quality: "BadNoCommunication"},
+		"site/LEVEL": {Type: "uint16", Value: 3.0},
+	} {
+		msg := mqttMessage{}
+		err := json.Unmarshal(b.published[topic], &msg)
+		if err != nil {
+			t.Fatalf("%v: failed to decode %s: %v", topic, b.published[topic], err)
+		}
+		if msg.Quality != expect.Quality || msg.Type != expect.Type || msg.Value != expect.Value {
+			t.Fatalf("%v: expected %+v, got %s", topic, expect, b.published[topic])
+		}
+	}
 }
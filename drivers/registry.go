@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package drivers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"tel/config"
+)
+
+// Registration describes a driver, such that it can be configured and created by name.
+// Drivers within other packages register themselves from an init function, and are included by importing the package.
+type Registration struct {
+	// Name is the name of the driver, as set by RuntimeDriver.Driver or DRIVER
+	Name string
+	// Config returns an empty configuration of the driver, of the type returned by Load
+	Config func() interface{}
+	// Load loads the configuration of the driver from a file
+	Load func(path string) (interface{}, error)
+	// New creates a driver instance from a configuration returned by Load
+	New func(name string, tags []config.TagListTag, cfg interface{}, opcConfig config.OPCClient) (Driver, error)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]Registration{}
+)
+
+// Register registers a driver, panicking if the registration is incomplete or the name is already registered
+func Register(r Registration) {
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if r.Name == "" || r.Config == nil || r.Load == nil || r.New == nil {
+		panic(fmt.Sprintf("driver registration is incomplete: %+v", r))
+	}
+	if _, ok := registry[r.Name]; ok {
+		panic(fmt.Sprintf("driver %v is already registered", r.Name))
+	}
+	registry[r.Name] = r
+}
+
+// Lookup returns the registration of the driver name
+func Lookup(name string) (Registration, bool) {
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	r, ok := registry[name]
+	return r, ok
+}
+
+// Registered returns the names of the registered drivers, in order
+func Registered() []string {
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	names := []string{}
+	for k := range registry {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New loads the configuration of a driver instance from path, and creates the driver registered as driver.
+// The configuration the driver is created from is also returned, of the type returned by Registration.Load.
+func New(name string, driver string, path string, tags []config.TagListTag, opcConfig config.OPCClient) (Driver, interface{}, error) {
+
+	r, ok := Lookup(driver)
+	if !ok {
+		return nil, nil, fmt.Errorf("driver %v not recognised, expected one of %v", driver, Registered())
+	}
+
+	cfg, err := r.Load(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load %v configuration: %w", driver, err)
+	}
+
+	// a configuration which references taglist tags is checked against the taglist, reporting every missing tag
+	if refs, ok := cfg.(interface{ TagRefs() []config.TagRef }); ok {
+		err = config.CheckTags(tags, refs.TagRefs())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	d, err := r.New(name, tags, cfg, opcConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create %v driver: %w", driver, err)
+	}
+	return d, cfg, nil
+}
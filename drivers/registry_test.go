@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package drivers
+
+import (
+	"fmt"
+	"tel/config"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+
+	registered := fmt.Sprint(Registered())
+	if registered != "[goose modbus mqtt]" {
+		t.Fatalf("expected goose, modbus and mqtt to be registered, got %v", registered)
+	}
+
+	tags, err := config.LoadTagList("../config/taglist.yml")
+	if err != nil {
+		t.Fatalf("failed to load taglist: %v", err)
+	}
+
+	d, cfg, err := New("wago_1", "modbus", "../config/modbus.yml", tags.Tags, config.OPCClient{Endpoint: "opc.tcp://localhost:4840"})
+	if err != nil {
+		t.Fatalf("failed to create modbus driver: %v", err)
+	}
+	if _, ok := d.(*Modbus); !ok || d.Name() != "wago_1" {
+		t.Fatalf("expected modbus driver named wago_1, got %T %v", d, d.Name())
+	}
+	if _, ok := cfg.(config.Modbus); !ok {
+		t.Fatalf("expected the loaded modbus configuration, got %T", cfg)
+	}
+
+	_, _, err = New("x", "profibus", "", tags.Tags, config.OPCClient{})
+	if err == nil {
+		t.Fatalf("expected unregistered driver to fail")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected duplicate registration to panic")
+		}
+	}()
+	r, _ := Lookup("modbus")
+	Register(r)
+}
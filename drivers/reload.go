@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package drivers
+
+import (
+	"errors"
+	"tel/config"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// ErrRestart is returned by Reload if a configuration cannot be applied to the running driver, which must be restarted to apply it
+var ErrRestart = errors.New("configuration cannot be applied to the running driver")
+
+// Reloader is a driver which can apply a new configuration while it runs, without reconnecting to its device
+type Reloader interface {
+	// Reload applies the configuration of next, a driver of the same name created from the new configuration, which is not run.
+	// The configuration is applied by the running driver once its current cycle completes, or when it is next run.
+	// Reload returns ErrRestart if the change cannot be applied live.
+	Reload(next Driver) error
+}
+
+// added returns the tags and nodes of tags not within previous, by name
+func added(previous map[string]bool, tags []config.TagListTag, nodes []*ua.NodeID) ([]config.TagListTag, []*ua.NodeID) {
+
+	addedTags := []config.TagListTag{}
+	addedNodes := []*ua.NodeID{}
+	for i, v := range tags {
+		if !previous[v.Name] {
+			addedTags = append(addedTags, v)
+			addedNodes = append(addedNodes, nodes[i])
+		}
+	}
+	return addedTags, addedNodes
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package drivers
+
+import (
+	"errors"
+	"reflect"
+	"tel/config"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+
+	tags, err := config.LoadTagList("../config/taglist.yml")
+	if err != nil {
+		t.Fatalf("failed to load taglist: %v", err)
+	}
+	cfg, err := config.LoadModbus("../config/modbus.yml")
+	if err != nil {
+		t.Fatalf("failed to load modbus: %v", err)
+	}
+	opcConfig := config.OPCClient{Endpoint: "opc.tcp://localhost:4840"}
+
+	current, err := NewModbus("wago_1", tags.Tags, cfg.Modbus, opcConfig)
+	if err != nil {
+		t.Fatalf("failed to create modbus driver: %v", err)
+	}
+
+	live := cfg.Modbus
+	live.Device.ScantimeMs *= 2
+	live.Tags = live.Tags[:1]
+	next, err := NewModbus("wago_1", tags.Tags, live, opcConfig)
+	if err != nil {
+		t.Fatalf("failed to create modbus driver: %v", err)
+	}
+
+	err = current.Reload(next)
+	if err != nil {
+		t.Fatalf("expected scan time and tags to be applied live, got %v", err)
+	}
+	if pending := <-current.reloads; pending != next {
+		t.Fatalf("expected reload to be pending for the session")
+	}
+	if !reflect.DeepEqual(current.loaded, live.Device) {
+		t.Fatalf("expected the accepted configuration to be loaded, got %+v", current.loaded)
+	}
+
+	restart := cfg.Modbus
+	restart.Device.Target = "192.0.2.1:502"
+	next, err = NewModbus("wago_1", tags.Tags, restart, opcConfig)
+	if err != nil {
+		t.Fatalf("failed to create modbus driver: %v", err)
+	}
+
+	err = current.Reload(next)
+	if !errors.Is(err, ErrRestart) {
+		t.Fatalf("expected a change of target to require a restart, got %v", err)
+	}
+
+	mqtt, err := NewMQTT("wago_1", tags.Tags, config.MQTTDriver{}, opcConfig)
+	if err != nil {
+		t.Fatalf("failed to create mqtt driver: %v", err)
+	}
+	err = current.Reload(mqtt)
+	if !errors.Is(err, ErrRestart) {
+		t.Fatalf("expected a change of driver to require a restart, got %v", err)
+	}
+}
+
+func TestReloadGoose(t *testing.T) {
+
+	tags, err := config.LoadTagList("../config/taglist.yml")
+	if err != nil {
+		t.Fatalf("failed to load taglist: %v", err)
+	}
+	cfg, err := config.LoadGoose("../config/goose.yml")
+	if err != nil {
+		t.Fatalf("failed to load goose: %v", err)
+	}
+	opcConfig := config.OPCClient{Endpoint: "opc.tcp://localhost:4840"}
+
+	current, err := NewGoose("goose_1", tags.Tags, cfg.Goose, opcConfig)
+	if err != nil {
+		t.Fatalf("failed to create goose driver: %v", err)
+	}
+
+	// the number of tags of a dataset is applied live
+	live := config.GooseDriver{Device: cfg.Goose.Device, Endpoints: append([]config.GooseEndpoint{}, cfg.Goose.Endpoints...)}
+	live.Endpoints[0].Datasets = append([]config.GooseDataset{}, live.Endpoints[0].Datasets...)
+	live.Endpoints[0].Datasets[0].Tags--
+	next, err := NewGoose("goose_1", tags.Tags, live, opcConfig)
+	if err != nil {
+		t.Fatalf("failed to create goose driver: %v", err)
+	}
+
+	err = current.Reload(next)
+	if err != nil {
+		t.Fatalf("expected the tags of a dataset to be applied live, got %v", err)
+	}
+	if !reflect.DeepEqual(current.loaded, live) {
+		t.Fatalf("expected the accepted configuration to be loaded, got %+v", current.loaded)
+	}
+
+	current.apply(<-current.reloads)
+	if !reflect.DeepEqual(current.endpoints, live.Endpoints) || len(current.tagmap) != len(next.tagmap) || current.log != next.log {
+		t.Fatalf("expected the endpoints, tags and logger of the reload to be applied, got %+v", current.endpoints)
+	}
+
+	restart := live
+	restart.Device.Interface = "eth3"
+	next, err = NewGoose("goose_1", tags.Tags, restart, opcConfig)
+	if err != nil {
+		t.Fatalf("failed to create goose driver: %v", err)
+	}
+
+	err = current.Reload(next)
+	if !errors.Is(err, ErrRestart) {
+		t.Fatalf("expected a change of interface to require a restart, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package drivers
+
+import (
+	"sync"
+	"tel/logging"
+	"time"
+)
+
+// ConnectionState is the state of a connection of a driver, to OPC or to its device
+type ConnectionState string
+
+const (
+	Disconnected ConnectionState = "disconnected"
+	Connected    ConnectionState = "connected"
+)
+
+// Status is the state of a driver, with its last error, and the time of its last successful cycle.
+// A cycle is a scan for modbus, a published batch of changes for mqtt, and a received message for goose.
+type Status struct {
+	OPC           ConnectionState
+	Device        ConnectionState
+	LastError     string
+	LastErrorTime time.Time
+	LastCycle     time.Time
+	// OPCSince is the time the connection to OPC entered its current state, and is zero until the driver first connects
+	OPCSince time.Time
+	// LastKeepAlive is the time of the last OPC keepalive of the session of the driver, by which a driver of which cycles follow changes is judged alive
+	LastKeepAlive time.Time
+	// Interval is the longest time expected between cycles while connected to OPC, the scan time for modbus,
+	// and zero for mqtt and goose, of which cycles follow changes. KeepAlive is the interval of the OPC keepalive.
+	Interval  time.Duration
+	KeepAlive time.Duration
+}
+
+// Stats are the counters of a driver since it was created. Reads and writes count values read from and written to OPC or the device,
+// and latency is the duration of the last successful cycle.
+type Stats struct {
+	Cycles  uint64
+	Reads   uint64
+	Writes  uint64
+	Errors  uint64
+	Latency time.Duration
+}
+
+// monitor records the status and stats of a driver, and is embedded by each driver to implement Name, Status and Stats.
+// It is safe for concurrent use, such that the status may be read while the driver runs.
+type monitor struct {
+	name   string
+	label  string
+	mu     sync.Mutex
+	status Status
+	stats  Stats
+	// log is the logger of the driver, which is only used by the goroutine running the driver, else by logger
+	log *logging.Logger
+}
+
+// newMonitor returns the monitor of the driver instance name, of the device label
+func newMonitor(name string, label string, log *logging.Logger) *monitor {
+	return &monitor{
+		name:   name,
+		label:  label,
+		status: Status{OPC: Disconnected, Device: Disconnected},
+		log:    log,
+	}
+}
+
+// logger returns the logger of the driver, for use outside of the goroutine running the driver
+func (m *monitor) logger() *logging.Logger {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.log
+}
+
+// setLogger replaces the logger of the driver, from the goroutine running the driver
+func (m *monitor) setLogger(l *logging.Logger) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.log = l
+}
+
+// Name returns the name of the driver instance
+func (m *monitor) Name() string {
+	return m.name
+}
+
+// Status returns the current status of the driver
+func (m *monitor) Status() Status {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Stats returns the current stats of the driver
+func (m *monitor) Stats() Stats {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// opcState records the state of the OPC connection
+func (m *monitor) opcState(state ConnectionState) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.OPC != state {
+		m.status.OPCSince = time.Now()
+	}
+	m.status.OPC = state
+	driverConnected.Set(up(state), m.name, m.label, "opc")
+}
+
+// deviceState records the state of the connection to the device
+func (m *monitor) deviceState(state ConnectionState) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.Device = state
+	driverConnected.Set(up(state), m.name, m.label, "device")
+}
+
+// up returns 1 if state is connected, else 0
+func up(state ConnectionState) float64 {
+
+	if state == Connected {
+		return 1
+	}
+	return 0
+}
+
+// expect records the longest time expected between cycles of the driver, zero if cycles follow changes, and the interval of its OPC keepalive
+func (m *monitor) expect(interval time.Duration, keepalive time.Duration) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.Interval = interval
+	m.status.KeepAlive = keepalive
+}
+
+// keptAlive records a successful OPC keepalive
+func (m *monitor) keptAlive() {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.LastKeepAlive = time.Now()
+}
+
+// cycle records a successful cycle started at start, which read and wrote the given number of values
+func (m *monitor) cycle(start time.Time, reads int, writes int) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.status.LastCycle = now
+	m.stats.Cycles++
+	m.stats.Reads += uint64(reads)
+	m.stats.Writes += uint64(writes)
+	m.stats.Latency = now.Sub(start)
+
+	driverCycles.Inc(m.name, m.label)
+	driverCycleDuration.Observe(m.stats.Latency.Seconds(), m.name, m.label)
+}
+
+// failed records an error
+func (m *monitor) failed(err error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status.LastError = err.Error()
+	m.status.LastErrorTime = time.Now()
+	m.stats.Errors++
+
+	driverErrors.Inc(m.name, m.label)
+}
@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package drivers
+
+import (
+	"fmt"
+	"tel/logging"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+
+	m := newMonitor("wago_1", "", logging.Default())
+
+	if m.Name() != "wago_1" || m.Status().OPC != Disconnected || m.Status().Device != Disconnected {
+		t.Fatalf("expected a disconnected monitor named wago_1, got %v %+v", m.Name(), m.Status())
+	}
+
+	m.opcState(Connected)
+	m.cycle(time.Now().Add(-time.Millisecond), 4, 6)
+	m.cycle(time.Now(), 4, 6)
+	m.failed(fmt.Errorf("io read failed"))
+
+	status := m.Status()
+	if status.OPC != Connected || status.Device != Disconnected || status.LastCycle.IsZero() || status.OPCSince.IsZero() || status.LastError != "io read failed" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	stats := m.Stats()
+	if stats.Cycles != 2 || stats.Reads != 8 || stats.Writes != 12 || stats.Errors != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
@@ -45,3 +45,12 @@ func (m GooseParseError) String() string {
 		return "unknown"
 	}
 }
+
+// ParseError is returned if the current message of a subscriber could not be parsed
+type ParseError struct {
+	Code GooseParseError
+}
+
+func (e ParseError) Error() string {
+	return "parse error returned: " + e.Code.String()
+}
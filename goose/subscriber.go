@@ -11,7 +11,6 @@ package goose
 */
 import "C"
 import (
-	"fmt"
 	"time"
 	"unsafe"
 )
@@ -47,7 +46,7 @@ func (s Subscriber) GetCurrentMessage() (Message, error) {
 
 	errCode := GooseParseError(C.GooseSubscriber_getParseError(s.subscriber))
 	if errCode != GooseParseErrorNone {
-		return Message{}, fmt.Errorf("parse error returned: %v", errCode)
+		return Message{}, ParseError{Code: errCode}
 	}
 
 	pdstmac := C.CBytes(make([]byte, 6))
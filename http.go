@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"tel/config"
+	"tel/logging"
+	"tel/metrics"
+	"tel/supervisor"
+	"time"
+)
+
+// serveHTTP serves the metrics of the drivers on /metrics, and the health and readiness of the instances of sup on /healthz and /readyz,
+// until ctx is cancelled. An error is returned if the address cannot be bound, after which the server is served in the background.
+func serveHTTP(ctx context.Context, c config.RuntimeHTTP, sup *supervisor.Supervisor) error {
+
+	factor := c.HealthFactor
+	if factor == 0 {
+		factor = supervisor.DefaultHealthFactor
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	mux.Handle("/healthz", probe(sup, func(s supervisor.Status) error {
+		return s.Healthy(time.Now(), factor)
+	}))
+	mux.Handle("/readyz", probe(sup, supervisor.Status.Ready))
+
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdown)
+	}()
+
+	go func() {
+		err := server.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			logging.Default().Errorf("http server stopped: %v", err)
+		}
+	}()
+
+	logging.Default().Infof("serving http on %v", ln.Addr())
+	return nil
+}
+
+// probe returns a handler checking each instance of sup, responding 200 if every instance passes check, else 503.
+// The result of each instance is listed in the body, such that the orchestrator logs which driver failed.
+func probe(sup *supervisor.Supervisor, check func(supervisor.Status) error) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+
+		code := http.StatusOK
+		body := ""
+		for _, s := range sup.Status() {
+			err := check(s)
+			if err != nil {
+				code = http.StatusServiceUnavailable
+				body += fmt.Sprintf("%v: %v\n", s.Name, err)
+				continue
+			}
+			body += fmt.Sprintf("%v: ok\n", s.Name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(body))
+	})
+}
@@ -0,0 +1,339 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+// Package logging writes structured log records as logfmt or JSON, each with a time, level, message and fields,
+// such as the driver and device of the record. Repeated warnings and errors are rate limited.
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a record
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Levels are the names of the levels, in order of severity
+var Levels = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return Levels[l]
+}
+
+// ParseLevel returns the level of name, an unset level is info
+func ParseLevel(name string) (Level, error) {
+
+	if name == "" {
+		return LevelInfo, nil
+	}
+	for i, v := range Levels {
+		if v == name {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %v, expected one of %v", name, Levels)
+}
+
+// Format is the encoding of records
+type Format string
+
+const (
+	FormatLogfmt Format = "logfmt"
+	FormatJSON   Format = "json"
+)
+
+// Formats are the supported formats
+var Formats = []string{string(FormatLogfmt), string(FormatJSON)}
+
+// ParseFormat returns the format of name, an unset format is logfmt
+func ParseFormat(name string) (Format, error) {
+
+	switch Format(name) {
+	case "":
+		return FormatLogfmt, nil
+	case FormatLogfmt, FormatJSON:
+		return Format(name), nil
+	default:
+		return FormatLogfmt, fmt.Errorf("invalid log format %v, expected one of %v", name, Formats)
+	}
+}
+
+// DefaultRateLimit is the interval at which a repeated warning or error is logged if unset
+const DefaultRateLimit = 10 * time.Second
+
+// Logger writes records at or above its level, with its fields. Loggers derived by With and WithLevel share the output of their parent.
+// A Logger is safe for concurrent use.
+type Logger struct {
+	out    *output
+	level  Level
+	fields []interface{}
+}
+
+// output is the writer shared by a logger and those derived from it, which rate limits repeated warnings and errors
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	window time.Duration
+	limits map[string]*limit
+	pruned time.Time
+	now    func() time.Time
+}
+
+// limit is the time a repeated record was last written, and the number of repeats suppressed since
+type limit struct {
+	last       time.Time
+	suppressed int
+}
+
+// New returns a logger writing records at or above level to w. A warning or error repeated with the same message and fields
+// is written at most once per window, with the number of repeats suppressed since. A window of 0 does not rate limit.
+func New(w io.Writer, format Format, level Level, window time.Duration) *Logger {
+
+	return &Logger{
+		out: &output{
+			w:      w,
+			format: format,
+			window: window,
+			limits: map[string]*limit{},
+			now:    time.Now,
+		},
+		level: level,
+	}
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(New(os.Stderr, FormatLogfmt, LevelInfo, DefaultRateLimit))
+}
+
+// Default returns the logger of the process, which logs info and above to stderr as logfmt until set by SetDefault
+func Default() *Logger {
+	return defaultLogger.Load().(*Logger)
+}
+
+// SetDefault sets the logger of the process. Loggers already derived from the previous default are not affected.
+func SetDefault(l *Logger) {
+	defaultLogger.Store(l)
+}
+
+// With returns a logger with the fields kv added, as alternating keys and values
+func (l *Logger) With(kv ...interface{}) *Logger {
+
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, level: l.level, fields: fields}
+}
+
+// WithLevel returns a logger writing records at or above level
+func (l *Logger) WithLevel(level Level) *Logger {
+	return &Logger{out: l.out, level: level, fields: l.fields}
+}
+
+// Enabled returns whether records of level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debugf(format string, a ...interface{}) {
+	l.log(LevelDebug, format, a)
+}
+
+func (l *Logger) Infof(format string, a ...interface{}) {
+	l.log(LevelInfo, format, a)
+}
+
+func (l *Logger) Warnf(format string, a ...interface{}) {
+	l.log(LevelWarn, format, a)
+}
+
+func (l *Logger) Errorf(format string, a ...interface{}) {
+	l.log(LevelError, format, a)
+}
+
+func (l *Logger) log(level Level, format string, a []interface{}) {
+
+	if !l.Enabled(level) {
+		return
+	}
+
+	o := l.out
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	fields := l.fields
+	msg := fmt.Sprintf(format, a...)
+
+	if level >= LevelWarn && o.window > 0 {
+
+		key := fmt.Sprintf("%v\x00%v\x00%v", level, msg, fields)
+		lim, ok := o.limits[key]
+		if ok && now.Sub(lim.last) < o.window {
+			lim.suppressed++
+			return
+		}
+		if !ok {
+			o.prune(now)
+			lim = &limit{}
+			o.limits[key] = lim
+		}
+		if lim.suppressed != 0 {
+			fields = append(append([]interface{}{}, fields...), "suppressed", lim.suppressed)
+		}
+		lim.last = now
+		lim.suppressed = 0
+	}
+
+	var b []byte
+	switch o.format {
+	case FormatJSON:
+		b = encodeJSON(now, level, msg, fields)
+	default:
+		b = encodeLogfmt(now, level, msg, fields)
+	}
+	_, _ = o.w.Write(b)
+}
+
+// prune removes the limits of records last written a window or more before now, at most once per window, as the messages
+// limited may each be distinct. The repeats suppressed since such a record was written are not counted once it is repeated.
+func (o *output) prune(now time.Time) {
+
+	if now.Sub(o.pruned) < o.window {
+		return
+	}
+	o.pruned = now
+	for k, v := range o.limits {
+		if now.Sub(v.last) >= o.window {
+			delete(o.limits, k)
+		}
+	}
+}
+
+// Writer returns a writer which logs each line written to it through the default logger at info, such that the standard library log package
+// may be redirected to it
+func Writer() io.Writer {
+	return writer{}
+}
+
+type writer struct{}
+
+func (writer) Write(p []byte) (int, error) {
+
+	s := bufio.NewScanner(bytes.NewReader(p))
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			Default().Infof("%s", line)
+		}
+	}
+	return len(p), nil
+}
+
+// pairs returns the fields as keys and values, a key without a value is given the value of nil
+func pairs(fields []interface{}) ([]string, []interface{}) {
+
+	keys := []string{}
+	values := []interface{}{}
+	for i := 0; i < len(fields); i += 2 {
+		keys = append(keys, fmt.Sprint(fields[i]))
+		if i+1 < len(fields) {
+			values = append(values, fields[i+1])
+		} else {
+			values = append(values, nil)
+		}
+	}
+	return keys, values
+}
+
+// text returns the value of a field as text, numbers and booleans are retained as is for encoding as JSON
+func text(v interface{}) interface{} {
+
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return x
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	default:
+		return fmt.Sprintf("%+v", x)
+	}
+}
+
+func encodeLogfmt(t time.Time, level Level, msg string, fields []interface{}) []byte {
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "ts=%v level=%v msg=%v", t.UTC().Format(time.RFC3339Nano), level, logfmtValue(msg))
+
+	keys, values := pairs(fields)
+	for i, k := range keys {
+		v := ""
+		if x := text(values[i]); x != nil {
+			v = fmt.Sprint(x)
+		}
+		fmt.Fprintf(b, " %v=%v", k, logfmtValue(v))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// logfmtValue quotes s if it is empty, or holds a space, quote, equals sign or control character
+func logfmtValue(s string) string {
+
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '"' || r == '=' || r == '\\' || r == 0x7f {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func encodeJSON(t time.Time, level Level, msg string, fields []interface{}) []byte {
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, `{"ts":%v,"level":%v,"msg":%v`, jsonValue(t.UTC().Format(time.RFC3339Nano)), jsonValue(level.String()), jsonValue(msg))
+
+	keys, values := pairs(fields)
+	for i, k := range keys {
+		fmt.Fprintf(b, ",%v:%v", jsonValue(k), jsonValue(text(values[i])))
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+func jsonValue(v interface{}) string {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(b)
+}
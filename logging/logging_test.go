@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := &bytes.Buffer{}
+
+	l := New(b, FormatLogfmt, LevelInfo, 0)
+	l.out.now = func() time.Time { return now }
+
+	l.Debugf("not logged")
+	l.With("driver", "modbus", "device", "wago 1").Warnf("scan failed: %v", errors.New("timeout"))
+	l.With("tag", `A="1"`).WithLevel(LevelDebug).Debugf("ok")
+
+	expect := "ts=2022-03-01T12:00:00Z level=warn msg=\"scan failed: timeout\" driver=modbus device=\"wago 1\"\n" +
+		"ts=2022-03-01T12:00:00Z level=debug msg=ok tag=\"A=\\\"1\\\"\"\n"
+	if b.String() != expect {
+		t.Fatalf("expected:\n%v\ngot:\n%v", expect, b.String())
+	}
+
+	b.Reset()
+	l = New(b, FormatJSON, LevelDebug, 0)
+	l.out.now = func() time.Time { return now }
+	l.With("driver", "goose", "count", 3, "err", errors.New("lost"), "latency", time.Second).Errorf("failed")
+
+	record := map[string]interface{}{}
+	err := json.Unmarshal(b.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("failed to decode %v: %v", b.String(), err)
+	}
+	for k, v := range map[string]interface{}{"ts": "2022-03-01T12:00:00Z", "level": "error", "msg": "failed", "driver": "goose", "count": 3.0, "err": "lost", "latency": "1s"} {
+		if record[k] != v {
+			t.Fatalf("expected %v of %v, got %v", v, k, record[k])
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := &bytes.Buffer{}
+
+	l := New(b, FormatLogfmt, LevelInfo, 10*time.Second)
+	l.out.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		l.Errorf("scan failed: %v", "timeout")
+		l.With("driver", "b").Errorf("scan failed: %v", "timeout")
+		l.Infof("info is not limited")
+		now = now.Add(time.Second)
+	}
+	now = now.Add(10 * time.Second)
+	l.Errorf("scan failed: %v", "timeout")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("expected 8 lines, got %v:\n%v", len(lines), b.String())
+	}
+	if !strings.HasSuffix(lines[0], `msg="scan failed: timeout"`) || !strings.HasSuffix(lines[1], `msg="scan failed: timeout" driver=b`) {
+		t.Fatalf("expected the first errors of each logger, got %v", lines[:2])
+	}
+	if !strings.HasSuffix(lines[7], `msg="scan failed: timeout" suppressed=4`) {
+		t.Fatalf("expected the suppressed errors to be counted, got %v", lines[7])
+	}
+
+	// an error of the same format but a different message is not suppressed
+	b.Reset()
+	l.Errorf("scan failed: %v", "timeout")
+	l.Errorf("scan failed: %v", "connection refused")
+
+	lines = strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], `msg="scan failed: connection refused"`) {
+		t.Fatalf("expected only the different error to be written, got %v", lines)
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	level, err := ParseLevel("")
+	if err != nil || level != LevelInfo {
+		t.Fatalf("expected an unset level to be info, got %v: %v", level, err)
+	}
+	level, err = ParseLevel("warn")
+	if err != nil || level != LevelWarn {
+		t.Fatalf("expected warn, got %v: %v", level, err)
+	}
+	_, err = ParseLevel("verbose")
+	if err == nil {
+		t.Fatalf("expected an unknown level to fail")
+	}
+	_, err = ParseFormat("xml")
+	if err == nil {
+		t.Fatalf("expected an unknown format to fail")
+	}
+}
@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+// Package metrics records counters, gauges and histograms by label, and writes them in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the buckets of a histogram of durations in seconds, from 0.5ms to 10s
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Default is the registry of the process, served by tel on /metrics if enabled
+var Default = NewRegistry()
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// Registry is a set of metrics, each of which is safe for concurrent use
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// family is a metric, with a series per combination of the values of its labels
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+// series is the value of a metric for a combination of label values. A histogram counts the observations within each bucket,
+// and the sum and count of all observations.
+type series struct {
+	values  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// register adds a metric, panicking if the name is already registered
+func (r *Registry) register(f *family) *family {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.families[f.name]; ok {
+		panic(fmt.Sprintf("metric %v is already registered", f.name))
+	}
+	f.series = map[string]*series{}
+	r.families[f.name] = f
+	return f
+}
+
+// Counter is a value that only increases, such as a number of requests
+type Counter struct {
+	r *Registry
+	f *family
+}
+
+// Counter registers a counter with the labels given
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+	return &Counter{r: r, f: r.register(&family{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+// Inc adds 1 to the series of the label values given, in the order of the labels of the counter
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the series of the label values given
+func (c *Counter) Add(v float64, values ...string) {
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.f.get(values).value += v
+}
+
+// Gauge is a value that may increase or decrease, such as the state of a connection
+type Gauge struct {
+	r *Registry
+	f *family
+}
+
+// Gauge registers a gauge with the labels given
+func (r *Registry) Gauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{r: r, f: r.register(&family{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+// Set sets the series of the label values given to v
+func (g *Gauge) Set(v float64, values ...string) {
+
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.get(values).value = v
+}
+
+// Histogram counts observations, such as durations, within buckets of increasing upper bounds
+type Histogram struct {
+	r *Registry
+	f *family
+}
+
+// Histogram registers a histogram with the upper bounds of its buckets, in increasing order, and the labels given
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r: r, f: r.register(&family{name: name, help: help, kind: kindHistogram, labels: labels, buckets: buckets})}
+}
+
+// Observe records v within the series of the label values given
+func (h *Histogram) Observe(v float64, values ...string) {
+
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+
+	s := h.f.get(values)
+	for i, b := range h.f.buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	s.value += v
+	s.count++
+}
+
+// get returns the series of the label values, creating it if not yet recorded. Missing values are empty, and extra values are ignored.
+func (f *family) get(values []string) *series {
+
+	fixed := make([]string, len(f.labels))
+	copy(fixed, values)
+
+	key := strings.Join(fixed, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: fixed, buckets: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Write writes each metric in the Prometheus text exposition format, in order of name and labels.
+// The metrics are copied before writing, such that a slow writer does not block the recording of metrics.
+func (r *Registry) Write(w io.Writer) error {
+
+	families := r.snapshot()
+
+	b := bufio.NewWriter(w)
+	for _, f := range families {
+
+		fmt.Fprintf(b, "# HELP %v %v\n", f.name, helpText.Replace(f.help))
+		fmt.Fprintf(b, "# TYPE %v %v\n", f.name, f.kind)
+
+		keys := []string{}
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+
+			s := f.series[k]
+			if f.kind != kindHistogram {
+				fmt.Fprintf(b, "%v%v %v\n", f.name, labels(f.labels, s.values, "", 0), number(s.value))
+				continue
+			}
+
+			for i, bound := range f.buckets {
+				fmt.Fprintf(b, "%v_bucket%v %v\n", f.name, labels(f.labels, s.values, "le", bound), s.buckets[i])
+			}
+			fmt.Fprintf(b, "%v_bucket%v %v\n", f.name, labels(f.labels, s.values, "le", math.Inf(1)), s.count)
+			fmt.Fprintf(b, "%v_sum%v %v\n", f.name, labels(f.labels, s.values, "", 0), number(s.value))
+			fmt.Fprintf(b, "%v_count%v %v\n", f.name, labels(f.labels, s.values, "", 0), s.count)
+		}
+	}
+
+	return b.Flush()
+}
+
+// snapshot returns a copy of each metric with recorded series, in order of name
+func (r *Registry) snapshot() []*family {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := []string{}
+	for k, f := range r.families {
+		if len(f.series) != 0 {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	families := make([]*family, 0, len(names))
+	for _, name := range names {
+
+		f := r.families[name]
+		c := &family{name: f.name, help: f.help, kind: f.kind, labels: f.labels, buckets: f.buckets, series: make(map[string]*series, len(f.series))}
+		for k, s := range f.series {
+			c.series[k] = &series{values: s.values, value: s.value, buckets: append([]uint64{}, s.buckets...), count: s.count}
+		}
+		families = append(families, c)
+	}
+	return families
+}
+
+// Handler returns a handler serving the metrics of the registry
+func (r *Registry) Handler() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.Write(w)
+	})
+}
+
+// labels formats the labels of a series, with the label extra set to bound if set, such as the le label of a histogram bucket
+func labels(names []string, values []string, extra string, bound float64) string {
+
+	pairs := []string{}
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, n, labelValue.Replace(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, extra, number(bound)))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// helpText escapes the help of a metric, with backslashes and newlines escaped
+var helpText = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// labelValue escapes a label value, with backslashes, quotes and newlines escaped
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// number formats v as in the exposition format
+func number(v float64) string {
+
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+
+	r := NewRegistry()
+	c := r.Counter("tel_errors_total", "Errors.", "driver", "device")
+	g := r.Gauge("tel_connected", "Connected.", "driver")
+	h := r.Histogram("tel_duration_seconds", "Duration\nof each cycle.", []float64{0.1, 1}, "driver")
+	r.Counter("tel_unused_total", "Not written until recorded.")
+
+	c.Inc("wago_1", `plc "A"`)
+	c.Add(2, "wago_1", `plc "A"`)
+	c.Inc("goose_1")
+	g.Set(1, "wago_1")
+	h.Observe(0.05, "wago_1")
+	h.Observe(0.5, "wago_1")
+	h.Observe(5, "wago_1")
+
+	b := &bytes.Buffer{}
+	err := r.Write(b)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	expect := `# HELP tel_connected Connected.
+# TYPE tel_connected gauge
+tel_connected{driver="wago_1"} 1
+# HELP tel_duration_seconds Duration\nof each cycle.
+# TYPE tel_duration_seconds histogram
+tel_duration_seconds_bucket{driver="wago_1",le="0.1"} 1
+tel_duration_seconds_bucket{driver="wago_1",le="1"} 2
+tel_duration_seconds_bucket{driver="wago_1",le="+Inf"} 3
+tel_duration_seconds_sum{driver="wago_1"} 5.55
+tel_duration_seconds_count{driver="wago_1"} 3
+# HELP tel_errors_total Errors.
+# TYPE tel_errors_total counter
+tel_errors_total{driver="goose_1",device=""} 1
+tel_errors_total{driver="wago_1",device="plc \"A\""} 3
+`
+	if b.String() != expect {
+		t.Fatalf("expected:\n%v\ngot:\n%v", expect, b.String())
+	}
+}
+
+func TestRegister(t *testing.T) {
+
+	r := NewRegistry()
+	r.Counter("tel_errors_total", "Errors.")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a duplicate metric to panic")
+		}
+	}()
+	r.Gauge("tel_errors_total", "Errors.")
+}
+
+// stalled is a writer which blocks until released
+type stalled struct {
+	release chan struct{}
+}
+
+func (s stalled) Write(p []byte) (int, error) {
+	<-s.release
+	return len(p), nil
+}
+
+func TestWriteStalled(t *testing.T) {
+
+	r := NewRegistry()
+	c := r.Counter("tel_errors_total", "Errors.", "driver")
+	c.Inc("wago_1")
+
+	w := stalled{release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- r.Write(w)
+	}()
+
+	recorded := make(chan struct{})
+	go func() {
+		c.Inc("wago_1")
+		close(recorded)
+	}()
+
+	select {
+	case <-recorded:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a stalled writer not to block recording")
+	}
+
+	close(w.release)
+	err := <-done
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+}
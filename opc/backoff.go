@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import "time"
+
+// Backoff provides exponentially increasing delays between Min and Max
+type Backoff struct {
+	Min  time.Duration
+	Max  time.Duration
+	next time.Duration
+}
+
+// Next returns the next delay, doubling the delay returned by the following call
+func (b *Backoff) Next() time.Duration {
+
+	if b.next < b.Min {
+		b.next = b.Min
+	}
+
+	d := b.next
+
+	b.next = b.next * 2
+	if b.next > b.Max {
+		b.next = b.Max
+	}
+	return d
+}
+
+// Reset returns the delay to Min
+func (b *Backoff) Reset() {
+	b.next = b.Min
+}
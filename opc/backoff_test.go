@@ -0,0 +1,29 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+
+	b := Backoff{Min: time.Second, Max: 5 * time.Second}
+
+	expect := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expect {
+		d := b.Next()
+		if d != e {
+			t.Fatalf("delay %v: expected %v, got %v", i, e, d)
+		}
+	}
+
+	b.Reset()
+	d := b.Next()
+	if d != time.Second {
+		t.Fatalf("expected reset delay of %v, got %v", time.Second, d)
+	}
+}
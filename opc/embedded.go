@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// embedded holds the listening servers of the process by endpoint, such that clients of the same endpoint are served in-process
+var embedded = struct {
+	sync.Mutex
+	servers map[string]*Server
+}{
+	servers: map[string]*Server{},
+}
+
+func register(s *Server) {
+	embedded.Lock()
+	defer embedded.Unlock()
+	embedded.servers[s.endpoint] = s
+}
+
+func unregister(s *Server) {
+	embedded.Lock()
+	defer embedded.Unlock()
+	if embedded.servers[s.endpoint] == s {
+		delete(embedded.servers, s.endpoint)
+	}
+}
+
+func lookup(endpoint string) *Server {
+	embedded.Lock()
+	defer embedded.Unlock()
+	return embedded.servers[endpoint]
+}
+
+// monitorLocal subscribes to nodes of the embedded server, forwarding queued notifications to ch at each interval
+func (s *Server) monitorLocal(interval time.Duration, nodes []*ua.NodeID, handles []uint32, ch chan *opcua.PublishNotificationData) (*Subscription, []ua.StatusCode) {
+
+	sub := newSubscription(s.id(), interval, 0)
+	s.space.subscribe(sub)
+
+	results := make([]ua.StatusCode, 0, len(nodes))
+	for i, n := range nodes {
+		_, status := s.space.monitor(sub, n, handles[i], monitorQueueSize)
+		results = append(results, status)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(sub.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			items := sub.take()
+			if len(items) == 0 {
+				continue
+			}
+
+			select {
+			case <-done:
+				return
+			case ch <- &opcua.PublishNotificationData{
+				SubscriptionID: sub.id,
+				Value:          &ua.DataChangeNotification{MonitoredItems: items},
+			}:
+			}
+		}
+	}()
+
+	once := sync.Once{}
+
+	return &Subscription{
+		ID: sub.id,
+		cancel: func() error {
+			once.Do(func() {
+				close(done)
+				s.space.unsubscribe(sub)
+			})
+			return nil
+		},
+	}, results
+}
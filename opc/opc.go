@@ -0,0 +1,548 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"context"
+	"fmt"
+	"tel/config"
+	"tel/logging"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+const (
+	defaultKeepAliveMs    = 5000
+	defaultReconnectMinMs = 1000
+	defaultReconnectMaxMs = 30000
+	monitorQueueSize      = 10
+)
+
+// Client wraps an OPC UA client, batching reads and writes within the operation limits of the server.
+// Successful writes are cached, and replayed to the server on each subsequent Connect.
+// If the endpoint is that of an embedded Server within the process, the server is accessed directly.
+type Client struct {
+	*opcua.Client
+	local     *Server
+	cfg       config.OPCClient
+	connected bool
+	maxRead   int
+	maxWrite  int
+	cache     map[string]cachedWrite
+	observe   Observer
+	log       *logging.Logger
+}
+
+// Observer is notified of each read or write request of a Client, with its duration and the status of each node, or the error of the request.
+// op is read or write, and the observer is called from the goroutine making the request.
+type Observer func(op string, duration time.Duration, results []ua.StatusCode, err error)
+
+type cachedWrite struct {
+	node  *ua.NodeID
+	value *ua.Variant
+}
+
+// ConnectionError indicates a failure of the OPC connection or session, rather than of an individual node
+type ConnectionError struct {
+	Err error
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("opc connection: %v", e.Err)
+}
+
+func (e ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+func NewClient(cfg config.OPCClient) *Client {
+
+	if cfg.KeepAliveMs == 0 {
+		cfg.KeepAliveMs = defaultKeepAliveMs
+	}
+	if cfg.ReconnectMinMs == 0 {
+		cfg.ReconnectMinMs = defaultReconnectMinMs
+	}
+	if cfg.ReconnectMaxMs == 0 {
+		cfg.ReconnectMaxMs = defaultReconnectMaxMs
+	}
+
+	return &Client{
+		cfg:   cfg,
+		cache: map[string]cachedWrite{},
+		log:   logging.Default(),
+	}
+}
+
+// SetObserver sets the observer of the requests of the client, which must be set before the client is used
+func (c *Client) SetObserver(o Observer) {
+	c.observe = o
+}
+
+// SetLogger sets the logger of the client in place of the default logger, and must not be called concurrently with the use of the client
+func (c *Client) SetLogger(l *logging.Logger) {
+	c.log = l
+}
+
+// notify notifies the observer of the client, if set, of a request started at start
+func (c *Client) notify(op string, start time.Time, results []ua.StatusCode, err error) {
+
+	if c.observe != nil {
+		c.observe(op, time.Since(start), results, err)
+	}
+}
+
+// KeepAliveInterval is the interval at which KeepAlive should be called
+func (c *Client) KeepAliveInterval() time.Duration {
+	return time.Duration(c.cfg.KeepAliveMs) * time.Millisecond
+}
+
+// Backoff returns a reconnection backoff within the configured bounds
+func (c *Client) Backoff() *Backoff {
+	return &Backoff{
+		Min: time.Duration(c.cfg.ReconnectMinMs) * time.Millisecond,
+		Max: time.Duration(c.cfg.ReconnectMaxMs) * time.Millisecond,
+	}
+}
+
+// Connect connects the client using the configured security, and loads the MaxNodesPerRead and MaxNodesPerWrite operation limits from the server
+func (c *Client) Connect(ctx context.Context) error {
+
+	if c.cfg.Endpoint == "" {
+		return fmt.Errorf("endpoint is not set")
+	}
+
+	if srv := lookup(c.cfg.Endpoint); srv != nil {
+		c.local = srv
+		c.connected = true
+		c.maxRead = 0
+		c.maxWrite = 0
+
+		err := c.replay(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to replay cached writes: %w", err)
+		}
+		return nil
+	}
+
+	opts, err := options(ctx, c.cfg, c.log)
+	if err != nil {
+		return err
+	}
+
+	// Reconnection is supervised by the caller, such that subscriptions are re-established against a fresh session
+	opts = append(opts, opcua.AutoReconnect(false))
+
+	c.Client = opcua.NewClient(c.cfg.Endpoint, opts...)
+
+	err = c.Client.Connect(ctx)
+	if err != nil {
+		return ConnectionError{Err: err}
+	}
+	c.connected = true
+
+	limits := []*ua.NodeID{
+		ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerRead),
+		ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerWrite),
+	}
+
+	// Servers are not required to expose operation limits, a missing or zero limit is taken as unbounded
+	c.maxRead = 0
+	c.maxWrite = 0
+
+	results, err := c.read(ctx, limits, ua.AttributeIDValue)
+	if err != nil {
+		return fmt.Errorf("failed to read operation limits: %w", err)
+	}
+
+	if results[0].Status == ua.StatusOK && results[0].Value != nil {
+		c.maxRead = int(results[0].Value.Uint())
+	}
+	if results[1].Status == ua.StatusOK && results[1].Value != nil {
+		c.maxWrite = int(results[1].Value.Uint())
+	}
+
+	err = c.replay(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to replay cached writes: %w", err)
+	}
+
+	return nil
+}
+
+// NodeID resolves the node ID of tag, against the NamespaceArray read from the server on Connect
+func (c *Client) NodeID(tag config.TagListTag) (*ua.NodeID, error) {
+
+	namespaces := []string{}
+	if c.local != nil {
+		namespaces = c.local.space.Namespaces()
+	} else {
+		namespaces = c.Client.Namespaces()
+	}
+
+	nid, err := tag.NodeID(namespaces)
+	if err != nil {
+		return nil, err
+	}
+	return &nid, nil
+}
+
+// Close closes the session and connection, if connected
+func (c *Client) Close() error {
+
+	if !c.connected {
+		return nil
+	}
+	c.connected = false
+
+	if c.local != nil {
+		c.local = nil
+		return nil
+	}
+	return c.Client.Close()
+}
+
+// KeepAlive reads the server state, returning a ConnectionError if the server is unreachable or not running
+func (c *Client) KeepAlive(ctx context.Context) error {
+
+	results, err := c.read(ctx, []*ua.NodeID{ua.NewNumericNodeID(0, id.Server_ServerStatus_State)}, ua.AttributeIDValue)
+	if err != nil {
+		return err
+	}
+	if results[0].Status != ua.StatusOK {
+		return ConnectionError{Err: fmt.Errorf("failed to read server state: %v", results[0].Status)}
+	}
+	if results[0].Value == nil {
+		return ConnectionError{Err: fmt.Errorf("server state returned empty")}
+	}
+
+	state := ua.ServerState(results[0].Value.Int())
+	if state != ua.ServerStateRunning {
+		return ConnectionError{Err: fmt.Errorf("server is not running: %v", state)}
+	}
+	return nil
+}
+
+// replay writes the last successfully written value of each node
+func (c *Client) replay(ctx context.Context) error {
+
+	if len(c.cache) == 0 {
+		return nil
+	}
+
+	nodes := make([]*ua.NodeID, 0, len(c.cache))
+	values := make([]*ua.Variant, 0, len(c.cache))
+	for _, v := range c.cache {
+		nodes = append(nodes, v.node)
+		values = append(values, v.value)
+	}
+
+	results, err := c.WriteValues(ctx, nodes, values)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range results {
+		if r != ua.StatusOK {
+			c.log.With("node", nodes[i]).Warnf("failed to replay write: %v", r)
+		}
+	}
+	c.log.Infof("replayed %v cached writes", len(nodes))
+	return nil
+}
+
+// ReadValues reads the value attribute of each node, split across as many requests as required by MaxNodesPerRead.
+// Results are returned in the order of nodes, the status of each result must be checked by the caller.
+func (c *Client) ReadValues(ctx context.Context, nodes []*ua.NodeID) ([]*ua.DataValue, error) {
+	return c.readAttribute(ctx, nodes, ua.AttributeIDValue)
+}
+
+// readAttribute reads attr of each node, split across as many requests as required by MaxNodesPerRead
+func (c *Client) readAttribute(ctx context.Context, nodes []*ua.NodeID, attr ua.AttributeID) ([]*ua.DataValue, error) {
+
+	results := make([]*ua.DataValue, 0, len(nodes))
+
+	for _, b := range batches(len(nodes), c.maxRead) {
+		r, err := c.read(ctx, nodes[b[0]:b[1]], attr)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+
+	return results, nil
+}
+
+// WriteValues writes the value attribute of each node, split across as many requests as required by MaxNodesPerWrite.
+// Results are returned in the order of nodes, the status of each result must be checked by the caller.
+func (c *Client) WriteValues(ctx context.Context, nodes []*ua.NodeID, values []*ua.Variant) ([]ua.StatusCode, error) {
+
+	if len(nodes) != len(values) {
+		return nil, fmt.Errorf("mismatched write, %v nodes for %v values", len(nodes), len(values))
+	}
+
+	writes := make([]*ua.WriteValue, 0, len(nodes))
+	for i, n := range nodes {
+		writes = append(writes, &ua.WriteValue{
+			NodeID:      n,
+			AttributeID: ua.AttributeIDValue,
+			Value: &ua.DataValue{
+				EncodingMask: ua.DataValueValue,
+				Value:        values[i],
+			},
+		})
+	}
+
+	results, err := c.write(ctx, writes)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range results {
+		if r == ua.StatusOK {
+			c.cache[nodes[i].String()] = cachedWrite{node: nodes[i], value: values[i]}
+		}
+	}
+
+	return results, nil
+}
+
+// WriteStatus writes status as the quality of each node without a value, such as to mark nodes as bad on loss of communication.
+// Nodes written successfully are removed from the write cache, such that their last value is not replayed on Connect.
+func (c *Client) WriteStatus(ctx context.Context, nodes []*ua.NodeID, status ua.StatusCode) ([]ua.StatusCode, error) {
+
+	writes := make([]*ua.WriteValue, 0, len(nodes))
+	for _, n := range nodes {
+		writes = append(writes, &ua.WriteValue{
+			NodeID:      n,
+			AttributeID: ua.AttributeIDValue,
+			Value: &ua.DataValue{
+				EncodingMask: ua.DataValueStatusCode,
+				Status:       status,
+			},
+		})
+	}
+
+	results, err := c.write(ctx, writes)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range results {
+		if r == ua.StatusOK {
+			delete(c.cache, nodes[i].String())
+		}
+	}
+
+	return results, nil
+}
+
+// write writes each value, split across as many requests as required by MaxNodesPerWrite
+func (c *Client) write(ctx context.Context, writes []*ua.WriteValue) ([]ua.StatusCode, error) {
+
+	results := make([]ua.StatusCode, 0, len(writes))
+
+	for _, b := range batches(len(writes), c.maxWrite) {
+
+		req := &ua.WriteRequest{
+			NodesToWrite: writes[b[0]:b[1]],
+		}
+
+		start := time.Now()
+		r, err := c.writeRequest(ctx, req)
+		c.notify("write", start, r, err)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+
+	return results, nil
+}
+
+// writeRequest writes a single request, to the embedded server if local
+func (c *Client) writeRequest(ctx context.Context, req *ua.WriteRequest) ([]ua.StatusCode, error) {
+
+	if c.local != nil {
+		err := c.embedded()
+		if err != nil {
+			return nil, err
+		}
+		results := make([]ua.StatusCode, 0, len(req.NodesToWrite))
+		for _, v := range req.NodesToWrite {
+			results = append(results, c.local.space.write(v))
+		}
+		return results, nil
+	}
+
+	resp, err := c.Client.WriteWithContext(ctx, req)
+	if err != nil {
+		return nil, ConnectionError{Err: err}
+	}
+	if len(resp.Results) != len(req.NodesToWrite) {
+		return nil, fmt.Errorf("%v results returned for %v writes", len(resp.Results), len(req.NodesToWrite))
+	}
+	return resp.Results, nil
+}
+
+func (c *Client) read(ctx context.Context, nodes []*ua.NodeID, attr ua.AttributeID) ([]*ua.DataValue, error) {
+
+	start := time.Now()
+	results, err := c.readRequest(ctx, nodes, attr)
+
+	if c.observe != nil {
+		statuses := make([]ua.StatusCode, 0, len(results))
+		for _, v := range results {
+			statuses = append(statuses, v.Status)
+		}
+		c.notify("read", start, statuses, err)
+	}
+	return results, err
+}
+
+// readRequest reads attr of each node in a single request, from the embedded server if local
+func (c *Client) readRequest(ctx context.Context, nodes []*ua.NodeID, attr ua.AttributeID) ([]*ua.DataValue, error) {
+
+	req := &ua.ReadRequest{
+		MaxAge:             0,
+		NodesToRead:        make([]*ua.ReadValueID, 0, len(nodes)),
+		TimestampsToReturn: ua.TimestampsToReturnBoth,
+	}
+	for _, n := range nodes {
+		req.NodesToRead = append(req.NodesToRead, &ua.ReadValueID{NodeID: n, AttributeID: attr})
+	}
+
+	if c.local != nil {
+		err := c.embedded()
+		if err != nil {
+			return nil, err
+		}
+		results := make([]*ua.DataValue, 0, len(nodes))
+		for _, v := range req.NodesToRead {
+			results = append(results, c.local.space.read(v))
+		}
+		return results, nil
+	}
+
+	resp, err := c.Client.ReadWithContext(ctx, req)
+	if err != nil {
+		return nil, ConnectionError{Err: err}
+	}
+	if len(resp.Results) != len(nodes) {
+		return nil, fmt.Errorf("%v results returned for %v reads", len(resp.Results), len(nodes))
+	}
+	return resp.Results, nil
+}
+
+// embedded checks the embedded server of the client is still serving
+func (c *Client) embedded() error {
+	if lookup(c.cfg.Endpoint) != c.local {
+		return ConnectionError{Err: fmt.Errorf("embedded server at %v has stopped", c.cfg.Endpoint)}
+	}
+	return nil
+}
+
+// Subscription is a subscription to the values of monitored nodes, on either a remote or the embedded server
+type Subscription struct {
+	// ID is the subscription ID of the notifications published by the subscription
+	ID     uint32
+	cancel func() error
+}
+
+// Cancel deletes the subscription, after which no further notifications are published
+func (s *Subscription) Cancel() error {
+	return s.cancel()
+}
+
+// Monitor subscribes to changes in the value of each node, published to ch at interval, and identified within notifications
+// by the handle at the same index. Results are returned in the order of nodes, the status of each result must be checked by the caller.
+func (c *Client) Monitor(ctx context.Context, interval time.Duration, nodes []*ua.NodeID, handles []uint32, ch chan *opcua.PublishNotificationData) (*Subscription, []ua.StatusCode, error) {
+
+	if len(nodes) != len(handles) {
+		return nil, nil, fmt.Errorf("mismatched monitor, %v nodes for %v handles", len(nodes), len(handles))
+	}
+
+	if c.local != nil {
+		err := c.embedded()
+		if err != nil {
+			return nil, nil, err
+		}
+		sub, results := c.local.monitorLocal(interval, nodes, handles, ch)
+		return sub, results, nil
+	}
+
+	sub, err := c.Client.SubscribeWithContext(ctx, &opcua.SubscriptionParameters{
+		Interval:                   interval,
+		LifetimeCount:              opcua.DefaultSubscriptionLifetimeCount,
+		MaxKeepAliveCount:          opcua.DefaultSubscriptionMaxKeepAliveCount,
+		MaxNotificationsPerPublish: opcua.DefaultSubscriptionMaxNotificationsPerPublish,
+		Priority:                   opcua.DefaultSubscriptionPriority,
+	}, ch)
+	if err != nil {
+		return nil, nil, ConnectionError{Err: fmt.Errorf("failed to create subscription: %w", err)}
+	}
+
+	items := make([]*ua.MonitoredItemCreateRequest, 0, len(nodes))
+	for i, n := range nodes {
+		items = append(items, &ua.MonitoredItemCreateRequest{
+			ItemToMonitor: &ua.ReadValueID{
+				NodeID:       n,
+				AttributeID:  ua.AttributeIDValue,
+				DataEncoding: &ua.QualifiedName{},
+			},
+			MonitoringMode: ua.MonitoringModeReporting,
+			RequestedParameters: &ua.MonitoringParameters{
+				ClientHandle:     handles[i],
+				DiscardOldest:    true,
+				Filter:           nil,
+				QueueSize:        monitorQueueSize,
+				SamplingInterval: 1.0,
+			},
+		})
+	}
+
+	res, err := sub.MonitorWithContext(ctx, ua.TimestampsToReturnBoth, items...)
+	if err != nil {
+		sub.Cancel(ctx)
+		return nil, nil, ConnectionError{Err: fmt.Errorf("failed to monitor: %w", err)}
+	}
+	if len(res.Results) != len(items) {
+		sub.Cancel(ctx)
+		return nil, nil, fmt.Errorf("%v results returned for %v monitored items", len(res.Results), len(items))
+	}
+
+	results := make([]ua.StatusCode, 0, len(items))
+	for _, r := range res.Results {
+		results = append(results, r.StatusCode)
+	}
+
+	return &Subscription{
+		ID: sub.SubscriptionID,
+		cancel: func() error {
+			return sub.Cancel(context.Background())
+		},
+	}, results, nil
+}
+
+// batches splits n items into [start, end) ranges of at most limit items, a limit of 0 is unbounded
+func batches(n int, limit int) [][2]int {
+
+	if limit <= 0 {
+		limit = n
+	}
+
+	b := [][2]int{}
+	for start := 0; start < n; start += limit {
+		end := start + limit
+		if end > n {
+			end = n
+		}
+		b = append(b, [2]int{start, end})
+	}
+	return b
+}
@@ -0,0 +1,32 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatches(t *testing.T) {
+
+	cases := []struct {
+		n      int
+		limit  int
+		expect [][2]int
+	}{
+		{n: 0, limit: 0, expect: [][2]int{}},
+		{n: 5, limit: 0, expect: [][2]int{{0, 5}}},
+		{n: 5, limit: 2, expect: [][2]int{{0, 2}, {2, 4}, {4, 5}}},
+		{n: 4, limit: 2, expect: [][2]int{{0, 2}, {2, 4}}},
+		{n: 3, limit: 10, expect: [][2]int{{0, 3}}},
+	}
+
+	for _, c := range cases {
+		b := batches(c.n, c.limit)
+		if !reflect.DeepEqual(b, c.expect) {
+			t.Fatalf("batches(%v, %v): expected %v, got %v", c.n, c.limit, c.expect, b)
+		}
+	}
+}
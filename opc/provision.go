@@ -0,0 +1,399 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"tel/config"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// folder is a folder of the taglist namespace hierarchy, to be provisioned beneath parent
+type folder struct {
+	id     *ua.NodeID
+	parent *ua.NodeID
+	name   string
+	depth  int
+}
+
+// Provision creates the nodes of tags missing from the server, using the NodeManagement AddNodes and AddReferences services.
+// Each missing tag is created as a variable of its DataType, with its description and default value, beneath a folder per element of its namespace under Objects.
+// Folders are created within the namespace index of the tag node, as ns=<index>;s=<path>. Existing nodes are not modified,
+// other than existing folders being organized beneath any parent folder created for them. The names of the created tags are returned.
+func (c *Client) Provision(ctx context.Context, tags []config.TagListTag) ([]string, error) {
+
+	nodes := make([]*ua.NodeID, 0, len(tags))
+	for _, t := range tags {
+		n, err := c.NodeID(t)
+		if err != nil {
+			return nil, fmt.Errorf("tag %v: %w", t.Name, err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	exists, err := c.exists(ctx, nodes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check tags: %w", err)
+	}
+
+	objects := ua.NewNumericNodeID(0, id.ObjectsFolder)
+
+	folders := []*folder{}
+	known := map[string]*folder{}
+	parents := make([]*ua.NodeID, len(tags))
+	missing := []int{}
+
+	for i, t := range tags {
+
+		if exists[i] {
+			continue
+		}
+		missing = append(missing, i)
+
+		parent := objects
+		path := ""
+		depth := 0
+		for _, name := range strings.Split(t.Namespace, "/") {
+
+			if name == "" {
+				continue
+			}
+			if path != "" {
+				path += "/"
+			}
+			path += name
+			depth++
+
+			fid := ua.NewStringNodeID(nodes[i].Namespace(), path)
+			if known[fid.String()] == nil {
+				f := &folder{id: fid, parent: parent, name: name, depth: depth}
+				folders = append(folders, f)
+				known[fid.String()] = f
+			}
+			parent = fid
+		}
+		parents[i] = parent
+	}
+
+	if len(missing) == 0 {
+		return []string{}, nil
+	}
+
+	err = c.provisionFolders(ctx, folders)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*ua.AddNodesItem, 0, len(missing))
+	for _, i := range missing {
+		item, err := variableItem(tags[i], nodes[i], parents[i])
+		if err != nil {
+			return nil, fmt.Errorf("tag %v: %w", tags[i].Name, err)
+		}
+		items = append(items, item)
+	}
+
+	results, err := c.addNodes(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+
+	created := []string{}
+	for j, r := range results {
+		name := tags[missing[j]].Name
+		switch r {
+		case ua.StatusOK:
+			created = append(created, name)
+		case ua.StatusBadNodeIDExists:
+			// created since checked, by another client
+		default:
+			return created, fmt.Errorf("failed to add tag %v: %v", name, r)
+		}
+	}
+
+	return created, nil
+}
+
+// provisionFolders adds the folders missing from the server, one depth at a time such that each parent exists before its children.
+// Existing folders beneath a created parent are organized beneath it with AddReferences.
+func (c *Client) provisionFolders(ctx context.Context, folders []*folder) error {
+
+	if len(folders) == 0 {
+		return nil
+	}
+
+	nodes := make([]*ua.NodeID, 0, len(folders))
+	depth := 0
+	for _, f := range folders {
+		nodes = append(nodes, f.id)
+		if f.depth > depth {
+			depth = f.depth
+		}
+	}
+
+	exists, err := c.exists(ctx, nodes)
+	if err != nil {
+		return fmt.Errorf("failed to check folders: %w", err)
+	}
+
+	created := map[string]bool{}
+	refs := []*ua.AddReferencesItem{}
+
+	for d := 1; d <= depth; d++ {
+
+		items := []*ua.AddNodesItem{}
+		added := []*folder{}
+
+		for i, f := range folders {
+			if f.depth != d {
+				continue
+			}
+			if exists[i] {
+				if created[f.parent.String()] {
+					refs = append(refs, &ua.AddReferencesItem{
+						SourceNodeID:    f.parent,
+						ReferenceTypeID: ua.NewNumericNodeID(0, id.Organizes),
+						IsForward:       true,
+						TargetNodeID:    ua.NewExpandedNodeID(f.id, "", 0),
+						TargetNodeClass: ua.NodeClassObject,
+					})
+				}
+				continue
+			}
+			items = append(items, folderItem(f))
+			added = append(added, f)
+		}
+
+		if len(items) == 0 {
+			continue
+		}
+
+		results, err := c.addNodes(ctx, items)
+		if err != nil {
+			return err
+		}
+		for i, r := range results {
+			if r != ua.StatusOK && r != ua.StatusBadNodeIDExists {
+				return fmt.Errorf("failed to add folder %v: %v", added[i].id, r)
+			}
+			if r == ua.StatusOK {
+				created[added[i].id.String()] = true
+			}
+		}
+	}
+
+	if len(refs) == 0 {
+		return nil
+	}
+
+	results, err := c.addReferences(ctx, refs)
+	if err != nil {
+		return err
+	}
+	for i, r := range results {
+		if r != ua.StatusOK && r != ua.StatusBadDuplicateReferenceNotAllowed {
+			return fmt.Errorf("failed to organize folder %v: %v", refs[i].TargetNodeID.NodeID, r)
+		}
+	}
+
+	return nil
+}
+
+// exists reads the node class of each node, returning false for nodes unknown to the server
+func (c *Client) exists(ctx context.Context, nodes []*ua.NodeID) ([]bool, error) {
+
+	results, err := c.readAttribute(ctx, nodes, ua.AttributeIDNodeClass)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make([]bool, 0, len(nodes))
+	for i, r := range results {
+		switch r.Status {
+		case ua.StatusOK:
+			exists = append(exists, true)
+		case ua.StatusBadNodeIDUnknown:
+			exists = append(exists, false)
+		default:
+			return nil, fmt.Errorf("failed to read %v: %v", nodes[i], r.Status)
+		}
+	}
+	return exists, nil
+}
+
+func folderItem(f *folder) *ua.AddNodesItem {
+	return &ua.AddNodesItem{
+		ParentNodeID:       ua.NewExpandedNodeID(f.parent, "", 0),
+		ReferenceTypeID:    ua.NewNumericNodeID(0, id.Organizes),
+		RequestedNewNodeID: ua.NewExpandedNodeID(f.id, "", 0),
+		BrowseName:         &ua.QualifiedName{NamespaceIndex: f.id.Namespace(), Name: f.name},
+		NodeClass:          ua.NodeClassObject,
+		NodeAttributes: ua.NewExtensionObject(&ua.ObjectAttributes{
+			SpecifiedAttributes: uint32(ua.NodeAttributesMaskDisplayName),
+			DisplayName:         ua.NewLocalizedText(f.name),
+			Description:         &ua.LocalizedText{},
+		}),
+		TypeDefinition: ua.NewExpandedNodeID(ua.NewNumericNodeID(0, id.FolderType), "", 0),
+	}
+}
+
+func variableItem(tag config.TagListTag, nid *ua.NodeID, parent *ua.NodeID) (*ua.AddNodesItem, error) {
+
+	dataType, err := DataType(tag.Type)
+	if err != nil {
+		return nil, err
+	}
+	value, err := DefaultVariant(tag.Type, tag.DefaultValue)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := ua.NodeAttributesMaskDisplayName | ua.NodeAttributesMaskDescription | ua.NodeAttributesMaskValue | ua.NodeAttributesMaskDataType |
+		ua.NodeAttributesMaskValueRank | ua.NodeAttributesMaskAccessLevel | ua.NodeAttributesMaskUserAccessLevel
+	access := uint8(ua.AccessLevelTypeCurrentRead | ua.AccessLevelTypeCurrentWrite)
+
+	return &ua.AddNodesItem{
+		ParentNodeID:       ua.NewExpandedNodeID(parent, "", 0),
+		ReferenceTypeID:    ua.NewNumericNodeID(0, id.Organizes),
+		RequestedNewNodeID: ua.NewExpandedNodeID(nid, "", 0),
+		BrowseName:         &ua.QualifiedName{NamespaceIndex: nid.Namespace(), Name: tag.Name},
+		NodeClass:          ua.NodeClassVariable,
+		NodeAttributes: ua.NewExtensionObject(&ua.VariableAttributes{
+			SpecifiedAttributes: uint32(mask),
+			DisplayName:         ua.NewLocalizedText(tag.Name),
+			Description:         ua.NewLocalizedText(tag.Description),
+			Value:               value,
+			DataType:            dataType,
+			ValueRank:           -1,
+			ArrayDimensions:     []uint32{},
+			AccessLevel:         access,
+			UserAccessLevel:     access,
+		}),
+		TypeDefinition: ua.NewExpandedNodeID(ua.NewNumericNodeID(0, id.BaseDataVariableType), "", 0),
+	}, nil
+}
+
+// addNodes sends AddNodes requests of at most MaxNodesPerNodeManagement items, returning the status of each item in order
+func (c *Client) addNodes(ctx context.Context, items []*ua.AddNodesItem) ([]ua.StatusCode, error) {
+
+	results := make([]ua.StatusCode, 0, len(items))
+
+	if c.local != nil {
+		err := c.embedded()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range items {
+			results = append(results, c.local.space.addNode(v).StatusCode)
+		}
+		return results, nil
+	}
+
+	limit, err := c.manageLimit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range batches(len(items), limit) {
+
+		req := &ua.AddNodesRequest{NodesToAdd: items[b[0]:b[1]]}
+
+		var resp *ua.AddNodesResponse
+		err := c.Client.SendWithContext(ctx, req, func(v interface{}) error {
+			r, ok := v.(*ua.AddNodesResponse)
+			if !ok {
+				return fmt.Errorf("unexpected response %T", v)
+			}
+			resp = r
+			return nil
+		})
+		if err != nil {
+			return nil, serviceError("add nodes", err)
+		}
+		if len(resp.Results) != len(req.NodesToAdd) {
+			return nil, fmt.Errorf("%v results returned for %v nodes", len(resp.Results), len(req.NodesToAdd))
+		}
+		for _, r := range resp.Results {
+			results = append(results, r.StatusCode)
+		}
+	}
+
+	return results, nil
+}
+
+// addReferences sends AddReferences requests of at most MaxNodesPerNodeManagement items, returning the status of each item in order
+func (c *Client) addReferences(ctx context.Context, items []*ua.AddReferencesItem) ([]ua.StatusCode, error) {
+
+	results := make([]ua.StatusCode, 0, len(items))
+
+	if c.local != nil {
+		err := c.embedded()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range items {
+			results = append(results, c.local.space.addReference(v))
+		}
+		return results, nil
+	}
+
+	limit, err := c.manageLimit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range batches(len(items), limit) {
+
+		req := &ua.AddReferencesRequest{ReferencesToAdd: items[b[0]:b[1]]}
+
+		var resp *ua.AddReferencesResponse
+		err := c.Client.SendWithContext(ctx, req, func(v interface{}) error {
+			r, ok := v.(*ua.AddReferencesResponse)
+			if !ok {
+				return fmt.Errorf("unexpected response %T", v)
+			}
+			resp = r
+			return nil
+		})
+		if err != nil {
+			return nil, serviceError("add references", err)
+		}
+		if len(resp.Results) != len(req.ReferencesToAdd) {
+			return nil, fmt.Errorf("%v results returned for %v references", len(resp.Results), len(req.ReferencesToAdd))
+		}
+		results = append(results, resp.Results...)
+	}
+
+	return results, nil
+}
+
+// manageLimit reads the MaxNodesPerNodeManagement operation limit of the server, a missing or zero limit is taken as unbounded
+func (c *Client) manageLimit(ctx context.Context) (int, error) {
+
+	results, err := c.read(ctx, []*ua.NodeID{ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerNodeManagement)}, ua.AttributeIDValue)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read operation limits: %w", err)
+	}
+	if results[0].Status != ua.StatusOK || results[0].Value == nil {
+		return 0, nil
+	}
+	return int(results[0].Value.Uint()), nil
+}
+
+// serviceError returns a status rejecting the service as is, such as where the server does not support NodeManagement,
+// and any other failure as a ConnectionError
+func serviceError(service string, err error) error {
+
+	var status ua.StatusCode
+	if errors.As(err, &status) {
+		return fmt.Errorf("%v failed: %w", service, status)
+	}
+	return ConnectionError{Err: fmt.Errorf("%v failed: %w", service, err)}
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"context"
+	"tel/config"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestProvision(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tags := []config.TagListTag{
+		{Name: "VALVE_OPEN", Namespace: "TAGS/VALVE", Description: "Valve Open", Type: "bool"},
+		{Name: "VALVE_FLOW", Namespace: "TAGS/VALVE", Description: "Valve Flow", Type: "uint16", DefaultValue: 7},
+		{Name: "PUMP_SPEED", Namespace: "TAGS/PUMP", Description: "Pump Speed", Type: "float32", DefaultValue: 2.5},
+		{Name: "TRIP", Type: "int32", DefaultValue: -1},
+	}
+
+	srv, _ := serve(ctx, t, "opc.tcp://127.0.0.1:0", tags[:1], true)
+
+	// provision over the network, to exercise the NodeManagement services of the server
+	c := NewClient(config.OPCClient{Endpoint: "opc.tcp://" + srv.Addr().String()})
+	err := c.Connect(ctx)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	created, err := c.Provision(ctx, tags)
+	if err != nil {
+		t.Fatalf("failed to provision: %v", err)
+	}
+	if len(created) != 3 || created[0] != "VALVE_FLOW" || created[2] != "TRIP" {
+		t.Fatalf("expected 3 tags to be created, got %v", created)
+	}
+
+	nodes := []*ua.NodeID{}
+	for _, v := range tags {
+		n, err := c.NodeID(v)
+		if err != nil {
+			t.Fatalf("failed to resolve %v: %v", v.Name, err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	values, err := c.ReadValues(ctx, nodes)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	expected := []interface{}{false, uint16(7), float32(2.5), int32(-1)}
+	for i, v := range values {
+		if v.Status != ua.StatusOK || v.Value.Value() != expected[i] {
+			t.Fatalf("%v: expected %v, got %v %v", tags[i].Name, expected[i], v.Status, v.Value)
+		}
+	}
+
+	statuses, err := c.WriteValues(ctx, nodes[2:3], []*ua.Variant{ua.MustVariant(float32(5))})
+	if err != nil || statuses[0] != ua.StatusOK {
+		t.Fatalf("failed to write provisioned tag: %v %v", err, statuses)
+	}
+
+	description := srv.space.read(&ua.ReadValueID{NodeID: nodes[2], AttributeID: ua.AttributeIDDescription})
+	if description.Value.Value().(*ua.LocalizedText).Text != "Pump Speed" {
+		t.Fatalf("expected description Pump Speed, got %v", description.Value)
+	}
+
+	for _, path := range []string{"TAGS/VALVE", "TAGS/PUMP"} {
+		browse := srv.space.browse(&ua.BrowseDescription{
+			NodeID:          ua.NewStringNodeID(1, path),
+			BrowseDirection: ua.BrowseDirectionForward,
+			ReferenceTypeID: ua.NewNumericNodeID(0, 33),
+			IncludeSubtypes: true,
+		})
+		if browse.StatusCode != ua.StatusOK || len(browse.References) == 0 {
+			t.Fatalf("expected tags within folder %v, got %v %v", path, browse.StatusCode, len(browse.References))
+		}
+	}
+
+	created, err = c.Provision(ctx, tags)
+	if err != nil {
+		t.Fatalf("failed to provision: %v", err)
+	}
+	if len(created) != 0 {
+		t.Fatalf("expected no tags to be created once provisioned, got %v", created)
+	}
+}
+
+func TestProvisionFolder(t *testing.T) {
+
+	tags := []config.TagListTag{
+		{Name: "A", Namespace: "SITE/AREA", Type: "bool"},
+	}
+
+	srv, err := NewServer(config.OPCServer{Endpoint: "opc.tcp://127.0.0.1:0"}, tags)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	// a folder of the taglist existing beneath a missing parent is organized beneath the created parent
+	delete(srv.space.nodes, ua.NewStringNodeID(1, "SITE").String())
+
+	c := &Client{local: srv, cfg: config.OPCClient{Endpoint: srv.Endpoint()}, connected: true}
+	register(srv)
+	defer unregister(srv)
+
+	created, err := c.Provision(context.Background(), append(tags, config.TagListTag{Name: "B", Namespace: "SITE/AREA", Type: "bool"}))
+	if err != nil {
+		t.Fatalf("failed to provision: %v", err)
+	}
+	if len(created) != 1 || created[0] != "B" {
+		t.Fatalf("expected B to be created, got %v", created)
+	}
+
+	browse := srv.space.browse(&ua.BrowseDescription{
+		NodeID:          ua.NewStringNodeID(1, "SITE"),
+		BrowseDirection: ua.BrowseDirectionForward,
+		ReferenceTypeID: ua.NewNumericNodeID(0, 35),
+	})
+	if browse.StatusCode != ua.StatusOK || len(browse.References) != 1 {
+		t.Fatalf("expected AREA to be organized beneath SITE, got %v %v", browse.StatusCode, browse.References)
+	}
+}
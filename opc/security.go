@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"tel/config"
+	"tel/logging"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// options resolves the client options for the configured endpoint, security policy, mode and user authentication.
+// Where security or authentication is configured, the endpoint is selected from those advertised by the server.
+func options(ctx context.Context, cfg config.OPCClient, log *logging.Logger) ([]opcua.Option, error) {
+
+	policy, mode := security(cfg)
+
+	authMode := cfg.Auth.Mode
+	if authMode == "" {
+		authMode = config.OPCAuthAnonymous
+	}
+
+	opts := []opcua.Option{}
+
+	// Retain the original behaviour of connecting without endpoint discovery where no security is configured
+	if policy == "None" && mode != ua.MessageSecurityModeSign && mode != ua.MessageSecurityModeSignAndEncrypt && authMode == config.OPCAuthAnonymous {
+		return opts, nil
+	}
+
+	endpoints, err := opcua.GetEndpoints(ctx, cfg.Endpoint)
+	if err != nil {
+		return nil, ConnectionError{Err: fmt.Errorf("failed to get endpoints: %w", err)}
+	}
+
+	ep := opcua.SelectEndpoint(endpoints, policy, mode)
+	if ep == nil {
+		return nil, fmt.Errorf("no endpoint found for policy %v and mode %v", orAny(policy), orAny(cfg.SecurityMode))
+	}
+
+	if ep.SecurityPolicyURI != ua.SecurityPolicyURINone {
+
+		if cfg.Certificate == "" || cfg.PrivateKey == "" {
+			return nil, fmt.Errorf("certificate and private_key are required for policy %v", policy)
+		}
+
+		err = verifyServer(ep.ServerCertificate, cfg.TrustedCertificates, cfg.InsecureSkipVerify, log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify server certificate: %w", err)
+		}
+
+		opts = append(opts,
+			opcua.CertificateFile(cfg.Certificate),
+			opcua.PrivateKeyFile(cfg.PrivateKey),
+		)
+	}
+
+	var tokenType ua.UserTokenType
+
+	switch authMode {
+	case config.OPCAuthAnonymous:
+		tokenType = ua.UserTokenTypeAnonymous
+		opts = append(opts, opcua.AuthAnonymous())
+	case config.OPCAuthUsername:
+		tokenType = ua.UserTokenTypeUserName
+		opts = append(opts, opcua.AuthUsername(cfg.Auth.Username, cfg.Auth.Password))
+	case config.OPCAuthCertificate:
+		// The user token signature is created with the application private key, so the user certificate must share it
+		cert, err := loadCertificate(cfg.Auth.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load user certificate: %w", err)
+		}
+		tokenType = ua.UserTokenTypeCertificate
+		opts = append(opts, opcua.AuthCertificate(cert))
+	default:
+		return nil, fmt.Errorf("auth mode %v is not supported", authMode)
+	}
+
+	opts = append(opts, opcua.SecurityFromEndpoint(ep, tokenType))
+
+	return opts, nil
+}
+
+// security returns the security policy and mode of the endpoint to select, where neither set selects no security.
+// If only one is set, the other is returned unset, such that opcua.SelectEndpoint selects the most secure endpoint matching the one set.
+func security(cfg config.OPCClient) (string, ua.MessageSecurityMode) {
+
+	mode := ua.MessageSecurityModeFromString(cfg.SecurityMode)
+	if cfg.SecurityPolicy == "" && mode == ua.MessageSecurityModeInvalid {
+		return "None", ua.MessageSecurityModeNone
+	}
+	return cfg.SecurityPolicy, mode
+}
+
+// orAny returns s, or any if s is not set
+func orAny(s string) string {
+
+	if s == "" {
+		return "any"
+	}
+	return s
+}
+
+// verifyServer checks the server certificate is either one of the trusted certificates, or is valid and chains to one of them.
+// If no trusted certificates are configured, the server certificate is only accepted, unverified, if skip is set.
+func verifyServer(server []byte, trusted []string, skip bool, log *logging.Logger) error {
+
+	if len(trusted) == 0 {
+		if !skip {
+			return fmt.Errorf("no trusted_certificates configured, set insecure_skip_verify to accept the server certificate unverified")
+		}
+		log.Warnf("no trusted_certificates configured, insecure_skip_verify is set, server certificate is not verified")
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(server)
+	if err != nil {
+		return fmt.Errorf("failed to parse server certificate: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	for _, t := range trusted {
+
+		der, err := loadCertificate(t)
+		if err != nil {
+			return fmt.Errorf("failed to load trusted certificate %v: %w", t, err)
+		}
+
+		// a trusted certificate may pin a self-signed server certificate
+		if bytes.Equal(der, server) {
+			return nil
+		}
+
+		ca, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("failed to parse trusted certificate %v: %w", t, err)
+		}
+		roots.AddCert(ca)
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return fmt.Errorf("server certificate %v is not trusted: %w", cert.Subject, err)
+	}
+	return nil
+}
+
+// loadCertificate loads a DER or PEM encoded certificate, returning it DER encoded
+func loadCertificate(path string) ([]byte, error) {
+
+	b, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return b, nil
+	}
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("unexpected pem block type %v", block.Type)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"tel/config"
+	"tel/logging"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestVerifyServer(t *testing.T) {
+
+	dir := t.TempDir()
+
+	valid := time.Now().Add(time.Hour)
+	ca, caKey := testCertificate(t, "ca", nil, nil, valid)
+	server, _ := testCertificate(t, "server", ca, caKey, valid)
+	expired, _ := testCertificate(t, "expired", ca, caKey, time.Now().Add(-time.Minute))
+	other, _ := testCertificate(t, "other", nil, nil, valid)
+
+	caPath := filepath.Join(dir, "ca.crt")
+	err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	serverPath := filepath.Join(dir, "server.der")
+	err = os.WriteFile(serverPath, server.Raw, 0600)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	err = verifyServer(server.Raw, []string{caPath}, false, logging.Default())
+	if err != nil {
+		t.Fatalf("expected server signed by trusted ca to verify: %v", err)
+	}
+
+	err = verifyServer(server.Raw, []string{serverPath}, false, logging.Default())
+	if err != nil {
+		t.Fatalf("expected trusted server to verify: %v", err)
+	}
+
+	err = verifyServer(expired.Raw, []string{caPath}, false, logging.Default())
+	if err == nil {
+		t.Fatalf("expected expired server signed by trusted ca to fail verification")
+	}
+
+	err = verifyServer(other.Raw, []string{caPath, serverPath}, true, logging.Default())
+	if err == nil {
+		t.Fatalf("expected untrusted server to fail verification")
+	}
+
+	err = verifyServer(other.Raw, nil, false, logging.Default())
+	if err == nil {
+		t.Fatalf("expected server without trusted certificates to fail verification")
+	}
+
+	err = verifyServer(other.Raw, nil, true, logging.Default())
+	if err != nil {
+		t.Fatalf("expected server without trusted certificates to be accepted with insecure_skip_verify: %v", err)
+	}
+}
+
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *rsa.PrivateKey, notAfter time.Time) (*x509.Certificate, *rsa.PrivateKey) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notAfter.Add(-2 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestSecurity(t *testing.T) {
+
+	endpoints := []*ua.EndpointDescription{
+		{SecurityPolicyURI: ua.SecurityPolicyURINone, SecurityMode: ua.MessageSecurityModeNone, SecurityLevel: 0},
+		{SecurityPolicyURI: ua.SecurityPolicyURIBasic256Sha256, SecurityMode: ua.MessageSecurityModeSign, SecurityLevel: 1},
+		{SecurityPolicyURI: ua.SecurityPolicyURIBasic256Sha256, SecurityMode: ua.MessageSecurityModeSignAndEncrypt, SecurityLevel: 2},
+	}
+
+	for _, v := range []struct {
+		policy string
+		mode   string
+		expect *ua.EndpointDescription
+	}{
+		{"", "", endpoints[0]},
+		{"Basic256Sha256", "", endpoints[2]},
+		{"", "Sign", endpoints[1]},
+		{"Basic256Sha256", "Sign", endpoints[1]},
+	} {
+		policy, mode := security(config.OPCClient{SecurityPolicy: v.policy, SecurityMode: v.mode})
+		ep := opcua.SelectEndpoint(append([]*ua.EndpointDescription{}, endpoints...), policy, mode)
+		if ep != v.expect {
+			t.Fatalf("expected policy %q and mode %q to select %+v, got %+v", v.policy, v.mode, v.expect, ep)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"tel/config"
+	"tel/logging"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uacp"
+	"github.com/gopcua/opcua/uasc"
+)
+
+const (
+	defaultServerNamespace = "urn:tel"
+	defaultTokenLifetimeMs = 3600000
+	maxRequestSize         = uacp.DefaultMaxMessageSize
+)
+
+// Server is an embedded OPC UA server, serving an address space built from the taglist to clients over the network.
+// Only security policy None with anonymous authentication is supported, so the server only listens on a loopback address,
+// and clients over the network may browse, read and subscribe, but not write or add nodes.
+// Clients within the process configured with the server endpoint access the address space directly, and may write, see Client.Connect.
+type Server struct {
+	endpoint string
+	uri      string
+	space    *space
+	start    time.Time
+	listener *net.TCPListener
+	log      *logging.Logger
+	// remoteWrite permits clients over the network to write and add nodes, and is only set by tests exercising the client over the network
+	remoteWrite bool
+
+	mu       sync.Mutex
+	nextID   uint32
+	sessions map[string]*session
+	conns    map[*uacp.Conn]struct{}
+}
+
+func NewServer(cfg config.OPCServer, tags []config.TagListTag) (*Server, error) {
+
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is not set")
+	}
+	if cfg.NamespaceURI == "" {
+		cfg.NamespaceURI = defaultServerNamespace
+	}
+
+	start := time.Now()
+
+	sp, err := newSpace(cfg.NamespaceURI, tags, start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build address space: %w", err)
+	}
+
+	return &Server{
+		endpoint: cfg.Endpoint,
+		uri:      cfg.NamespaceURI,
+		space:    sp,
+		start:    start,
+		log:      logging.Default(),
+		sessions: map[string]*session{},
+		conns:    map[*uacp.Conn]struct{}{},
+	}, nil
+}
+
+// SetLogger sets the logger of the server, which must be set before Listen, else the default logger is used
+func (s *Server) SetLogger(l *logging.Logger) {
+	s.log = l
+}
+
+// Endpoint returns the configured endpoint of the server
+func (s *Server) Endpoint() string {
+	return s.endpoint
+}
+
+// Listen binds the server endpoint, and registers the server for in-process clients.
+// An endpoint without a host, such as opc.tcp://:4840, is bound to the loopback address. As the server does not enforce security,
+// an endpoint of any other address, such as opc.tcp://0.0.0.0:4840, is refused.
+func (s *Server) Listen() error {
+
+	_, addr, err := uacp.ResolveEndpoint(s.endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to resolve endpoint: %w", err)
+	}
+	if addr.IP == nil {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	if !addr.IP.IsLoopback() {
+		return fmt.Errorf("endpoint %v is not a loopback address, the embedded server supports security policy None only, so may only listen on loopback", s.endpoint)
+	}
+
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	s.listener = l
+
+	register(s)
+	s.log.Infof("opc server listening on %v", l.Addr())
+	return nil
+}
+
+// Addr returns the bound network address of the server, after Listen
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until ctx is cancelled, after which all connections are closed and the server is unregistered
+func (s *Server) Serve(ctx context.Context) error {
+
+	if s.listener == nil {
+		err := s.Listen()
+		if err != nil {
+			return err
+		}
+	}
+	defer unregister(s)
+
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for c := range s.conns {
+			c.Close()
+		}
+		for k, v := range s.sessions {
+			v.close()
+			delete(s.sessions, k)
+		}
+	}()
+
+	for {
+		tcp, err := s.listener.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("ctx caught")
+			}
+			return fmt.Errorf("failed to accept: %w", err)
+		}
+
+		go func() {
+			err := s.serveConn(tcp)
+			if err != nil && !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				s.log.With("remote", tcp.RemoteAddr()).Infof("opc server connection closed: %v", err)
+			}
+		}()
+	}
+}
+
+// channel is a secure channel with security policy None over a single connection
+type channel struct {
+	conn  *uacp.Conn
+	id    uint32
+	token uint32
+	chunk uint32
+
+	mu  sync.Mutex
+	seq uint32
+}
+
+func (s *Server) serveConn(tcp *net.TCPConn) error {
+
+	conn, err := uacp.NewConn(tcp, uacp.DefaultServerACK)
+	if err != nil {
+		tcp.Close()
+		return err
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	ch, err := s.hello(conn)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	defer s.closeSessions(ch)
+
+	chunks := map[uint32][]byte{}
+
+	for {
+		b, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+
+		m := new(uasc.MessageChunk)
+		_, err = m.Decode(b)
+		if err != nil {
+			return fmt.Errorf("failed to decode chunk: %w", err)
+		}
+
+		switch m.MessageType {
+		case "OPN":
+			if m.SecurityPolicyURI != ua.SecurityPolicyURINone {
+				conn.SendError(ua.StatusBadSecurityPolicyRejected)
+				return fmt.Errorf("security policy %v is not supported", m.SecurityPolicyURI)
+			}
+		case "CLO":
+			return nil
+		case "MSG":
+		default:
+			conn.SendError(ua.StatusBadTCPMessageTypeInvalid)
+			return fmt.Errorf("unexpected message type %v", m.MessageType)
+		}
+
+		_, err = m.SequenceHeader.Decode(m.Data)
+		if err != nil {
+			return fmt.Errorf("failed to decode sequence header: %w", err)
+		}
+		reqID := m.SequenceHeader.RequestID
+		body := append(chunks[reqID], m.Data[8:]...)
+
+		switch m.ChunkType {
+		case uasc.ChunkTypeIntermediate:
+			if len(body) > maxRequestSize {
+				return fmt.Errorf("request %v exceeds %v bytes", reqID, maxRequestSize)
+			}
+			chunks[reqID] = body
+			continue
+		case uasc.ChunkTypeError:
+			delete(chunks, reqID)
+			continue
+		}
+		delete(chunks, reqID)
+
+		_, svc, err := ua.DecodeService(body)
+		if err != nil {
+			return fmt.Errorf("failed to decode request: %w", err)
+		}
+
+		if m.MessageType == "OPN" {
+			err = s.open(ch, reqID, svc)
+		} else {
+			err = s.handle(ch, reqID, svc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hello completes the connection handshake. The endpoint URL of the hello is not checked, as the server may be reached by any address.
+func (s *Server) hello(conn *uacp.Conn) (*channel, error) {
+
+	b, err := conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if string(b[:4]) != "HELF" {
+		conn.SendError(ua.StatusBadTCPMessageTypeInvalid)
+		return nil, fmt.Errorf("expected hello, got %q", b[:4])
+	}
+
+	hel := new(uacp.Hello)
+	_, err = hel.Decode(b[8:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode hello: %w", err)
+	}
+
+	ack := *uacp.DefaultServerACK
+	if hel.SendBufSize < ack.ReceiveBufSize {
+		ack.ReceiveBufSize = hel.SendBufSize
+	}
+	if hel.ReceiveBufSize < ack.SendBufSize {
+		ack.SendBufSize = hel.ReceiveBufSize
+	}
+
+	err = conn.Send("ACKF", &ack)
+	if err != nil {
+		return nil, err
+	}
+
+	return &channel{
+		conn:  conn,
+		chunk: ack.SendBufSize,
+	}, nil
+}
+
+// open issues or renews the security token of the channel
+func (s *Server) open(ch *channel, reqID uint32, svc interface{}) error {
+
+	req, ok := svc.(*ua.OpenSecureChannelRequest)
+	if !ok {
+		return fmt.Errorf("expected open secure channel request, got %T", svc)
+	}
+	if req.SecurityMode != ua.MessageSecurityModeNone {
+		ch.conn.SendError(ua.StatusBadSecurityModeRejected)
+		return fmt.Errorf("security mode %v is not supported", req.SecurityMode)
+	}
+
+	ch.mu.Lock()
+	if req.RequestType == ua.SecurityTokenRequestTypeIssue {
+		ch.id = s.id()
+	}
+	ch.token++
+	token := &ua.ChannelSecurityToken{
+		ChannelID: ch.id,
+		TokenID:   ch.token,
+		CreatedAt: time.Now(),
+	}
+	ch.mu.Unlock()
+
+	token.RevisedLifetime = req.RequestedLifetime
+	if token.RevisedLifetime == 0 {
+		token.RevisedLifetime = defaultTokenLifetimeMs
+	}
+
+	return ch.send("OPN", reqID, &ua.OpenSecureChannelResponse{
+		ResponseHeader: responseHeader(req, ua.StatusOK),
+		SecurityToken:  token,
+		ServerNonce:    []byte{},
+	})
+}
+
+// send encodes a response, and writes it to the connection as as many chunks as required by the buffer size of the client
+func (c *channel) send(typ string, reqID uint32, msg interface{}) error {
+
+	body := ua.NewBuffer(nil)
+	body.WriteStruct(ua.NewFourByteExpandedNodeID(0, ua.ServiceTypeID(msg)))
+	body.WriteStruct(msg)
+	if body.Error() != nil {
+		return fmt.Errorf("failed to encode %T: %w", msg, body.Error())
+	}
+	b := body.Bytes()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var security interface{} = uasc.NewSymmetricSecurityHeader(c.token)
+	if typ == "OPN" {
+		security = uasc.NewAsymmetricSecurityHeader(ua.SecurityPolicyURINone, nil, nil)
+	}
+
+	for {
+		prefix := ua.NewBuffer(nil)
+		prefix.WriteStruct(security)
+		prefix.WriteStruct(uasc.NewSequenceHeader(c.seq+1, reqID))
+		if prefix.Error() != nil {
+			return fmt.Errorf("failed to encode header: %w", prefix.Error())
+		}
+
+		max := int(c.chunk) - 12 - prefix.Len()
+		n := len(b)
+		var chunkType byte = uasc.ChunkTypeFinal
+		if n > max && typ != "OPN" {
+			n = max
+			chunkType = uasc.ChunkTypeIntermediate
+		}
+
+		h := uasc.NewHeader(typ, chunkType, c.id)
+		h.MessageSize = uint32(12 + prefix.Len() + n)
+
+		chunk := ua.NewBuffer(nil)
+		chunk.WriteStruct(h)
+		chunk.Write(prefix.Bytes())
+		chunk.Write(b[:n])
+		if chunk.Error() != nil {
+			return fmt.Errorf("failed to encode chunk: %w", chunk.Error())
+		}
+
+		_, err := c.conn.Write(chunk.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+		c.seq++
+
+		b = b[n:]
+		if chunkType == uasc.ChunkTypeFinal {
+			return nil
+		}
+	}
+}
+
+func (s *Server) id() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	return s.nextID
+}
+
+func responseHeader(req ua.Request, status ua.StatusCode) *ua.ResponseHeader {
+
+	h := &ua.ResponseHeader{
+		Timestamp:          time.Now(),
+		ServiceResult:      status,
+		ServiceDiagnostics: &ua.DiagnosticInfo{},
+		StringTable:        []string{},
+	}
+	if req != nil && req.Header() != nil {
+		h.RequestHandle = req.Header().RequestHandle
+	}
+	return h
+}
@@ -0,0 +1,355 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"tel/config"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestServer(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tags := []config.TagListTag{
+		{Name: "VALVE_OPEN", Namespace: "TAGS/VALVE", Description: "Valve Open", Type: "bool"},
+		{Name: "VALVE_FLOW", Namespace: "TAGS/VALVE", Description: "Valve Flow", Type: "uint16", DefaultValue: 7},
+		{Name: "REMOTE", Node: "nsu=urn:vendor:plc;i=1001", Namespace: "VENDOR", Type: "float64", DefaultValue: 1.5},
+	}
+
+	// the client is exercised alike in-process and over the network
+	srv, _ := serve(ctx, t, "opc.tcp://127.0.0.1:0", tags, true)
+
+	remote := "opc.tcp://" + srv.Addr().String()
+
+	for _, endpoint := range []string{srv.Endpoint(), remote} {
+
+		c := NewClient(config.OPCClient{Endpoint: endpoint})
+		err := c.Connect(ctx)
+		if err != nil {
+			t.Fatalf("%v: failed to connect: %v", endpoint, err)
+		}
+		if (c.local != nil) != (endpoint == srv.Endpoint()) {
+			t.Fatalf("%v: expected in-process connection only for the server endpoint", endpoint)
+		}
+
+		err = c.KeepAlive(ctx)
+		if err != nil {
+			t.Fatalf("%v: keepalive failed: %v", endpoint, err)
+		}
+
+		nodes := []*ua.NodeID{}
+		for _, v := range tags {
+			n, err := c.NodeID(v)
+			if err != nil {
+				t.Fatalf("%v: failed to resolve %v: %v", endpoint, v.Name, err)
+			}
+			nodes = append(nodes, n)
+		}
+		if nodes[2].Namespace() != 2 {
+			t.Fatalf("%v: expected namespace uri to resolve to 2, got %v", endpoint, nodes[2].Namespace())
+		}
+
+		values, err := c.ReadValues(ctx, nodes)
+		if err != nil {
+			t.Fatalf("%v: failed to read: %v", endpoint, err)
+		}
+		if values[1].Status != ua.StatusOK || values[1].Value.Value() != uint16(7) {
+			t.Fatalf("%v: expected default value uint16 7, got %v %v", endpoint, values[1].Status, values[1].Value.Value())
+		}
+		if values[2].Value.Value() != 1.5 {
+			t.Fatalf("%v: expected default value 1.5, got %v", endpoint, values[2].Value)
+		}
+
+		ch := make(chan *opcua.PublishNotificationData)
+		sub, results, err := c.Monitor(ctx, 10*time.Millisecond, nodes[1:2], []uint32{42}, ch)
+		if err != nil {
+			t.Fatalf("%v: failed to monitor: %v", endpoint, err)
+		}
+		if results[0] != ua.StatusOK {
+			t.Fatalf("%v: failed to monitor: %v", endpoint, results[0])
+		}
+
+		// the initial value is published on creation of the monitored item
+		expect(t, ch, 42, uint16(7))
+
+		statuses, err := c.WriteValues(ctx, nodes[1:2], []*ua.Variant{ua.MustVariant(uint16(100))})
+		if err != nil {
+			t.Fatalf("%v: failed to write: %v", endpoint, err)
+		}
+		if statuses[0] != ua.StatusOK {
+			t.Fatalf("%v: failed to write: %v", endpoint, statuses[0])
+		}
+		expect(t, ch, 42, uint16(100))
+
+		statuses, err = c.WriteValues(ctx, nodes[1:2], []*ua.Variant{ua.MustVariant(int32(7))})
+		if err != nil {
+			t.Fatalf("%v: failed to write: %v", endpoint, err)
+		}
+		if statuses[0] != ua.StatusBadTypeMismatch {
+			t.Fatalf("%v: expected type mismatch writing int32 to uint16, got %v", endpoint, statuses[0])
+		}
+
+		// restore the default for the next client
+		_, err = c.WriteValues(ctx, nodes[1:2], []*ua.Variant{ua.MustVariant(uint16(7))})
+		if err != nil {
+			t.Fatalf("%v: failed to write: %v", endpoint, err)
+		}
+
+		sub.Cancel()
+		c.Close()
+	}
+
+	folder := srv.space.read(&ua.ReadValueID{NodeID: ua.NewStringNodeID(1, "TAGS/VALVE"), AttributeID: ua.AttributeIDBrowseName})
+	if folder.Status != ua.StatusOK || folder.Value.Value().(*ua.QualifiedName).Name != "VALVE" {
+		t.Fatalf("expected folder VALVE, got %v %v", folder.Status, folder.Value)
+	}
+
+	browse := srv.space.browse(&ua.BrowseDescription{
+		NodeID:          ua.NewStringNodeID(1, "TAGS/VALVE"),
+		BrowseDirection: ua.BrowseDirectionForward,
+		ReferenceTypeID: ua.NewNumericNodeID(0, 33),
+		IncludeSubtypes: true,
+	})
+	if len(browse.References) != 2 {
+		t.Fatalf("expected 2 tags within folder, got %v", len(browse.References))
+	}
+}
+
+// TestServerRemote exercises the server with a gopcua client over the network, which may browse, read and subscribe,
+// but not write or add nodes, while writes in-process are published to its subscription
+func TestServerRemote(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tags := []config.TagListTag{
+		{Name: "VALVE_OPEN", Namespace: "TAGS/VALVE", Type: "bool"},
+		{Name: "VALVE_FLOW", Namespace: "TAGS/VALVE", Type: "uint16", DefaultValue: 7},
+	}
+
+	// an endpoint without a host is bound to loopback
+	srv, _ := serve(ctx, t, "opc.tcp://:0", tags, false)
+
+	addr := srv.Addr().(*net.TCPAddr)
+	if !addr.IP.IsLoopback() {
+		t.Fatalf("expected server to listen on loopback, got %v", addr)
+	}
+
+	c := opcua.NewClient("opc.tcp://"+addr.String(), opcua.SecurityMode(ua.MessageSecurityModeNone))
+	err := c.Connect(ctx)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	browsed, err := c.BrowseWithContext(ctx, &ua.BrowseRequest{
+		NodesToBrowse: []*ua.BrowseDescription{
+			{NodeID: ua.NewNumericNodeID(0, id.ObjectsFolder), BrowseDirection: ua.BrowseDirectionForward, ReferenceTypeID: ua.NewNumericNodeID(0, id.HierarchicalReferences), IncludeSubtypes: true, ResultMask: uint32(ua.BrowseResultMaskAll)},
+			{NodeID: ua.NewStringNodeID(1, "TAGS/VALVE"), BrowseDirection: ua.BrowseDirectionForward, ReferenceTypeID: ua.NewNumericNodeID(0, id.HierarchicalReferences), IncludeSubtypes: true, ResultMask: uint32(ua.BrowseResultMaskAll)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to browse: %v", err)
+	}
+	found := false
+	for _, v := range browsed.Results[0].References {
+		found = found || v.BrowseName.Name == "TAGS"
+	}
+	if !found || len(browsed.Results[1].References) != 2 {
+		t.Fatalf("expected folder TAGS within Objects, and 2 tags within TAGS/VALVE, got %v and %v references", len(browsed.Results[0].References), len(browsed.Results[1].References))
+	}
+
+	node := ua.NewStringNodeID(1, "VALVE_FLOW")
+	read, err := c.ReadWithContext(ctx, &ua.ReadRequest{NodesToRead: []*ua.ReadValueID{
+		{NodeID: node, AttributeID: ua.AttributeIDValue},
+		{NodeID: node, AttributeID: ua.AttributeIDUserAccessLevel},
+	}})
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if read.Results[0].Status != ua.StatusOK || read.Results[0].Value.Value() != uint16(7) {
+		t.Fatalf("expected uint16 7, got %v %v", read.Results[0].Status, read.Results[0].Value)
+	}
+	if access := ua.AccessLevelType(read.Results[1].Value.Value().(byte)); access&ua.AccessLevelTypeCurrentWrite != 0 || access&ua.AccessLevelTypeCurrentRead == 0 {
+		t.Fatalf("expected user access level to be read only, got %v", access)
+	}
+
+	ch := make(chan *opcua.PublishNotificationData)
+	sub, err := c.SubscribeWithContext(ctx, &opcua.SubscriptionParameters{Interval: 10 * time.Millisecond}, ch)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Cancel(ctx)
+
+	monitored, err := sub.MonitorWithContext(ctx, ua.TimestampsToReturnBoth, opcua.NewMonitoredItemCreateRequestWithDefaults(node, ua.AttributeIDValue, 42))
+	if err != nil || monitored.Results[0].StatusCode != ua.StatusOK {
+		t.Fatalf("failed to monitor: %v %v", err, monitored)
+	}
+	expect(t, ch, 42, uint16(7))
+
+	written, err := c.WriteWithContext(ctx, &ua.WriteRequest{NodesToWrite: []*ua.WriteValue{
+		{NodeID: node, AttributeID: ua.AttributeIDValue, Value: &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant(uint16(100))}},
+	}})
+	if err != nil || written.Results[0] != ua.StatusBadUserAccessDenied {
+		t.Fatalf("expected write over the network to be denied, got %v %v", err, written)
+	}
+
+	added := folderItem(&folder{id: ua.NewStringNodeID(1, "ADDED"), parent: ua.NewNumericNodeID(0, id.ObjectsFolder), name: "ADDED"})
+	err = c.SendWithContext(ctx, &ua.AddNodesRequest{NodesToAdd: []*ua.AddNodesItem{added}}, func(v interface{}) error {
+		r, ok := v.(*ua.AddNodesResponse)
+		if !ok || r.Results[0].StatusCode != ua.StatusBadUserAccessDenied {
+			return fmt.Errorf("expected add nodes over the network to be denied, got %v", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	local := NewClient(config.OPCClient{Endpoint: srv.Endpoint()})
+	err = local.Connect(ctx)
+	if err != nil {
+		t.Fatalf("failed to connect in-process: %v", err)
+	}
+	defer local.Close()
+
+	statuses, err := local.WriteValues(ctx, []*ua.NodeID{node}, []*ua.Variant{ua.MustVariant(uint16(100))})
+	if err != nil || statuses[0] != ua.StatusOK {
+		t.Fatalf("failed to write in-process: %v %v", err, statuses)
+	}
+	expect(t, ch, 42, uint16(100))
+}
+
+func TestServerLoopback(t *testing.T) {
+
+	srv, err := NewServer(config.OPCServer{Endpoint: "opc.tcp://0.0.0.0:0"}, []config.TagListTag{{Name: "A", Type: "bool"}})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	err = srv.Listen()
+	if err == nil {
+		srv.listener.Close()
+		t.Fatalf("expected listening on all addresses to be refused")
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+
+	ctx := context.Background()
+
+	tags := []config.TagListTag{
+		{Name: "FLOW", Type: "uint16", DefaultValue: 7},
+	}
+
+	srv, err := NewServer(config.OPCServer{Endpoint: "opc.tcp://127.0.0.1:0"}, tags)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	register(srv)
+	defer unregister(srv)
+
+	c := NewClient(config.OPCClient{Endpoint: srv.Endpoint()})
+	err = c.Connect(ctx)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	node, err := c.NodeID(tags[0])
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+
+	_, err = c.WriteValues(ctx, []*ua.NodeID{node}, []*ua.Variant{ua.MustVariant(uint16(8))})
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	results, err := c.WriteStatus(ctx, []*ua.NodeID{node}, ua.StatusBadNoCommunication)
+	if err != nil || results[0] != ua.StatusOK {
+		t.Fatalf("failed to write status: %v %v", err, results)
+	}
+	if len(c.cache) != 0 {
+		t.Fatalf("expected status write to clear the write cache, got %v", c.cache)
+	}
+
+	values, err := c.ReadValues(ctx, []*ua.NodeID{node})
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if values[0].Status != ua.StatusBadNoCommunication {
+		t.Fatalf("expected bad no communication, got %v", values[0].Status)
+	}
+}
+
+func TestServerDuplicate(t *testing.T) {
+
+	tags := []config.TagListTag{
+		{Name: "A", Type: "bool"},
+		{Name: "B", Node: "ns=1;s=A", Type: "bool"},
+	}
+
+	_, err := NewServer(config.OPCServer{Endpoint: "opc.tcp://127.0.0.1:0"}, tags)
+	if err == nil {
+		t.Fatalf("expected duplicate node to fail")
+	}
+}
+
+// serve serves an embedded server of tags on endpoint until ctx is cancelled, the returned channel is closed once it has stopped.
+// Clients over the network may write to the server if remoteWrite is set.
+func serve(ctx context.Context, t *testing.T, endpoint string, tags []config.TagListTag, remoteWrite bool) (*Server, <-chan struct{}) {
+
+	srv, err := NewServer(config.OPCServer{Endpoint: endpoint}, tags)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	srv.remoteWrite = remoteWrite
+	err = srv.Listen()
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		err := srv.Serve(ctx)
+		if ctx.Err() == nil {
+			t.Errorf("server stopped: %v", err)
+		}
+	}()
+	return srv, stopped
+}
+
+func expect(t *testing.T, ch chan *opcua.PublishNotificationData, handle uint32, value interface{}) {
+
+	t.Helper()
+
+	select {
+	case res := <-ch:
+		if res.Error != nil {
+			t.Fatalf("notification failed: %v", res.Error)
+		}
+		dcn, ok := res.Value.(*ua.DataChangeNotification)
+		if !ok {
+			t.Fatalf("unexpected notification %T", res.Value)
+		}
+		last := dcn.MonitoredItems[len(dcn.MonitoredItems)-1]
+		if last.ClientHandle != handle || last.Value.Value.Value() != value {
+			t.Fatalf("expected %v for handle %v, got %v for handle %v", value, handle, last.Value.Value.Value(), last.ClientHandle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for notification of %v", value)
+	}
+}
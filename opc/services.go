@@ -0,0 +1,608 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+const transportProfile = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+
+type session struct {
+	id        *ua.NodeID
+	token     *ua.NodeID
+	ch        *channel
+	activated bool
+
+	mu      sync.Mutex
+	subs    map[uint32]*serverSubscription
+	publish []pendingPublish
+	done    chan struct{}
+	once    sync.Once
+}
+
+type serverSubscription struct {
+	*subscription
+	stop chan struct{}
+}
+
+type pendingPublish struct {
+	ch    *channel
+	reqID uint32
+	req   *ua.PublishRequest
+}
+
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// handle dispatches a service request, writing the response to the channel.
+// Publish requests are queued against the session, and responded to by its subscriptions.
+func (s *Server) handle(ch *channel, reqID uint32, svc interface{}) error {
+
+	req, ok := svc.(ua.Request)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", svc)
+	}
+
+	var resp interface{}
+
+	switch r := req.(type) {
+	case *ua.GetEndpointsRequest:
+		resp = &ua.GetEndpointsResponse{
+			ResponseHeader: responseHeader(req, ua.StatusOK),
+			Endpoints:      s.endpoints(r.EndpointURL),
+		}
+	case *ua.FindServersRequest:
+		resp = &ua.FindServersResponse{
+			ResponseHeader: responseHeader(req, ua.StatusOK),
+			Servers:        []*ua.ApplicationDescription{s.application()},
+		}
+	case *ua.CreateSessionRequest:
+		resp = s.createSession(ch, r)
+	case *ua.ActivateSessionRequest:
+		resp = s.activateSession(ch, r)
+	default:
+
+		sess, status := s.session(req)
+		if status != ua.StatusOK {
+			resp = &ua.ServiceFault{ResponseHeader: responseHeader(req, status)}
+			break
+		}
+
+		switch r := req.(type) {
+		case *ua.CloseSessionRequest:
+			s.closeSession(sess)
+			resp = &ua.CloseSessionResponse{ResponseHeader: responseHeader(req, ua.StatusOK)}
+		case *ua.ReadRequest:
+			resp = s.read(r)
+		case *ua.WriteRequest:
+			resp = s.write(r)
+		case *ua.BrowseRequest:
+			resp = s.browse(r)
+		case *ua.AddNodesRequest:
+			resp = s.addNodes(r)
+		case *ua.AddReferencesRequest:
+			resp = s.addReferences(r)
+		case *ua.BrowseNextRequest:
+			results := []*ua.BrowseResult{}
+			for range r.ContinuationPoints {
+				results = append(results, &ua.BrowseResult{StatusCode: ua.StatusBadContinuationPointInvalid, References: []*ua.ReferenceDescription{}})
+			}
+			resp = &ua.BrowseNextResponse{ResponseHeader: responseHeader(req, ua.StatusOK), Results: results, DiagnosticInfos: []*ua.DiagnosticInfo{}}
+		case *ua.CreateSubscriptionRequest:
+			resp = s.createSubscription(sess, r)
+		case *ua.ModifySubscriptionRequest:
+			resp = s.modifySubscription(sess, r)
+		case *ua.SetPublishingModeRequest:
+			resp = s.setPublishingMode(sess, r)
+		case *ua.DeleteSubscriptionsRequest:
+			resp = s.deleteSubscriptions(sess, r)
+		case *ua.CreateMonitoredItemsRequest:
+			resp = s.createMonitoredItems(sess, r)
+		case *ua.DeleteMonitoredItemsRequest:
+			resp = s.deleteMonitoredItems(sess, r)
+		case *ua.PublishRequest:
+			resp = s.queuePublish(sess, ch, reqID, r)
+		default:
+			resp = &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadServiceUnsupported)}
+		}
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return ch.send("MSG", reqID, resp)
+}
+
+func (s *Server) application() *ua.ApplicationDescription {
+	return &ua.ApplicationDescription{
+		ApplicationURI:  s.uri,
+		ProductURI:      defaultServerNamespace,
+		ApplicationName: ua.NewLocalizedText("tel"),
+		ApplicationType: ua.ApplicationTypeServer,
+		DiscoveryURLs:   []string{s.endpoint},
+	}
+}
+
+// endpoints returns the single endpoint of the server, advertised at the URL requested by the client
+func (s *Server) endpoints(url string) []*ua.EndpointDescription {
+
+	if url == "" {
+		url = s.endpoint
+	}
+
+	return []*ua.EndpointDescription{
+		{
+			EndpointURL:       url,
+			Server:            s.application(),
+			ServerCertificate: []byte{},
+			SecurityMode:      ua.MessageSecurityModeNone,
+			SecurityPolicyURI: ua.SecurityPolicyURINone,
+			UserIdentityTokens: []*ua.UserTokenPolicy{
+				{PolicyID: "Anonymous", TokenType: ua.UserTokenTypeAnonymous},
+			},
+			TransportProfileURI: transportProfile,
+		},
+	}
+}
+
+// session returns the activated session of a request
+func (s *Server) session(req ua.Request) (*session, ua.StatusCode) {
+
+	h := req.Header()
+	if h == nil || h.AuthenticationToken == nil {
+		return nil, ua.StatusBadSessionIDInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.sessions[h.AuthenticationToken.String()]
+	if sess == nil {
+		return nil, ua.StatusBadSessionIDInvalid
+	}
+	if !sess.activated {
+		return nil, ua.StatusBadSessionNotActivated
+	}
+	return sess, ua.StatusOK
+}
+
+func (s *Server) createSession(ch *channel, req *ua.CreateSessionRequest) interface{} {
+
+	token := make([]byte, 32)
+	nonce := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err == nil {
+		_, err = rand.Read(nonce)
+	}
+	if err != nil {
+		return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadInternalError)}
+	}
+
+	sess := &session{
+		id:    ua.NewNumericNodeID(1, s.id()),
+		token: ua.NewByteStringNodeID(0, token),
+		ch:    ch,
+		subs:  map[uint32]*serverSubscription{},
+		done:  make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.sessions[sess.token.String()] = sess
+	s.mu.Unlock()
+
+	return &ua.CreateSessionResponse{
+		ResponseHeader:             responseHeader(req, ua.StatusOK),
+		SessionID:                  sess.id,
+		AuthenticationToken:        sess.token,
+		RevisedSessionTimeout:      req.RequestedSessionTimeout,
+		ServerNonce:                nonce,
+		ServerCertificate:          []byte{},
+		ServerEndpoints:            s.endpoints(req.EndpointURL),
+		ServerSoftwareCertificates: []*ua.SignedSoftwareCertificate{},
+		ServerSignature:            &ua.SignatureData{},
+		MaxRequestMessageSize:      maxRequestSize,
+	}
+}
+
+// activateSession activates a session against the channel of the request, accepting only anonymous identity tokens
+func (s *Server) activateSession(ch *channel, req *ua.ActivateSessionRequest) interface{} {
+
+	h := req.Header()
+	if h == nil || h.AuthenticationToken == nil {
+		return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadSessionIDInvalid)}
+	}
+
+	if req.UserIdentityToken != nil && req.UserIdentityToken.Value != nil {
+		_, ok := req.UserIdentityToken.Value.(*ua.AnonymousIdentityToken)
+		if !ok {
+			return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadIdentityTokenRejected)}
+		}
+	}
+
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadInternalError)}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.sessions[h.AuthenticationToken.String()]
+	if sess == nil {
+		return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadSessionIDInvalid)}
+	}
+	sess.ch = ch
+	sess.activated = true
+
+	return &ua.ActivateSessionResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		ServerNonce:     nonce,
+		Results:         []ua.StatusCode{},
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) closeSession(sess *session) {
+
+	s.mu.Lock()
+	delete(s.sessions, sess.token.String())
+	s.mu.Unlock()
+
+	sess.mu.Lock()
+	for _, sub := range sess.subs {
+		s.space.unsubscribe(sub.subscription)
+	}
+	sess.mu.Unlock()
+
+	sess.close()
+}
+
+// closeSessions closes each session last activated on a closed channel
+func (s *Server) closeSessions(ch *channel) {
+
+	s.mu.Lock()
+	closed := []*session{}
+	for _, v := range s.sessions {
+		if v.ch == ch {
+			closed = append(closed, v)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, v := range closed {
+		s.closeSession(v)
+	}
+}
+
+func (s *Server) read(req *ua.ReadRequest) interface{} {
+
+	results := make([]*ua.DataValue, 0, len(req.NodesToRead))
+	for _, v := range req.NodesToRead {
+		dv := s.space.read(v)
+
+		// clients over the network may not write, as reflected by the access level of the user
+		if v.AttributeID == ua.AttributeIDUserAccessLevel && dv.Status == ua.StatusOK && !s.remoteWrite {
+			access := dv.Value.Value().(byte) &^ byte(ua.AccessLevelTypeCurrentWrite)
+			dv = &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant(access)}
+		}
+		results = append(results, dv)
+	}
+
+	return &ua.ReadResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) write(req *ua.WriteRequest) interface{} {
+
+	results := make([]ua.StatusCode, 0, len(req.NodesToWrite))
+	for _, v := range req.NodesToWrite {
+		if !s.remoteWrite {
+			results = append(results, ua.StatusBadUserAccessDenied)
+			continue
+		}
+		results = append(results, s.space.write(v))
+	}
+
+	return &ua.WriteResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) browse(req *ua.BrowseRequest) interface{} {
+
+	results := make([]*ua.BrowseResult, 0, len(req.NodesToBrowse))
+	for _, v := range req.NodesToBrowse {
+		results = append(results, s.space.browse(v))
+	}
+
+	return &ua.BrowseResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) addNodes(req *ua.AddNodesRequest) interface{} {
+
+	results := make([]*ua.AddNodesResult, 0, len(req.NodesToAdd))
+	for _, v := range req.NodesToAdd {
+		if !s.remoteWrite {
+			results = append(results, &ua.AddNodesResult{StatusCode: ua.StatusBadUserAccessDenied, AddedNodeID: ua.NewTwoByteNodeID(0)})
+			continue
+		}
+		results = append(results, s.space.addNode(v))
+	}
+
+	return &ua.AddNodesResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) addReferences(req *ua.AddReferencesRequest) interface{} {
+
+	results := make([]ua.StatusCode, 0, len(req.ReferencesToAdd))
+	for _, v := range req.ReferencesToAdd {
+		if !s.remoteWrite {
+			results = append(results, ua.StatusBadUserAccessDenied)
+			continue
+		}
+		results = append(results, s.space.addReference(v))
+	}
+
+	return &ua.AddReferencesResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) createSubscription(sess *session, req *ua.CreateSubscriptionRequest) interface{} {
+
+	interval := time.Duration(req.RequestedPublishingInterval * float64(time.Millisecond))
+	sub := &serverSubscription{
+		subscription: newSubscription(s.id(), interval, req.RequestedMaxKeepAliveCount),
+		stop:         make(chan struct{}),
+	}
+	sub.enabled = req.PublishingEnabled
+
+	sess.mu.Lock()
+	sess.subs[sub.id] = sub
+	sess.mu.Unlock()
+
+	s.space.subscribe(sub.subscription)
+	go s.publishLoop(sess, sub)
+
+	return &ua.CreateSubscriptionResponse{
+		ResponseHeader:            responseHeader(req, ua.StatusOK),
+		SubscriptionID:            sub.id,
+		RevisedPublishingInterval: float64(sub.interval) / float64(time.Millisecond),
+		RevisedLifetimeCount:      req.RequestedLifetimeCount,
+		RevisedMaxKeepAliveCount:  sub.keepalive,
+	}
+}
+
+func (s *Server) modifySubscription(sess *session, req *ua.ModifySubscriptionRequest) interface{} {
+
+	sess.mu.Lock()
+	sub := sess.subs[req.SubscriptionID]
+	sess.mu.Unlock()
+
+	if sub == nil {
+		return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadSubscriptionIDInvalid)}
+	}
+
+	// the publishing interval is fixed on creation, only the keep alive count is revised
+	sub.mu.Lock()
+	if req.RequestedMaxKeepAliveCount != 0 {
+		sub.keepalive = req.RequestedMaxKeepAliveCount
+	}
+	keepalive := sub.keepalive
+	sub.mu.Unlock()
+
+	return &ua.ModifySubscriptionResponse{
+		ResponseHeader:            responseHeader(req, ua.StatusOK),
+		RevisedPublishingInterval: float64(sub.interval) / float64(time.Millisecond),
+		RevisedLifetimeCount:      req.RequestedLifetimeCount,
+		RevisedMaxKeepAliveCount:  keepalive,
+	}
+}
+
+func (s *Server) setPublishingMode(sess *session, req *ua.SetPublishingModeRequest) interface{} {
+
+	results := []ua.StatusCode{}
+
+	sess.mu.Lock()
+	for _, v := range req.SubscriptionIDs {
+		sub := sess.subs[v]
+		if sub == nil {
+			results = append(results, ua.StatusBadSubscriptionIDInvalid)
+			continue
+		}
+		sub.mu.Lock()
+		sub.enabled = req.PublishingEnabled
+		sub.mu.Unlock()
+		results = append(results, ua.StatusOK)
+	}
+	sess.mu.Unlock()
+
+	return &ua.SetPublishingModeResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) deleteSubscriptions(sess *session, req *ua.DeleteSubscriptionsRequest) interface{} {
+
+	results := []ua.StatusCode{}
+
+	sess.mu.Lock()
+	for _, v := range req.SubscriptionIDs {
+		sub := sess.subs[v]
+		if sub == nil {
+			results = append(results, ua.StatusBadSubscriptionIDInvalid)
+			continue
+		}
+		delete(sess.subs, v)
+		close(sub.stop)
+		s.space.unsubscribe(sub.subscription)
+		results = append(results, ua.StatusOK)
+	}
+	sess.mu.Unlock()
+
+	return &ua.DeleteSubscriptionsResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) createMonitoredItems(sess *session, req *ua.CreateMonitoredItemsRequest) interface{} {
+
+	sess.mu.Lock()
+	sub := sess.subs[req.SubscriptionID]
+	sess.mu.Unlock()
+
+	if sub == nil {
+		return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadSubscriptionIDInvalid)}
+	}
+
+	results := []*ua.MonitoredItemCreateResult{}
+
+	for _, v := range req.ItemsToCreate {
+
+		result := &ua.MonitoredItemCreateResult{
+			RevisedSamplingInterval: float64(sub.interval) / float64(time.Millisecond),
+		}
+
+		if v.ItemToMonitor == nil || v.RequestedParameters == nil || v.ItemToMonitor.AttributeID != ua.AttributeIDValue {
+			result.StatusCode = ua.StatusBadAttributeIDInvalid
+			results = append(results, result)
+			continue
+		}
+
+		queue := v.RequestedParameters.QueueSize
+		if queue == 0 {
+			queue = 1
+		}
+		result.RevisedQueueSize = queue
+		result.MonitoredItemID, result.StatusCode = s.space.monitor(sub.subscription, v.ItemToMonitor.NodeID, v.RequestedParameters.ClientHandle, queue)
+		results = append(results, result)
+	}
+
+	return &ua.CreateMonitoredItemsResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+func (s *Server) deleteMonitoredItems(sess *session, req *ua.DeleteMonitoredItemsRequest) interface{} {
+
+	sess.mu.Lock()
+	sub := sess.subs[req.SubscriptionID]
+	sess.mu.Unlock()
+
+	if sub == nil {
+		return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadSubscriptionIDInvalid)}
+	}
+
+	results := []ua.StatusCode{}
+	for _, v := range req.MonitoredItemIDs {
+		if sub.remove(v) {
+			results = append(results, ua.StatusOK)
+		} else {
+			results = append(results, ua.StatusBadMonitoredItemIDInvalid)
+		}
+	}
+
+	return &ua.DeleteMonitoredItemsResponse{
+		ResponseHeader:  responseHeader(req, ua.StatusOK),
+		Results:         results,
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+}
+
+// queuePublish queues a publish request to be responded to by the next subscription with a notification or keep alive to send.
+// Acknowledgements are accepted without retransmission, as notifications are not retained once sent.
+func (s *Server) queuePublish(sess *session, ch *channel, reqID uint32, req *ua.PublishRequest) interface{} {
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if len(sess.subs) == 0 {
+		return &ua.ServiceFault{ResponseHeader: responseHeader(req, ua.StatusBadNoSubscription)}
+	}
+
+	sess.publish = append(sess.publish, pendingPublish{ch: ch, reqID: reqID, req: req})
+	return nil
+}
+
+// publishLoop responds to the queued publish requests of a session at each publishing interval of a subscription
+func (s *Server) publishLoop(sess *session, sub *serverSubscription) {
+
+	ticker := time.NewTicker(sub.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-sub.stop:
+			return
+		case <-ticker.C:
+		}
+
+		msg := sub.next()
+		if msg == nil {
+			continue
+		}
+
+		sess.mu.Lock()
+		if len(sess.publish) == 0 {
+			sess.mu.Unlock()
+			sub.restore(msg)
+			continue
+		}
+		p := sess.publish[0]
+		sess.publish = sess.publish[1:]
+		sess.mu.Unlock()
+
+		results := []ua.StatusCode{}
+		for range p.req.SubscriptionAcknowledgements {
+			results = append(results, ua.StatusOK)
+		}
+
+		err := p.ch.send("MSG", p.reqID, &ua.PublishResponse{
+			ResponseHeader:           responseHeader(p.req, ua.StatusOK),
+			SubscriptionID:           sub.id,
+			AvailableSequenceNumbers: []uint32{},
+			MoreNotifications:        false,
+			NotificationMessage:      msg,
+			Results:                  results,
+			DiagnosticInfos:          []*ua.DiagnosticInfo{},
+		})
+		if err != nil {
+			sub.restore(msg)
+		}
+	}
+}
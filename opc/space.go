@@ -0,0 +1,585 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"tel/config"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+const namespaceUA = "http://opcfoundation.org/UA/"
+
+// space is the address space of the embedded server, holding the standard server nodes and a variable per tag
+type space struct {
+	mu         sync.RWMutex
+	namespaces []string
+	nodes      map[string]*node
+	subs       map[*subscription]struct{}
+}
+
+type node struct {
+	id          *ua.NodeID
+	class       ua.NodeClass
+	name        string
+	description string
+	typeDef     *ua.NodeID
+	dataType    *ua.NodeID
+	valueType   ua.TypeID
+	valueRank   int32
+	access      ua.AccessLevelType
+	value       *ua.DataValue
+	refs        []reference
+}
+
+type reference struct {
+	typeID  uint32
+	target  *node
+	forward bool
+}
+
+// newSpace builds the address space from the taglist, with a folder per element of each tag namespace under Objects.
+// Folders and tags without an explicit node_id are created within uri, as namespace 1.
+func newSpace(uri string, tags []config.TagListTag, start time.Time) (*space, error) {
+
+	s := &space{
+		namespaces: []string{namespaceUA, uri},
+		nodes:      map[string]*node{},
+		subs:       map[*subscription]struct{}{},
+	}
+
+	root := s.object(ua.NewNumericNodeID(0, id.RootFolder), "Root", id.FolderType)
+	objects := s.object(ua.NewNumericNodeID(0, id.ObjectsFolder), "Objects", id.FolderType)
+	server := s.object(ua.NewNumericNodeID(0, id.Server), "Server", id.ServerType)
+	s.link(root, objects, id.Organizes)
+	s.link(objects, server, id.Organizes)
+
+	namespaces := s.variable(ua.NewNumericNodeID(0, id.Server_NamespaceArray), "NamespaceArray", id.PropertyType, ua.TypeIDString)
+	namespaces.valueRank = 1
+	s.link(server, namespaces, id.HasProperty)
+
+	status := s.variable(ua.NewNumericNodeID(0, id.Server_ServerStatus), "ServerStatus", id.ServerStatusType, ua.TypeIDExtensionObject)
+	status.dataType = ua.NewNumericNodeID(0, id.ServerStatusDataType)
+	status.value = dataValue(ua.MustVariant(ua.NewExtensionObject(&ua.ServerStatusDataType{
+		StartTime:      start,
+		CurrentTime:    start,
+		State:          ua.ServerStateRunning,
+		BuildInfo:      &ua.BuildInfo{ProductName: "tel"},
+		ShutdownReason: &ua.LocalizedText{},
+	})))
+	s.link(server, status, id.HasComponent)
+
+	state := s.variable(ua.NewNumericNodeID(0, id.Server_ServerStatus_State), "State", id.BaseDataVariableType, ua.TypeIDInt32)
+	state.dataType = ua.NewNumericNodeID(0, id.ServerState)
+	state.value = dataValue(ua.MustVariant(int32(ua.ServerStateRunning)))
+	s.link(status, state, id.HasComponent)
+
+	for _, t := range tags {
+
+		if strings.HasPrefix(t.Node, "nsu=") {
+			s.namespace(strings.TrimPrefix(strings.SplitN(t.Node, ";", 2)[0], "nsu="))
+		}
+
+		nid, err := t.NodeID(s.namespaces)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve nodeID for %v: %w", t.Name, err)
+		}
+		if int(nid.Namespace()) >= len(s.namespaces) {
+			return nil, fmt.Errorf("namespace %v of %v is not served, use nsu= to add a namespace", nid.Namespace(), t.Name)
+		}
+		if s.nodes[nid.String()] != nil {
+			return nil, fmt.Errorf("duplicate node %v for %v", nid.String(), t.Name)
+		}
+
+		parent, err := s.folder(objects, t.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create folder for %v: %w", t.Name, err)
+		}
+
+		typ, ok := dataTypes[t.Type]
+		if !ok {
+			return nil, fmt.Errorf("type %v of %v is not supported", t.Type, t.Name)
+		}
+
+		value, err := DefaultVariant(t.Type, t.DefaultValue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode default value of %v: %w", t.Name, err)
+		}
+
+		v := s.variable(&nid, t.Name, id.BaseDataVariableType, typ)
+		v.description = t.Description
+		v.access = ua.AccessLevelTypeCurrentRead | ua.AccessLevelTypeCurrentWrite
+		v.value = dataValue(value)
+		s.link(parent, v, id.Organizes)
+	}
+
+	namespaces.value = dataValue(ua.MustVariant(s.namespaces))
+
+	return s, nil
+}
+
+// namespace returns the index of uri, adding it to the namespace array if not already present
+func (s *space) namespace(uri string) uint16 {
+
+	for i, v := range s.namespaces {
+		if v == uri {
+			return uint16(i)
+		}
+	}
+	s.namespaces = append(s.namespaces, uri)
+	return uint16(len(s.namespaces) - 1)
+}
+
+// folder returns the folder for a slash separated path beneath parent, creating each element as required
+func (s *space) folder(parent *node, path string) (*node, error) {
+
+	current := ""
+	for _, name := range strings.Split(path, "/") {
+
+		if name == "" {
+			continue
+		}
+		if current != "" {
+			current += "/"
+		}
+		current += name
+
+		nid := ua.NewStringNodeID(1, current)
+		existing := s.nodes[nid.String()]
+
+		if existing == nil {
+			f := s.object(nid, name, id.FolderType)
+			s.link(parent, f, id.Organizes)
+			parent = f
+			continue
+		}
+
+		if existing.class != ua.NodeClassObject {
+			return nil, fmt.Errorf("folder %v conflicts with an existing variable", current)
+		}
+		parent = existing
+	}
+	return parent, nil
+}
+
+func (s *space) object(nid *ua.NodeID, name string, typeDef uint32) *node {
+
+	n := &node{
+		id:      nid,
+		class:   ua.NodeClassObject,
+		name:    name,
+		typeDef: ua.NewNumericNodeID(0, typeDef),
+	}
+	s.nodes[nid.String()] = n
+	return n
+}
+
+func (s *space) variable(nid *ua.NodeID, name string, typeDef uint32, typ ua.TypeID) *node {
+
+	n := &node{
+		id:        nid,
+		class:     ua.NodeClassVariable,
+		name:      name,
+		typeDef:   ua.NewNumericNodeID(0, typeDef),
+		dataType:  ua.NewNumericNodeID(0, uint32(typ)),
+		valueType: typ,
+		valueRank: -1,
+		access:    ua.AccessLevelTypeCurrentRead,
+	}
+	s.nodes[nid.String()] = n
+	return n
+}
+
+// link adds a reference of typeID from parent to child, and the inverse reference from child to parent
+func (s *space) link(parent *node, child *node, typeID uint32) {
+	parent.refs = append(parent.refs, reference{typeID: typeID, target: child, forward: true})
+	child.refs = append(child.refs, reference{typeID: typeID, target: parent, forward: false})
+}
+
+func dataValue(v *ua.Variant) *ua.DataValue {
+
+	now := time.Now()
+	dv := &ua.DataValue{
+		Value:           v,
+		Status:          ua.StatusOK,
+		SourceTimestamp: now,
+		ServerTimestamp: now,
+	}
+	dv.UpdateMask()
+	return dv
+}
+
+// Namespaces returns the namespace array of the address space
+func (s *space) Namespaces() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.namespaces
+}
+
+// read reads a single attribute of a node
+func (s *space) read(rv *ua.ReadValueID) *ua.DataValue {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if rv.NodeID == nil {
+		return &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadNodeIDUnknown}
+	}
+	n := s.nodes[rv.NodeID.String()]
+	if n == nil {
+		return &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadNodeIDUnknown}
+	}
+
+	var v interface{}
+
+	switch rv.AttributeID {
+	case ua.AttributeIDNodeID:
+		v = n.id
+	case ua.AttributeIDNodeClass:
+		v = int32(n.class)
+	case ua.AttributeIDBrowseName:
+		v = &ua.QualifiedName{NamespaceIndex: n.id.Namespace(), Name: n.name}
+	case ua.AttributeIDDisplayName:
+		v = ua.NewLocalizedText(n.name)
+	case ua.AttributeIDDescription:
+		v = ua.NewLocalizedText(n.description)
+	case ua.AttributeIDWriteMask, ua.AttributeIDUserWriteMask:
+		v = uint32(0)
+	}
+
+	if v == nil && n.class == ua.NodeClassObject {
+		switch rv.AttributeID {
+		case ua.AttributeIDEventNotifier:
+			v = byte(0)
+		}
+	}
+
+	if v == nil && n.class == ua.NodeClassVariable {
+		switch rv.AttributeID {
+		case ua.AttributeIDValue:
+			dv := *n.value
+			dv.ServerTimestamp = time.Now()
+			dv.UpdateMask()
+			return &dv
+		case ua.AttributeIDDataType:
+			v = n.dataType
+		case ua.AttributeIDValueRank:
+			v = n.valueRank
+		case ua.AttributeIDAccessLevel, ua.AttributeIDUserAccessLevel:
+			v = byte(n.access)
+		case ua.AttributeIDMinimumSamplingInterval:
+			v = float64(0)
+		case ua.AttributeIDHistorizing:
+			v = false
+		}
+	}
+
+	if v == nil {
+		return &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadAttributeIDInvalid}
+	}
+
+	return dataValue(ua.MustVariant(v))
+}
+
+// write writes the value attribute of a node, notifying each subscription monitoring it
+func (s *space) write(wv *ua.WriteValue) ua.StatusCode {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wv.NodeID == nil {
+		return ua.StatusBadNodeIDUnknown
+	}
+	n := s.nodes[wv.NodeID.String()]
+	if n == nil {
+		return ua.StatusBadNodeIDUnknown
+	}
+	if wv.AttributeID != ua.AttributeIDValue {
+		return ua.StatusBadWriteNotSupported
+	}
+	if n.class != ua.NodeClassVariable || n.access&ua.AccessLevelTypeCurrentWrite == 0 {
+		return ua.StatusBadNotWritable
+	}
+	if wv.Value == nil {
+		return ua.StatusBadTypeMismatch
+	}
+
+	// a status without a value sets the quality of the node, such as bad on loss of communication
+	empty := wv.Value.Value == nil || wv.Value.Value.Type() == ua.TypeIDNull
+	if empty && wv.Value.Status == ua.StatusOK {
+		return ua.StatusBadTypeMismatch
+	}
+	if !empty && (wv.Value.Value.Type() != n.valueType || wv.Value.Value.ArrayLength() != 0) {
+		return ua.StatusBadTypeMismatch
+	}
+
+	dv := &ua.DataValue{
+		Value:           wv.Value.Value,
+		Status:          wv.Value.Status,
+		SourceTimestamp: wv.Value.SourceTimestamp,
+		ServerTimestamp: time.Now(),
+	}
+	if dv.SourceTimestamp.IsZero() {
+		dv.SourceTimestamp = dv.ServerTimestamp
+	}
+	dv.UpdateMask()
+	n.value = dv
+
+	key := wv.NodeID.String()
+	for sub := range s.subs {
+		sub.notify(key, dv)
+	}
+
+	return ua.StatusOK
+}
+
+// browse returns the references of a node matching the direction, reference type and node class of bd
+func (s *space) browse(bd *ua.BrowseDescription) *ua.BrowseResult {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := &ua.BrowseResult{
+		StatusCode: ua.StatusOK,
+		References: []*ua.ReferenceDescription{},
+	}
+
+	if bd.NodeID == nil {
+		result.StatusCode = ua.StatusBadNodeIDUnknown
+		return result
+	}
+	n := s.nodes[bd.NodeID.String()]
+	if n == nil {
+		result.StatusCode = ua.StatusBadNodeIDUnknown
+		return result
+	}
+
+	for _, r := range n.refs {
+
+		switch bd.BrowseDirection {
+		case ua.BrowseDirectionForward:
+			if !r.forward {
+				continue
+			}
+		case ua.BrowseDirectionInverse:
+			if r.forward {
+				continue
+			}
+		}
+
+		if !matchReference(bd.ReferenceTypeID, bd.IncludeSubtypes, r.typeID) {
+			continue
+		}
+		if bd.NodeClassMask != 0 && bd.NodeClassMask&uint32(r.target.class) == 0 {
+			continue
+		}
+
+		result.References = append(result.References, &ua.ReferenceDescription{
+			ReferenceTypeID: ua.NewNumericNodeID(0, r.typeID),
+			IsForward:       r.forward,
+			NodeID:          ua.NewExpandedNodeID(r.target.id, "", 0),
+			BrowseName:      &ua.QualifiedName{NamespaceIndex: r.target.id.Namespace(), Name: r.target.name},
+			DisplayName:     ua.NewLocalizedText(r.target.name),
+			NodeClass:       r.target.class,
+			TypeDefinition:  ua.NewExpandedNodeID(r.target.typeDef, "", 0),
+		})
+	}
+
+	return result
+}
+
+// referenceParents holds the supertype of each reference type used within the address space
+var referenceParents = map[uint32]uint32{
+	id.Organizes:              id.HierarchicalReferences,
+	id.HasComponent:           id.Aggregates,
+	id.HasProperty:            id.Aggregates,
+	id.Aggregates:             id.HasChild,
+	id.HasChild:               id.HierarchicalReferences,
+	id.HierarchicalReferences: id.References,
+}
+
+// matchReference checks if a reference of typeID matches the requested reference type, or is a subtype of it
+func matchReference(requested *ua.NodeID, subtypes bool, typeID uint32) bool {
+
+	if requested == nil || requested.Namespace() == 0 && requested.IntID() == 0 {
+		return true
+	}
+	if requested.Namespace() != 0 {
+		return false
+	}
+
+	want := requested.IntID()
+	for t := typeID; t != 0; t = referenceParents[t] {
+		if t == want {
+			return true
+		}
+		if !subtypes {
+			return false
+		}
+	}
+	return false
+}
+
+// subscribe registers sub to be notified of writes to the nodes it monitors
+func (s *space) subscribe(sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[sub] = struct{}{}
+}
+
+func (s *space) unsubscribe(sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, sub)
+}
+
+// monitor adds a monitored item for the value of a node to sub, queueing the current value as the initial notification
+func (s *space) monitor(sub *subscription, nid *ua.NodeID, handle uint32, queue uint32) (uint32, ua.StatusCode) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if nid == nil {
+		return 0, ua.StatusBadNodeIDUnknown
+	}
+	n := s.nodes[nid.String()]
+	if n == nil {
+		return 0, ua.StatusBadNodeIDUnknown
+	}
+	if n.class != ua.NodeClassVariable {
+		return 0, ua.StatusBadAttributeIDInvalid
+	}
+
+	return sub.add(nid.String(), handle, queue, n.value), ua.StatusOK
+}
+
+// addNode adds an object or variable node beneath an existing parent, as the NodeManagement AddNodes service
+func (s *space) addNode(item *ua.AddNodesItem) *ua.AddNodesResult {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := &ua.AddNodesResult{AddedNodeID: ua.NewTwoByteNodeID(0)}
+
+	if item.ParentNodeID == nil || item.ParentNodeID.NodeID == nil || s.nodes[item.ParentNodeID.NodeID.String()] == nil {
+		result.StatusCode = ua.StatusBadParentNodeIDInvalid
+		return result
+	}
+	parent := s.nodes[item.ParentNodeID.NodeID.String()]
+
+	if item.ReferenceTypeID == nil || item.ReferenceTypeID.Namespace() != 0 || referenceParents[item.ReferenceTypeID.IntID()] == 0 {
+		result.StatusCode = ua.StatusBadReferenceTypeIDInvalid
+		return result
+	}
+	if item.RequestedNewNodeID == nil || item.RequestedNewNodeID.NodeID == nil || int(item.RequestedNewNodeID.NodeID.Namespace()) >= len(s.namespaces) {
+		result.StatusCode = ua.StatusBadNodeIDRejected
+		return result
+	}
+	nid := item.RequestedNewNodeID.NodeID
+	if s.nodes[nid.String()] != nil {
+		result.StatusCode = ua.StatusBadNodeIDExists
+		return result
+	}
+	if item.BrowseName == nil || item.BrowseName.Name == "" {
+		result.StatusCode = ua.StatusBadBrowseNameInvalid
+		return result
+	}
+
+	var attrs interface{}
+	if item.NodeAttributes != nil {
+		attrs = item.NodeAttributes.Value
+	}
+
+	var n *node
+
+	switch item.NodeClass {
+	case ua.NodeClassObject:
+
+		typeDef := uint32(id.BaseObjectType)
+		if item.TypeDefinition != nil && item.TypeDefinition.NodeID != nil && item.TypeDefinition.NodeID.IntID() != 0 {
+			typeDef = item.TypeDefinition.NodeID.IntID()
+		}
+
+		n = s.object(nid, item.BrowseName.Name, typeDef)
+		if a, ok := attrs.(*ua.ObjectAttributes); ok && a.Description != nil {
+			n.description = a.Description.Text
+		}
+
+	case ua.NodeClassVariable:
+
+		a, ok := attrs.(*ua.VariableAttributes)
+		if !ok || a.DataType == nil || a.DataType.Namespace() != 0 {
+			result.StatusCode = ua.StatusBadNodeAttributesInvalid
+			return result
+		}
+		typ := ua.TypeID(a.DataType.IntID())
+		if typ == ua.TypeIDNull || typ > ua.TypeIDDiagnosticInfo {
+			result.StatusCode = ua.StatusBadDataTypeIDUnknown
+			return result
+		}
+		if a.Value != nil && a.Value.Type() != ua.TypeIDNull && (a.Value.Type() != typ || a.Value.ArrayLength() != 0) {
+			result.StatusCode = ua.StatusBadTypeMismatch
+			return result
+		}
+
+		n = s.variable(nid, item.BrowseName.Name, id.BaseDataVariableType, typ)
+		if a.Description != nil {
+			n.description = a.Description.Text
+		}
+		n.access = ua.AccessLevelTypeCurrentRead | ua.AccessLevelTypeCurrentWrite
+		if a.Value != nil && a.Value.Type() != ua.TypeIDNull {
+			n.value = dataValue(a.Value)
+		} else {
+			n.value = &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadWaitingForInitialData}
+		}
+
+	default:
+		result.StatusCode = ua.StatusBadNodeClassInvalid
+		return result
+	}
+
+	s.link(parent, n, item.ReferenceTypeID.IntID())
+
+	result.StatusCode = ua.StatusOK
+	result.AddedNodeID = nid
+	return result
+}
+
+// addReference adds a hierarchical reference between existing nodes, as the NodeManagement AddReferences service
+func (s *space) addReference(item *ua.AddReferencesItem) ua.StatusCode {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item.SourceNodeID == nil || s.nodes[item.SourceNodeID.String()] == nil {
+		return ua.StatusBadSourceNodeIDInvalid
+	}
+	if item.TargetServerURI != "" || item.TargetNodeID == nil || item.TargetNodeID.NodeID == nil || s.nodes[item.TargetNodeID.NodeID.String()] == nil {
+		return ua.StatusBadTargetNodeIDInvalid
+	}
+	if item.ReferenceTypeID == nil || item.ReferenceTypeID.Namespace() != 0 || referenceParents[item.ReferenceTypeID.IntID()] == 0 {
+		return ua.StatusBadReferenceTypeIDInvalid
+	}
+
+	source := s.nodes[item.SourceNodeID.String()]
+	target := s.nodes[item.TargetNodeID.NodeID.String()]
+	if !item.IsForward {
+		source, target = target, source
+	}
+
+	for _, r := range source.refs {
+		if r.forward && r.target == target && r.typeID == item.ReferenceTypeID.IntID() {
+			return ua.StatusBadDuplicateReferenceNotAllowed
+		}
+	}
+
+	s.link(source, target, item.ReferenceTypeID.IntID())
+	return ua.StatusOK
+}
@@ -0,0 +1,230 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// subscription queues value changes of the nodes monitored within the embedded server,
+// for publishing to either a session of the server or an in-process client.
+type subscription struct {
+	id        uint32
+	interval  time.Duration
+	keepalive uint32
+	enabled   bool
+
+	mu      sync.Mutex
+	nextID  uint32
+	items   map[uint32]*monitoredItem
+	nodes   map[string][]*monitoredItem
+	pending []*ua.MonitoredItemNotification
+	seq     uint32
+	idle    uint32
+}
+
+type monitoredItem struct {
+	id     uint32
+	handle uint32
+	key    string
+	queue  uint32
+	queued uint32
+}
+
+func newSubscription(id uint32, interval time.Duration, keepalive uint32) *subscription {
+
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	if keepalive == 0 {
+		keepalive = 10
+	}
+
+	return &subscription{
+		id:        id,
+		interval:  interval,
+		keepalive: keepalive,
+		enabled:   true,
+		items:     map[uint32]*monitoredItem{},
+		nodes:     map[string][]*monitoredItem{},
+	}
+}
+
+// add adds a monitored item for the node key, queueing value as its initial notification
+func (s *subscription) add(key string, handle uint32, queue uint32, value *ua.DataValue) uint32 {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if queue == 0 {
+		queue = 1
+	}
+
+	s.nextID++
+	item := &monitoredItem{
+		id:     s.nextID,
+		handle: handle,
+		key:    key,
+		queue:  queue,
+	}
+	s.items[item.id] = item
+	s.nodes[key] = append(s.nodes[key], item)
+	s.push(item, value)
+
+	return item.id
+}
+
+// remove removes a monitored item, returning false if it does not exist
+func (s *subscription) remove(id uint32) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[id]
+	if !ok {
+		return false
+	}
+	delete(s.items, id)
+
+	items := s.nodes[item.key]
+	for i, v := range items {
+		if v == item {
+			s.nodes[item.key] = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+	if len(s.nodes[item.key]) == 0 {
+		delete(s.nodes, item.key)
+	}
+	return true
+}
+
+// notify queues value for each item monitoring the node key
+func (s *subscription) notify(key string, value *ua.DataValue) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range s.nodes[key] {
+		s.push(item, value)
+	}
+}
+
+// push queues a notification for item, discarding the oldest queued notification of the item if its queue is full
+func (s *subscription) push(item *monitoredItem, value *ua.DataValue) {
+
+	if item.queued >= item.queue {
+		for i, v := range s.pending {
+			if v.ClientHandle == item.handle {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				break
+			}
+		}
+		item.queued--
+	}
+
+	s.pending = append(s.pending, &ua.MonitoredItemNotification{
+		ClientHandle: item.handle,
+		Value:        value,
+	})
+	item.queued++
+}
+
+// take returns and clears the queued notifications
+func (s *subscription) take() []*ua.MonitoredItemNotification {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.enabled || len(s.pending) == 0 {
+		return nil
+	}
+
+	pending := s.pending
+	s.pending = nil
+	for _, item := range s.items {
+		item.queued = 0
+	}
+	return pending
+}
+
+// next returns the next notification message, or nil if there is nothing to publish within this interval.
+// A keep alive message with no notifications is returned after the configured number of idle intervals.
+func (s *subscription) next() *ua.NotificationMessage {
+
+	items := s.take()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(items) == 0 {
+		s.idle++
+		if s.idle < s.keepalive {
+			return nil
+		}
+		s.idle = 0
+		return &ua.NotificationMessage{
+			SequenceNumber:   s.seq + 1,
+			PublishTime:      time.Now(),
+			NotificationData: []*ua.ExtensionObject{},
+		}
+	}
+
+	s.idle = 0
+	s.seq++
+	return &ua.NotificationMessage{
+		SequenceNumber: s.seq,
+		PublishTime:    time.Now(),
+		NotificationData: []*ua.ExtensionObject{
+			ua.NewExtensionObject(&ua.DataChangeNotification{
+				MonitoredItems:  items,
+				DiagnosticInfos: []*ua.DiagnosticInfo{},
+			}),
+		},
+	}
+}
+
+// restore returns notifications taken by next to the front of the queue, where they could not be published.
+// The queue of each item is recounted, discarding its oldest notifications beyond its queue size, and those of items since removed.
+func (s *subscription) restore(msg *ua.NotificationMessage) {
+
+	if len(msg.NotificationData) == 0 {
+		return
+	}
+	dcn, ok := msg.NotificationData[0].Value.(*ua.DataChangeNotification)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	handles := map[uint32]*monitoredItem{}
+	for _, item := range s.items {
+		handles[item.handle] = item
+		item.queued = 0
+	}
+
+	// the newest notifications of each item are retained, counted from the back of the queue
+	queue := append(append([]*ua.MonitoredItemNotification{}, dcn.MonitoredItems...), s.pending...)
+	retained := []*ua.MonitoredItemNotification{}
+	for i := len(queue) - 1; i >= 0; i-- {
+		item, ok := handles[queue[i].ClientHandle]
+		if !ok || item.queued >= item.queue {
+			continue
+		}
+		item.queued++
+		retained = append(retained, queue[i])
+	}
+
+	s.pending = make([]*ua.MonitoredItemNotification, 0, len(retained))
+	for i := len(retained) - 1; i >= 0; i-- {
+		s.pending = append(s.pending, retained[i])
+	}
+	s.seq--
+}
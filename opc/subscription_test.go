@@ -0,0 +1,46 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestSubscriptionRestore(t *testing.T) {
+
+	value := func(v int32) *ua.DataValue {
+		return &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant(v)}
+	}
+	queued := func(s *subscription) string {
+		values := []string{}
+		for _, v := range s.pending {
+			values = append(values, fmt.Sprintf("%v=%v", v.ClientHandle, v.Value.Value.Value()))
+		}
+		return fmt.Sprint(values)
+	}
+
+	s := newSubscription(1, 0, 0)
+	s.add("a", 1, 1, value(1))
+	s.add("b", 2, 2, value(1))
+
+	// the notifications of a failed publish are restored, retaining the newest within the queue size of each item
+	msg := s.next()
+	s.notify("a", value(2))
+	s.notify("b", value(2))
+	s.restore(msg)
+
+	if q := queued(s); q != "[2=1 1=2 2=2]" {
+		t.Fatalf("expected the restored queue to hold the newest of each item, got %v", q)
+	}
+
+	s.notify("a", value(3))
+	s.notify("b", value(3))
+	if q := queued(s); q != "[2=2 1=3 2=3]" {
+		t.Fatalf("expected the queue size of each item to be enforced once restored, got %v", q)
+	}
+}
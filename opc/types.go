@@ -0,0 +1,261 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// dataTypes maps each supported TagListTag.Type to its OPC built in data type
+var dataTypes = map[string]ua.TypeID{
+	"bool":    ua.TypeIDBoolean,
+	"int8":    ua.TypeIDSByte,
+	"uint8":   ua.TypeIDByte,
+	"int16":   ua.TypeIDInt16,
+	"uint16":  ua.TypeIDUint16,
+	"int32":   ua.TypeIDInt32,
+	"uint32":  ua.TypeIDUint32,
+	"int64":   ua.TypeIDInt64,
+	"uint64":  ua.TypeIDUint64,
+	"float32": ua.TypeIDFloat,
+	"float64": ua.TypeIDDouble,
+	"string":  ua.TypeIDString,
+}
+
+// RangeError indicates a value that cannot be represented by a TagListTag.Type without loss
+type RangeError struct {
+	Value interface{}
+	Type  string
+}
+
+func (e RangeError) Error() string {
+	return fmt.Sprintf("value %v (%T) is out of range for type %v", e.Value, e.Value, e.Type)
+}
+
+// DataType returns the OPC data type node of a TagListTag.Type
+func DataType(typ string) (*ua.NodeID, error) {
+
+	t, ok := dataTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("type %v is not supported", typ)
+	}
+	return ua.NewNumericNodeID(0, uint32(t)), nil
+}
+
+// Variant encodes value as a variant of the TagListTag.Type typ, see Coerce.
+// An unset type encodes the value as its own type.
+func Variant(typ string, value interface{}) (*ua.Variant, error) {
+
+	if typ == "" {
+		return ua.NewVariant(value)
+	}
+
+	v, err := Coerce(typ, value)
+	if err != nil {
+		return nil, err
+	}
+	return ua.NewVariant(v)
+}
+
+// Coerce converts a bool, integer, float or string value to the Go type of the TagListTag.Type typ.
+// Numeric values are converted between types where the value can be represented exactly, and a RangeError is returned where it cannot,
+// such as a negative value for an unsigned type, a fractional value for an integer type, or a value other than 0 or 1 for bool.
+// Any value converts to string, but a string converts to no other type.
+func Coerce(typ string, value interface{}) (interface{}, error) {
+
+	if _, ok := dataTypes[typ]; !ok {
+		return nil, fmt.Errorf("type %v is not supported", typ)
+	}
+
+	n, err := normalize(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if typ == "string" {
+		if s, ok := n.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(n), nil
+	}
+	if _, ok := n.(string); ok {
+		return nil, fmt.Errorf("string %q cannot be converted to type %v", value, typ)
+	}
+
+	var out interface{}
+
+	switch typ {
+	case "bool":
+		var u uint64
+		u, err = toUint(n, 1)
+		out = u == 1
+	case "int8":
+		var i int64
+		i, err = toInt(n, math.MinInt8)
+		out = int8(i)
+	case "int16":
+		var i int64
+		i, err = toInt(n, math.MinInt16)
+		out = int16(i)
+	case "int32":
+		var i int64
+		i, err = toInt(n, math.MinInt32)
+		out = int32(i)
+	case "int64":
+		out, err = toInt(n, math.MinInt64)
+	case "uint8":
+		var u uint64
+		u, err = toUint(n, math.MaxUint8)
+		out = uint8(u)
+	case "uint16":
+		var u uint64
+		u, err = toUint(n, math.MaxUint16)
+		out = uint16(u)
+	case "uint32":
+		var u uint64
+		u, err = toUint(n, math.MaxUint32)
+		out = uint32(u)
+	case "uint64":
+		out, err = toUint(n, math.MaxUint64)
+	case "float32":
+		f := toFloat(n)
+		if math.Abs(f) > math.MaxFloat32 && !math.IsInf(f, 0) {
+			err = errRange
+		}
+		out = float32(f)
+	default:
+		out = toFloat(n)
+	}
+
+	if err != nil {
+		return nil, RangeError{Value: value, Type: typ}
+	}
+	return out, nil
+}
+
+// DefaultVariant encodes a TagListTag.DefaultValue as a variant of the tag type, string tags default to empty
+func DefaultVariant(typ string, v float64) (*ua.Variant, error) {
+
+	if typ == "string" {
+		return ua.NewVariant("")
+	}
+	if typ == "" {
+		return nil, fmt.Errorf("type is not set")
+	}
+	return Variant(typ, v)
+}
+
+// normalize widens value to one of bool, int64, uint64, float64 or string
+func normalize(value interface{}) (interface{}, error) {
+
+	switch v := value.(type) {
+	case bool, int64, uint64, float64, string:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case float32:
+		return float64(v), nil
+	default:
+		return nil, fmt.Errorf("value %v of %T is not supported", value, value)
+	}
+}
+
+var errRange = fmt.Errorf("out of range")
+
+// toInt converts a normalized value to a signed integer of at least min, and at most -min-1
+func toInt(n interface{}, min int64) (int64, error) {
+
+	max := -(min + 1)
+
+	switch v := n.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case int64:
+		if v < min || v > max {
+			return 0, errRange
+		}
+		return v, nil
+	case uint64:
+		if v > uint64(max) {
+			return 0, errRange
+		}
+		return int64(v), nil
+	case float64:
+		// -min is exactly representable as a float, where max may not be
+		if v != math.Trunc(v) || v < float64(min) || v >= -float64(min) {
+			return 0, errRange
+		}
+		return int64(v), nil
+	}
+	return 0, errRange
+}
+
+// toUint converts a normalized value to an unsigned integer of at most max
+func toUint(n interface{}, max uint64) (uint64, error) {
+
+	switch v := n.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case int64:
+		if v < 0 || uint64(v) > max {
+			return 0, errRange
+		}
+		return uint64(v), nil
+	case uint64:
+		if v > max {
+			return 0, errRange
+		}
+		return v, nil
+	case float64:
+		// max+1 is exactly representable as a float, where max may not be
+		if v != math.Trunc(v) || v < 0 || v >= float64(max)+1 {
+			return 0, errRange
+		}
+		return uint64(v), nil
+	}
+	return 0, errRange
+}
+
+// toFloat converts a normalized numeric value to a float
+func toFloat(n interface{}) float64 {
+
+	switch v := n.(type) {
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestCoerce(t *testing.T) {
+
+	valid := []struct {
+		typ      string
+		value    interface{}
+		expected interface{}
+	}{
+		{"uint32", uint16(65535), uint32(65535)},
+		{"float64", uint16(7), float64(7)},
+		{"float64", int32(-7), float64(-7)},
+		{"uint32", int32(5), uint32(5)},
+		{"int32", uint32(math.MaxInt32), int32(math.MaxInt32)},
+		{"uint16", float64(300), uint16(300)},
+		{"bool", uint32(1), true},
+		{"bool", float64(0), false},
+		{"uint16", true, uint16(1)},
+		{"float32", float64(2.5), float32(2.5)},
+		{"int64", float64(-9007199254740992), int64(-9007199254740992)},
+		{"uint64", uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"string", int32(-3), "-3"},
+	}
+
+	for _, v := range valid {
+		out, err := Coerce(v.typ, v.value)
+		if err != nil {
+			t.Fatalf("%v %T to %v: %v", v.value, v.value, v.typ, err)
+		}
+		if out != v.expected {
+			t.Fatalf("%v %T to %v: expected %v %T, got %v %T", v.value, v.value, v.typ, v.expected, v.expected, out, out)
+		}
+	}
+
+	overflow := []struct {
+		typ   string
+		value interface{}
+	}{
+		{"uint16", uint32(65536)},
+		{"uint32", int32(-1)},
+		{"int32", uint32(math.MaxUint32)},
+		{"int8", int16(128)},
+		{"uint16", float64(1.5)},
+		{"int64", float64(math.MaxInt64)},
+		{"uint64", float64(-1)},
+		{"int32", math.NaN()},
+		{"bool", uint16(2)},
+		{"float32", float64(math.MaxFloat64)},
+	}
+
+	for _, v := range overflow {
+		_, err := Coerce(v.typ, v.value)
+		if !errors.As(err, &RangeError{}) {
+			t.Fatalf("%v %T to %v: expected range error, got %v", v.value, v.value, v.typ, err)
+		}
+	}
+
+	_, err := Coerce("uint16", "7")
+	if err == nil {
+		t.Fatalf("expected string to uint16 to fail")
+	}
+	_, err = Coerce("uint128", 7)
+	if err == nil {
+		t.Fatalf("expected unsupported type to fail")
+	}
+}
+
+func TestVariant(t *testing.T) {
+
+	v, err := Variant("uint32", uint16(7))
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if v.Type() != ua.TypeIDUint32 || v.Value() != uint32(7) {
+		t.Fatalf("expected uint32 7, got %v %v", v.Type(), v.Value())
+	}
+
+	// an unset type retains the type of the value
+	v, err = Variant("", uint16(7))
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if v.Type() != ua.TypeIDUint16 {
+		t.Fatalf("expected uint16, got %v", v.Type())
+	}
+}
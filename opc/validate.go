@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"context"
+	"fmt"
+	"tel/config"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// Validation is the result of validating a tag against its node on the server
+type Validation struct {
+	Tag      config.TagListTag
+	Node     *ua.NodeID
+	Write    bool
+	Problems []string
+}
+
+// OK returns true if no problems were found with the tag
+func (v Validation) OK() bool {
+	return len(v.Problems) == 0
+}
+
+// Validate checks the node of each tag exists on the server as a readable variable, with the data type of the tag type,
+// and writable by the session where write is set for the tag at the same index. Problems are reported per tag,
+// an error is returned only if the server could not be read.
+func (c *Client) Validate(ctx context.Context, tags []config.TagListTag, write []bool) ([]Validation, error) {
+
+	if len(tags) != len(write) {
+		return nil, fmt.Errorf("mismatched validate, %v tags for %v write flags", len(tags), len(write))
+	}
+
+	validations := make([]Validation, 0, len(tags))
+	resolved := []int{}
+	nodes := []*ua.NodeID{}
+
+	for i, t := range tags {
+
+		v := Validation{Tag: t, Write: write[i]}
+
+		n, err := c.NodeID(t)
+		if err != nil {
+			v.Problems = append(v.Problems, err.Error())
+		} else {
+			v.Node = n
+			resolved = append(resolved, i)
+			nodes = append(nodes, n)
+		}
+		validations = append(validations, v)
+	}
+
+	classes, err := c.readAttribute(ctx, nodes, ua.AttributeIDNodeClass)
+	if err != nil {
+		return nil, err
+	}
+	dataTypes, err := c.readAttribute(ctx, nodes, ua.AttributeIDDataType)
+	if err != nil {
+		return nil, err
+	}
+	access, err := c.readAttribute(ctx, nodes, ua.AttributeIDUserAccessLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range resolved {
+		validations[i].Problems = check(tags[i], write[i], classes[j], dataTypes[j], access[j])
+	}
+
+	return validations, nil
+}
+
+// check returns the problems with a tag, from the node class, data type and user access level attributes of its node
+func check(tag config.TagListTag, write bool, class *ua.DataValue, dataType *ua.DataValue, access *ua.DataValue) []string {
+
+	switch class.Status {
+	case ua.StatusOK:
+	case ua.StatusBadNodeIDUnknown:
+		return []string{"node does not exist"}
+	default:
+		return []string{fmt.Sprintf("failed to read node class: %v", class.Status)}
+	}
+
+	if c := ua.NodeClass(class.Value.Int()); c != ua.NodeClassVariable {
+		return []string{fmt.Sprintf("node is of class %v, expected a variable", c)}
+	}
+
+	problems := []string{}
+
+	expected, err := DataType(tag.Type)
+	switch {
+	case tag.Type == "":
+		problems = append(problems, "type is not set")
+	case err != nil:
+		problems = append(problems, err.Error())
+	case dataType.Status != ua.StatusOK:
+		problems = append(problems, fmt.Sprintf("failed to read data type: %v", dataType.Status))
+	default:
+		actual, ok := dataType.Value.Value().(*ua.NodeID)
+		if !ok || actual.Namespace() != 0 || actual.IntID() != expected.IntID() {
+			problems = append(problems, fmt.Sprintf("data type %v is not compatible with type %v, expected %v", dataTypeName(actual), tag.Type, dataTypeName(expected)))
+		}
+	}
+
+	if access.Status != ua.StatusOK {
+		problems = append(problems, fmt.Sprintf("failed to read access level: %v", access.Status))
+		return problems
+	}
+
+	level := ua.AccessLevelType(access.Value.Uint())
+	if level&ua.AccessLevelTypeCurrentRead == 0 {
+		problems = append(problems, "node is not readable")
+	}
+	if write && level&ua.AccessLevelTypeCurrentWrite == 0 {
+		problems = append(problems, "node is not writable")
+	}
+
+	return problems
+}
+
+// dataTypeName returns the name of a built in data type, or the node ID of any other data type
+func dataTypeName(n *ua.NodeID) string {
+
+	if n == nil {
+		return "<none>"
+	}
+	if n.Namespace() == 0 && n.IntID() > 0 && n.IntID() <= uint32(ua.TypeIDDiagnosticInfo) {
+		return ua.TypeID(n.IntID()).String()
+	}
+	return n.String()
+}
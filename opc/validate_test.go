@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package opc
+
+import (
+	"context"
+	"strings"
+	"tel/config"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := []config.TagListTag{
+		{Name: "VALVE_OPEN", Namespace: "TAGS/VALVE", Type: "bool"},
+		{Name: "VALVE_FLOW", Namespace: "TAGS/VALVE", Type: "uint16"},
+	}
+
+	srv, _ := serve(ctx, t, "opc.tcp://127.0.0.1:0", served, true)
+
+	c := NewClient(config.OPCClient{Endpoint: "opc.tcp://" + srv.Addr().String()})
+	err := c.Connect(ctx)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	tags := []config.TagListTag{
+		{Name: "VALVE_OPEN", Type: "bool"},
+		{Name: "VALVE_FLOW", Type: "float64"},
+		{Name: "MISSING", Type: "bool"},
+		{Name: "FOLDER", Node: "ns=1;s=TAGS/VALVE", Type: "bool"},
+		{Name: "STATE", Node: "i=2259", Type: "int32"},
+		{Name: "UNTYPED", Node: "ns=1;s=VALVE_OPEN"},
+	}
+	write := []bool{true, false, false, false, true, false}
+	expected := []string{"", "not compatible", "does not exist", "expected a variable", "not writable", "type is not set"}
+
+	results, err := c.Validate(ctx, tags, write)
+	if err != nil {
+		t.Fatalf("failed to validate: %v", err)
+	}
+
+	for i, v := range results {
+		if expected[i] == "" {
+			if !v.OK() {
+				t.Fatalf("%v: expected no problems, got %v", v.Tag.Name, v.Problems)
+			}
+			continue
+		}
+		if v.OK() || !strings.Contains(strings.Join(v.Problems, "; "), expected[i]) {
+			t.Fatalf("%v: expected problem %q, got %v", v.Tag.Name, expected[i], v.Problems)
+		}
+	}
+}
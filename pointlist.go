@@ -0,0 +1,77 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"tel/config"
+)
+
+// pointListFlags parses the taglist and driver configuration files of a point list, returning the remaining arguments
+func pointListFlags(command string, args []string) (config.PointList, []string, error) {
+
+	files := config.PointList{}
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.StringVar(&files.TagList, "taglist", "", "taglist configuration file")
+	fs.StringVar(&files.Modbus, "modbus", "", "modbus configuration file, if mapped")
+	fs.StringVar(&files.MQTT, "mqtt", "", "mqtt configuration file, if mapped")
+	fs.StringVar(&files.Goose, "goose", "", "goose configuration file, if mapped")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return files, nil, err
+	}
+	if files.TagList == "" {
+		return files, nil, fmt.Errorf("usage: tel %v -taglist <file> [-modbus <file>] [-mqtt <file>] [-goose <file>] [<csv>]", command)
+	}
+	return files, fs.Args(), nil
+}
+
+// exportCSV writes the point list of the taglist and driver configurations as CSV to the file given, or to w
+func exportCSV(w io.Writer, args []string) error {
+
+	files, args, err := pointListFlags("export", args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		f, err := os.Create(filepath.Clean(args[0]))
+		if err != nil {
+			return fmt.Errorf("failed to create %v: %w", args[0], err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return config.ExportCSV(w, files)
+}
+
+// importCSV reads a point list as CSV from the file given, or from r, replacing the tags of the taglist and driver configurations
+func importCSV(r io.Reader, args []string) error {
+
+	files, args, err := pointListFlags("import", args)
+	if err != nil {
+		return err
+	}
+
+	name := "stdin"
+	if len(args) == 1 {
+		f, err := os.Open(filepath.Clean(args[0]))
+		if err != nil {
+			return fmt.Errorf("failed to open %v: %w", args[0], err)
+		}
+		defer f.Close()
+		r = f
+		name = args[0]
+	}
+
+	return config.ImportCSV(r, name, files)
+}
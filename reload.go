@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"tel/drivers"
+	"tel/logging"
+	"tel/supervisor"
+)
+
+// reloads reloads the configuration on each signal of hup until ctx is cancelled, applying the changes to the instances of sup.
+// A configuration that fails to load or validate is rejected, and the current configuration is retained.
+func reloads(ctx context.Context, hup chan os.Signal, s setup, sup *supervisor.Supervisor) {
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		logging.Default().Infof("reloading configuration")
+
+		next, err := reload(ctx, s, sup)
+		if err != nil {
+			logging.Default().Errorf("failed to reload configuration, the current configuration is retained: %v", err)
+			continue
+		}
+		s = next
+	}
+}
+
+// reload loads the configuration from the environment, and applies it to the instances of sup.
+// An instance with a changed configuration or tags is reloaded live if its driver supports the change, else it is restarted with the new configuration.
+// Instances are added and removed as configured, while an unchanged instance continues to run undisturbed.
+// The OPC, log and HTTP configuration, and the restart and shutdown policies, are applied once tel is restarted.
+func reload(ctx context.Context, s setup, sup *supervisor.Supervisor) (setup, error) {
+
+	c, err := configure()
+	if err != nil {
+		return s, err
+	}
+
+	if !reflect.DeepEqual(c.opc.Opc, s.loaded.opc.Opc) || !reflect.DeepEqual(c.opc.Server, s.loaded.opc.Server) {
+		logging.Default().Warnf("opc configuration has changed, and will be applied once tel is restarted")
+	}
+	if !reflect.DeepEqual(c.runtime.Restart, s.loaded.runtime.Restart) || c.runtime.ShutdownMs != s.loaded.runtime.ShutdownMs {
+		logging.Default().Warnf("restart and shutdown policies have changed, and will be applied once tel is restarted")
+	}
+	if c.log != s.loaded.log {
+		logging.Default().Warnf("log configuration has changed, and will be applied once tel is restarted")
+	}
+	if c.http != s.loaded.http {
+		logging.Default().Warnf("http configuration has changed, and will be applied once tel is restarted")
+	}
+
+	// every instance is created before any is applied, such that an invalid configuration is rejected as a whole
+	created := []drivers.Driver{}
+	digests := map[string]string{}
+	for _, v := range c.runtime.Drivers {
+		d, digest, err := create(v, c.tags, s.opc)
+		if err != nil {
+			return s, err
+		}
+		created = append(created, d)
+		digests[v.Name] = digest
+	}
+
+	// tags added to the taglist are created before the drivers use them
+	if (s.opc.Provision || s.loaded.opc.Server.Endpoint != "") && !reflect.DeepEqual(c.tags, s.tags) {
+		err := provision(ctx, s.opc, c.tags)
+		if err != nil {
+			return s, fmt.Errorf("failed to provision opc: %w", err)
+		}
+	}
+
+	running := map[string]drivers.Driver{}
+	for _, d := range s.instances {
+		running[d.Name()] = d
+	}
+
+	next := s
+	next.instances = []drivers.Driver{}
+	next.tags = c.tags
+	next.digests = digests
+
+	for _, d := range created {
+
+		name := d.Name()
+		log := logging.Default().With("driver", name)
+		current, ok := running[name]
+		delete(running, name)
+
+		switch {
+		case !ok:
+			log.Infof("adding instance")
+		case digests[name] == s.digests[name]:
+			next.instances = append(next.instances, current)
+			continue
+		default:
+			err := apply(current, d)
+			if err == nil {
+				log.Infof("configuration applied live")
+				next.instances = append(next.instances, current)
+				continue
+			}
+			log.Infof("restarting to apply configuration: %v", err)
+		}
+
+		// an instance that fails to be replaced retains its current configuration, such that the next reload retries it
+		err := sup.Replace(d)
+		if err != nil {
+			log.Errorf("failed to start: %v", err)
+			if ok {
+				next.instances = append(next.instances, current)
+				next.digests[name] = s.digests[name]
+			} else {
+				delete(next.digests, name)
+			}
+			continue
+		}
+		next.instances = append(next.instances, d)
+	}
+
+	for name := range running {
+		log := logging.Default().With("driver", name)
+		log.Infof("removing instance")
+		err := sup.Remove(name)
+		if err != nil {
+			log.Errorf("failed to remove: %v", err)
+		}
+	}
+
+	return next, nil
+}
+
+// apply applies the configuration of next to the running driver current, returning an error if it cannot be applied live
+func apply(current drivers.Driver, next drivers.Driver) error {
+
+	r, ok := current.(drivers.Reloader)
+	if !ok {
+		return drivers.ErrRestart
+	}
+	return r.Reload(next)
+}
@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"tel/config"
+	"tel/drivers"
+	"tel/supervisor"
+	"testing"
+	"time"
+)
+
+// stuck is a driver which runs until released, ignoring the cancellation of its context, such that it cannot be replaced in time
+type stuck struct {
+	name     string
+	started  chan struct{}
+	released chan struct{}
+}
+
+func (s *stuck) Run(ctx context.Context) error {
+	s.started <- struct{}{}
+	<-s.released
+	return fmt.Errorf("released")
+}
+
+func (s *stuck) Name() string {
+	return s.name
+}
+
+func (s *stuck) Tags() []drivers.TagUsage {
+	return nil
+}
+
+func (s *stuck) Status() drivers.Status {
+	return drivers.Status{}
+}
+
+func (s *stuck) Stats() drivers.Stats {
+	return drivers.Stats{}
+}
+
+func (s *stuck) Validate() error {
+	return nil
+}
+
+// started and released are those of the stuck instances created, set by each test
+var started, released chan struct{}
+
+func init() {
+	drivers.Register(drivers.Registration{
+		Name:   "stuck",
+		Config: func() interface{} { return "" },
+		Load: func(path string) (interface{}, error) {
+			b, err := os.ReadFile(filepath.Clean(path))
+			return string(b), err
+		},
+		New: func(name string, tags []config.TagListTag, cfg interface{}, opcConfig config.OPCClient) (drivers.Driver, error) {
+			return &stuck{name: name, started: started, released: released}, nil
+		},
+	})
+}
+
+func TestReloadFailed(t *testing.T) {
+
+	started, released = make(chan struct{}, 2), make(chan struct{})
+
+	dir := t.TempDir()
+	runtime := filepath.Join(dir, "tel.yml")
+	driver := filepath.Join(dir, "stuck.yml")
+
+	err := os.WriteFile(runtime, []byte("tags:\n  - name: A\n    type: bool\ndrivers:\n  - name: stuck_1\n    driver: stuck\n    config: stuck.yml\nshutdown_ms: 50\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	err = os.WriteFile(driver, []byte("a"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	t.Setenv("CONFIG_RUNTIME", runtime)
+	t.Setenv("OPC", "opc.tcp://127.0.0.1:1")
+
+	s, err := load()
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	defer s.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sup := supervisor.New(s.instances, s.runtime)
+	go func() {
+		_ = sup.Run(ctx)
+	}()
+	<-started
+
+	// the instance does not stop within the shutdown time, so is retained with its current configuration
+	err = os.WriteFile(driver, []byte("b"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	next, err := reload(ctx, s, sup)
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if len(next.instances) != 1 || next.instances[0] != s.instances[0] || next.digests["stuck_1"] != s.digests["stuck_1"] {
+		t.Fatalf("expected the current instance and configuration to be retained, got %v %v", next.instances, next.digests)
+	}
+
+	// once the instance stops, the next reload of the unchanged file retries the replacement
+	close(released)
+	retried, err := reload(ctx, next, sup)
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if len(retried.instances) != 1 || retried.instances[0] == s.instances[0] || retried.digests["stuck_1"] == s.digests["stuck_1"] {
+		t.Fatalf("expected the instance to be replaced, got %v %v", retried.instances, retried.digests)
+	}
+}
@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"tel/config"
+)
+
+// schema writes the JSON Schema of each named configuration file to w, or of every configuration file to dir if set as -o <dir>
+func schema(w io.Writer, args []string) error {
+
+	if len(args) == 2 && args[0] == "-o" {
+
+		for _, name := range config.SchemaNames() {
+			b, err := config.Schema(name)
+			if err != nil {
+				return err
+			}
+			err = os.WriteFile(filepath.Join(args[1], name+".json"), b, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to write schema: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: tel schema <name>... | tel schema -o <dir>, where name is one of %v", config.SchemaNames())
+	}
+
+	for _, name := range args {
+		b, err := config.Schema(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
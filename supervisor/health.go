@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package supervisor
+
+import (
+	"fmt"
+	"tel/drivers"
+	"time"
+)
+
+// DefaultHealthFactor is the number of intervals of a driver without a cycle, or disconnected from OPC, after which its instance is unhealthy, if unset
+const DefaultHealthFactor = 10
+
+// Ready returns an error if the instance is not ready, unless it is running or starting, connected to OPC and to its device,
+// and has completed at least one cycle
+func (s Status) Ready() error {
+
+	switch {
+	case s.State != StateRunning && s.State != StateStarting:
+		return fmt.Errorf("instance is %v", s.State)
+	case s.Driver.OPC != drivers.Connected:
+		return fmt.Errorf("opc is %v", s.Driver.OPC)
+	case s.Driver.Device != drivers.Connected:
+		return fmt.Errorf("device is %v", s.Driver.Device)
+	case s.Driver.LastCycle.IsZero():
+		return fmt.Errorf("no cycle has completed")
+	default:
+		return nil
+	}
+}
+
+// Healthy returns an error if the instance has failed and will not be restarted, or if it is running or starting and either:
+// connected to OPC without a completed cycle within factor times the interval of the driver, or disconnected from OPC for longer than
+// factor times the longer of the interval and the OPC keepalive interval. A driver of which cycles follow changes is instead judged
+// connected without an OPC keepalive within factor times the keepalive interval. Each is judged from when the instance was started,
+// or the connection to OPC last changed, if later. An instance that is degraded is restarted by the supervisor and is not judged.
+func (s Status) Healthy(now time.Time, factor int) error {
+
+	if s.State == StateFailed {
+		return fmt.Errorf("instance has failed: %v", s.Err)
+	}
+	if s.State != StateRunning && s.State != StateStarting {
+		return nil
+	}
+
+	since := s.Since
+	if s.Driver.OPCSince.After(since) {
+		since = s.Driver.OPCSince
+	}
+
+	if s.Driver.OPC != drivers.Connected {
+		interval := s.Driver.Interval
+		if s.Driver.KeepAlive > interval {
+			interval = s.Driver.KeepAlive
+		}
+		limit := time.Duration(factor) * interval
+		if limit > 0 && now.Sub(since) > limit {
+			return fmt.Errorf("opc is %v since %v, exceeding %v", s.Driver.OPC, since.UTC().Format(time.RFC3339), limit)
+		}
+		return nil
+	}
+
+	// the session of a driver of which cycles follow changes is alive while it keeps the connection to OPC alive
+	if s.Driver.Interval <= 0 {
+
+		last := s.Driver.LastKeepAlive
+		if since.After(last) {
+			last = since
+		}
+
+		limit := time.Duration(factor) * s.Driver.KeepAlive
+		if limit > 0 && now.Sub(last) > limit {
+			return fmt.Errorf("no opc keepalive since %v, exceeding %v", last.UTC().Format(time.RFC3339), limit)
+		}
+		return nil
+	}
+
+	last := s.Driver.LastCycle
+	if since.After(last) {
+		last = since
+	}
+
+	limit := time.Duration(factor) * s.Driver.Interval
+	if now.Sub(last) > limit {
+		return fmt.Errorf("no cycle completed since %v, exceeding %v", last.UTC().Format(time.RFC3339), limit)
+	}
+	return nil
+}
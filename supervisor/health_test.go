@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package supervisor
+
+import (
+	"tel/drivers"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	status := Status{
+		Name:  "wago_1",
+		State: StateRunning,
+		Since: now.Add(-time.Hour),
+		Driver: drivers.Status{
+			OPC:       drivers.Connected,
+			Device:    drivers.Connected,
+			LastCycle: now.Add(-time.Second),
+			OPCSince:  now.Add(-time.Hour),
+			Interval:  200 * time.Millisecond,
+			KeepAlive: 5 * time.Second,
+		},
+	}
+
+	if err := status.Ready(); err != nil {
+		t.Fatalf("expected connected instance to be ready, got %v", err)
+	}
+	if err := status.Healthy(now, 10); err != nil {
+		t.Fatalf("expected instance within 10 scans to be healthy, got %v", err)
+	}
+
+	wedged := status
+	wedged.Driver.LastCycle = now.Add(-3 * time.Second)
+	if err := wedged.Healthy(now, 10); err == nil {
+		t.Fatalf("expected instance without a cycle for 15 scans to be unhealthy")
+	}
+
+	changes := wedged
+	changes.Driver.Interval = 0
+	changes.Driver.LastKeepAlive = now.Add(-5 * time.Second)
+	if err := changes.Healthy(now, 10); err != nil {
+		t.Fatalf("expected instance of which cycles follow changes to be healthy while kept alive, got %v", err)
+	}
+
+	stalled := changes
+	stalled.Driver.LastKeepAlive = now.Add(-time.Minute)
+	if err := stalled.Healthy(now, 10); err == nil {
+		t.Fatalf("expected instance of which cycles follow changes without a keepalive for 12 keepalives to be unhealthy")
+	}
+
+	restarted := wedged
+	restarted.Since = now.Add(-time.Second)
+	if err := restarted.Healthy(now, 10); err != nil {
+		t.Fatalf("expected recently started instance to be healthy, got %v", err)
+	}
+
+	reconnected := wedged
+	reconnected.Driver.OPCSince = now.Add(-time.Second)
+	if err := reconnected.Healthy(now, 10); err != nil {
+		t.Fatalf("expected recently reconnected instance to be healthy, got %v", err)
+	}
+
+	reconnecting := wedged
+	reconnecting.Driver.OPC = drivers.Disconnected
+	reconnecting.Driver.OPCSince = now.Add(-10 * time.Second)
+	if err := reconnecting.Healthy(now, 10); err != nil {
+		t.Fatalf("expected instance reconnecting to opc within 10 keepalives to be healthy, got %v", err)
+	}
+	if err := reconnecting.Ready(); err == nil {
+		t.Fatalf("expected instance reconnecting to opc not to be ready")
+	}
+
+	disconnected := reconnecting
+	disconnected.Driver.OPCSince = now.Add(-time.Minute)
+	if err := disconnected.Healthy(now, 10); err == nil {
+		t.Fatalf("expected instance disconnected from opc for 12 keepalives to be unhealthy")
+	}
+
+	unconnected := disconnected
+	unconnected.Driver.OPCSince = time.Time{}
+	if err := unconnected.Healthy(now, 10); err == nil {
+		t.Fatalf("expected instance never connected to opc since started to be unhealthy")
+	}
+
+	starting := status
+	starting.Driver.LastCycle = time.Time{}
+	if err := starting.Ready(); err == nil {
+		t.Fatalf("expected instance without a cycle not to be ready")
+	}
+
+	failed := status
+	failed.State = StateFailed
+	if err := failed.Healthy(now, 10); err == nil {
+		t.Fatalf("expected failed instance to be unhealthy")
+	}
+}
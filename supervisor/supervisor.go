@@ -0,0 +1,472 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"tel/config"
+	"tel/drivers"
+	"tel/logging"
+	"tel/opc"
+	"time"
+)
+
+const (
+	defaultBackoffMinMs = 5000
+	defaultBackoffMaxMs = 60000
+	defaultWindowMs     = 600000
+	defaultShutdownMs   = 8000
+)
+
+// State is the state of a driver instance
+type State string
+
+const (
+	// StateStarting is an instance that has been started, and has not yet run for the minimum backoff
+	StateStarting State = "starting"
+	// StateRunning is an instance that has run for at least the minimum backoff
+	StateRunning State = "running"
+	// StateDegraded is an instance that has failed, and is waiting to be restarted
+	StateDegraded State = "degraded"
+	// StateFailed is an instance that has exceeded its restart budget, and will not be restarted
+	StateFailed State = "failed"
+	// StateStopped is an instance that has stopped as the supervisor was cancelled, or as it was replaced or removed
+	StateStopped State = "stopped"
+)
+
+// Reason is the cause of the last failure or stop of an instance
+type Reason string
+
+const (
+	ReasonNone      Reason = ""
+	ReasonError     Reason = "driver_error"
+	ReasonExited    Reason = "driver_exited"
+	ReasonPanic     Reason = "panic"
+	ReasonBudget    Reason = "restart_budget_exhausted"
+	ReasonCancelled Reason = "cancelled"
+	ReasonReload    Reason = "reload"
+)
+
+// Status is the state of an instance, with the reason and error of its last failure, the number of times it has been restarted,
+// and the status and stats reported by its driver
+type Status struct {
+	Name     string
+	State    State
+	Reason   Reason
+	Err      string
+	Restarts int
+	Since    time.Time
+	Driver   drivers.Status
+	Stats    drivers.Stats
+}
+
+// Supervisor runs driver instances, restarting each independently with backoff if it fails.
+// The driver of an instance is reused across restarts, so a restart does not reload the configuration or affect the other instances.
+// An instance may be replaced or removed while the supervisor runs, such as to apply a new configuration.
+type Supervisor struct {
+	cfg       config.RuntimeRestart
+	shutdown  time.Duration
+	mu        sync.Mutex
+	instances []*instance
+	// ctx is the context of Run, within which instances are started, and is nil until Run is called
+	ctx    context.Context
+	exited chan struct{}
+}
+
+// instance is a driver instance, which once started runs until cancel is called, after which done is closed
+type instance struct {
+	driver drivers.Driver
+	status Status
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// panicError is a panic recovered from a driver
+type panicError struct {
+	value interface{}
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+func New(instances []drivers.Driver, runtime config.Runtime) *Supervisor {
+
+	cfg := runtime.Restart
+	if cfg.BackoffMinMs == 0 {
+		cfg.BackoffMinMs = defaultBackoffMinMs
+	}
+	if cfg.BackoffMaxMs == 0 {
+		cfg.BackoffMaxMs = defaultBackoffMaxMs
+	}
+	if cfg.BackoffMaxMs < cfg.BackoffMinMs {
+		cfg.BackoffMaxMs = cfg.BackoffMinMs
+	}
+	if cfg.WindowMs == 0 {
+		cfg.WindowMs = defaultWindowMs
+	}
+
+	if runtime.ShutdownMs == 0 {
+		runtime.ShutdownMs = defaultShutdownMs
+	}
+
+	s := Supervisor{
+		cfg:      cfg,
+		shutdown: time.Duration(runtime.ShutdownMs) * time.Millisecond,
+		exited:   make(chan struct{}, 1),
+	}
+
+	now := time.Now()
+	for _, v := range instances {
+		s.instances = append(s.instances, &instance{
+			driver: v,
+			status: Status{Name: v.Name(), State: StateStarting, Since: now},
+		})
+	}
+	return &s
+}
+
+// Status returns the status of each instance
+func (s *Supervisor) Status() []Status {
+
+	s.mu.Lock()
+	status := make([]Status, 0, len(s.instances))
+	instances := make([]drivers.Driver, 0, len(s.instances))
+	for _, v := range s.instances {
+		status = append(status, v.status)
+		instances = append(instances, v.driver)
+	}
+	s.mu.Unlock()
+
+	for i, v := range instances {
+		status[i].Driver = v.Status()
+		status[i].Stats = v.Stats()
+	}
+	return status
+}
+
+// Run runs each instance concurrently until ctx is cancelled, or until every instance has failed.
+// An instance that has failed remains failed while the other instances continue to run.
+// Once ctx is cancelled, the instances are given the shutdown time to stop, and Run returns nil if all stopped within it.
+func (s *Supervisor) Run(ctx context.Context) error {
+
+	s.mu.Lock()
+	s.ctx = ctx
+	for _, v := range s.instances {
+		s.start(v)
+	}
+	s.mu.Unlock()
+
+	for !s.failed() {
+		select {
+		case <-ctx.Done():
+			return s.stop()
+		case <-s.exited:
+		}
+	}
+	return fmt.Errorf("all driver instances have failed")
+}
+
+// Replace stops the instance of the same name as d, and runs d in its place, such as to apply a configuration that cannot be applied to the running driver.
+// The previous instance is given the shutdown time to stop, and d is added as a new instance if there is no instance of the same name.
+func (s *Supervisor) Replace(d drivers.Driver) error {
+
+	s.mu.Lock()
+	previous := s.find(d.Name())
+	s.mu.Unlock()
+
+	if previous != nil {
+		err := s.halt(previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx != nil && s.ctx.Err() != nil {
+		return fmt.Errorf("cannot start %v, the supervisor has stopped", d.Name())
+	}
+
+	next := &instance{
+		driver: d,
+		status: Status{Name: d.Name(), State: StateStarting, Since: time.Now()},
+	}
+
+	replaced := false
+	for i, v := range s.instances {
+		if v == previous {
+			next.status.Reason = ReasonReload
+			next.status.Restarts = v.status.Restarts + 1
+			s.instances[i] = next
+			replaced = true
+		}
+	}
+	if !replaced {
+		s.instances = append(s.instances, next)
+	}
+
+	if s.ctx != nil {
+		s.start(next)
+	}
+	return nil
+}
+
+// Remove stops and removes the instance name, giving it the shutdown time to stop
+func (s *Supervisor) Remove(name string) error {
+
+	s.mu.Lock()
+	previous := s.find(name)
+	s.mu.Unlock()
+
+	if previous == nil {
+		return fmt.Errorf("instance %v not found", name)
+	}
+
+	err := s.halt(previous)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.instances {
+		if v == previous {
+			s.instances = append(s.instances[:i], s.instances[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// find returns the instance name, or nil, and must be called with mu held
+func (s *Supervisor) find(name string) *instance {
+
+	for _, v := range s.instances {
+		if v.driver.Name() == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// start runs an instance within the context of Run, and must be called with mu held
+func (s *Supervisor) start(inst *instance) {
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	inst.cancel = cancel
+	inst.done = make(chan struct{})
+
+	go func() {
+		defer func() {
+			close(inst.done)
+			select {
+			case s.exited <- struct{}{}:
+			default:
+			}
+		}()
+		s.supervise(ctx, inst)
+	}()
+}
+
+// halt cancels a started instance, waiting for at most the shutdown time for it to stop
+func (s *Supervisor) halt(inst *instance) error {
+
+	s.mu.Lock()
+	cancel, done := inst.cancel, inst.done
+	s.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(s.shutdown):
+		return fmt.Errorf("%v did not stop within %v", inst.driver.Name(), s.shutdown)
+	}
+}
+
+// failed returns true if there are instances, and every instance has failed
+func (s *Supervisor) failed() bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.instances {
+		if v.status.State != StateFailed {
+			return false
+		}
+	}
+	return len(s.instances) != 0
+}
+
+// stop waits for at most the shutdown time for the instances to stop, once the context of Run is cancelled
+func (s *Supervisor) stop() error {
+
+	s.mu.Lock()
+	instances := make([]*instance, len(s.instances))
+	copy(instances, s.instances)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.shutdown)
+	defer timer.Stop()
+
+	expired := false
+	stopping := []string{}
+	for _, v := range instances {
+
+		if !expired {
+			select {
+			case <-v.done:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+
+		select {
+		case <-v.done:
+		default:
+			stopping = append(stopping, v.driver.Name())
+		}
+	}
+
+	if len(stopping) != 0 {
+		return fmt.Errorf("shutdown timed out after %v, waiting for: %v", s.shutdown, stopping)
+	}
+	return nil
+}
+
+// supervise runs an instance, restarting it with backoff until ctx is cancelled, or it is restarted more than max restarts within the window
+func (s *Supervisor) supervise(ctx context.Context, inst *instance) {
+
+	instance := inst.driver
+
+	backoff := opc.Backoff{
+		Min: time.Duration(s.cfg.BackoffMinMs) * time.Millisecond,
+		Max: time.Duration(s.cfg.BackoffMaxMs) * time.Millisecond,
+	}
+	window := time.Duration(s.cfg.WindowMs) * time.Millisecond
+	restarts := []time.Time{}
+	log := logging.Default().With("driver", instance.Name())
+
+	for {
+		log.Infof("starting")
+
+		run := s.set(inst, StateStarting, ReasonNone, nil)
+		promote := time.AfterFunc(backoff.Min, func() {
+			s.promote(inst, run)
+		})
+
+		start := time.Now()
+		err := s.run(ctx, instance)
+		promote.Stop()
+
+		if ctx.Err() != nil {
+			s.set(inst, StateStopped, ReasonCancelled, nil)
+			log.Infof("stopped")
+			return
+		}
+
+		reason := ReasonError
+		if err == nil {
+			reason = ReasonExited
+			err = fmt.Errorf("exit without error")
+		} else if errors.As(err, &panicError{}) {
+			reason = ReasonPanic
+		}
+
+		if time.Since(start) > backoff.Max {
+			backoff.Reset()
+		}
+
+		now := time.Now()
+		recent := []time.Time{}
+		for _, t := range restarts {
+			if now.Sub(t) < window {
+				recent = append(recent, t)
+			}
+		}
+		restarts = recent
+
+		if s.cfg.MaxRestarts != 0 && len(restarts) >= s.cfg.MaxRestarts {
+			s.set(inst, StateFailed, ReasonBudget, err)
+			log.Errorf("failed, restarted %v times within %v, not restarting: %v", len(restarts), window, err)
+			return
+		}
+		restarts = append(restarts, now)
+
+		delay := backoff.Next()
+		s.set(inst, StateDegraded, reason, err)
+		log.With("reason", reason).Errorf("failed, restarting in %v: %v", delay, err)
+
+		select {
+		case <-ctx.Done():
+			s.set(inst, StateStopped, ReasonCancelled, nil)
+			log.Infof("stopped")
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// run runs the driver, recovering a panic as a panicError
+func (s *Supervisor) run(ctx context.Context, driver drivers.Driver) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError{value: r}
+		}
+	}()
+
+	return driver.Run(ctx)
+}
+
+// set sets the state of an instance, counting each start after the first as a restart, and returns the number of restarts.
+// The reason and error of the last failure are retained if reason is ReasonNone and err is nil.
+func (s *Supervisor) set(inst *instance, state State, reason Reason, err error) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := &inst.status
+
+	if state == StateStarting && st.State != StateStarting {
+		st.Restarts++
+	}
+	if reason != ReasonNone {
+		st.Reason = reason
+	}
+	if err != nil {
+		st.Err = err.Error()
+	}
+	if st.State != state {
+		st.Since = time.Now()
+	}
+	st.State = state
+
+	return st.Restarts
+}
+
+// promote marks an instance as running, if it is still starting from the same restart
+func (s *Supervisor) promote(inst *instance, restarts int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := &inst.status
+	if st.State == StateStarting && st.Restarts == restarts {
+		st.State = StateRunning
+		st.Since = time.Now()
+	}
+}
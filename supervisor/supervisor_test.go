@@ -0,0 +1,266 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"tel/config"
+	"tel/drivers"
+	"testing"
+	"time"
+)
+
+// fake fails until it has been run failures times, then runs until ctx is cancelled. A failure panics if panics is set.
+type fake struct {
+	name     string
+	failures int32
+	runs     int32
+	panics   bool
+}
+
+func (f *fake) Run(ctx context.Context) error {
+	if atomic.AddInt32(&f.runs, 1) <= f.failures {
+		if f.panics {
+			panic("failed")
+		}
+		return fmt.Errorf("failed")
+	}
+	<-ctx.Done()
+	return fmt.Errorf("ctx caught")
+}
+
+func (f *fake) Name() string {
+	return f.name
+}
+
+func (f *fake) Tags() []drivers.TagUsage {
+	return nil
+}
+
+func (f *fake) Status() drivers.Status {
+	return drivers.Status{}
+}
+
+func (f *fake) Stats() drivers.Stats {
+	return drivers.Stats{}
+}
+
+func (f *fake) Validate() error {
+	return nil
+}
+
+func TestRun(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	failing := &fake{name: "failing", failures: 3}
+	healthy := &fake{name: "healthy"}
+
+	s := New([]drivers.Driver{failing, healthy}, config.Runtime{Restart: config.RuntimeRestart{BackoffMinMs: 1, BackoffMaxMs: 1}})
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&failing.runs) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected failing instance to be restarted, ran %v times", atomic.LoadInt32(&failing.runs))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if runs := atomic.LoadInt32(&healthy.runs); runs != 1 {
+		t.Fatalf("expected healthy instance to run once, independently of the failing instance, ran %v times", runs)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for s.Status()[0].State != StateRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected restarted instance to be running, got %+v", s.Status()[0])
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if st := s.Status()[0]; st.Restarts != 3 || st.Reason != ReasonError {
+		t.Fatalf("expected 3 restarts after driver errors, got %+v", st)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected an orderly shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for instances to stop")
+	}
+
+	if st := s.Status()[1]; st.State != StateStopped || st.Reason != ReasonCancelled {
+		t.Fatalf("expected healthy instance to be stopped, got %+v", st)
+	}
+}
+
+func TestBudget(t *testing.T) {
+
+	failing := &fake{name: "failing", failures: 100, panics: true}
+
+	s := New([]drivers.Driver{failing}, config.Runtime{Restart: config.RuntimeRestart{BackoffMinMs: 1, BackoffMaxMs: 1, MaxRestarts: 2}})
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("expected an error once all instances have failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the restart budget to be exhausted")
+	}
+
+	if runs := atomic.LoadInt32(&failing.runs); runs != 3 {
+		t.Fatalf("expected instance to run once and be restarted twice, ran %v times", runs)
+	}
+
+	st := s.Status()[0]
+	if st.State != StateFailed || st.Reason != ReasonBudget || st.Err != "panic: failed" {
+		t.Fatalf("expected instance to have failed on the budget after panicking, got %+v", st)
+	}
+}
+
+// stuck ignores cancellation until released
+type stuck struct {
+	release chan struct{}
+}
+
+func (s *stuck) Run(ctx context.Context) error {
+	<-s.release
+	return fmt.Errorf("released")
+}
+
+func (s *stuck) Name() string {
+	return "stuck"
+}
+
+func (s *stuck) Tags() []drivers.TagUsage {
+	return nil
+}
+
+func (s *stuck) Status() drivers.Status {
+	return drivers.Status{}
+}
+
+func (s *stuck) Stats() drivers.Stats {
+	return drivers.Stats{}
+}
+
+func (s *stuck) Validate() error {
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &stuck{release: make(chan struct{})}
+	defer close(d.release)
+
+	s := New([]drivers.Driver{d}, config.Runtime{ShutdownMs: 10})
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("expected shutdown to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected shutdown to return after the shutdown time")
+	}
+}
+
+func TestReplace(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := &fake{name: "a"}
+	other := &fake{name: "b"}
+
+	s := New([]drivers.Driver{first, other}, config.Runtime{Restart: config.RuntimeRestart{BackoffMinMs: 1, BackoffMaxMs: 1}})
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&first.runs) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected instance to be started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	second := &fake{name: "a"}
+	err := s.Replace(second)
+	if err != nil {
+		t.Fatalf("failed to replace: %v", err)
+	}
+
+	added := &fake{name: "c"}
+	err = s.Replace(added)
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&second.runs) == 0 || atomic.LoadInt32(&added.runs) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected replaced and added instances to be started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if runs := atomic.LoadInt32(&first.runs); runs != 1 {
+		t.Fatalf("expected replaced instance not to be restarted, ran %v times", runs)
+	}
+	if runs := atomic.LoadInt32(&other.runs); runs != 1 {
+		t.Fatalf("expected other instance to run once, independently of the replaced instance, ran %v times", runs)
+	}
+
+	err = s.Remove("b")
+	if err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+
+	status := s.Status()
+	if len(status) != 2 || status[0].Name != "a" || status[0].Reason != ReasonReload || status[0].Restarts != 1 || status[1].Name != "c" {
+		t.Fatalf("expected replaced instance a and added instance c, got %+v", status)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected an orderly shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for instances to stop")
+	}
+}
@@ -6,107 +6,363 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"tel/config"
 	"tel/drivers"
+	"tel/logging"
+	"tel/opc"
+	"tel/supervisor"
+	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 func main() {
 
 	log.SetFlags(0)
 
-	ctx, ctxx := context.WithCancel(context.Background())
+	// SIGINT or SIGTERM cancels ctx, stopping the drivers and then the embedded OPC server, after which a second signal terminates immediately
+	ctx, ctxx := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		ctxx()
+	}()
+
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "":
+	case "validate":
+		err := validate(ctx, os.Stdout)
+		ctxx()
+		if err != nil {
+			log.Printf("%v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "schema":
+		err := schema(os.Stdout, os.Args[2:])
+		ctxx()
+		if err != nil {
+			log.Printf("%v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "export":
+		err := exportCSV(os.Stdout, os.Args[2:])
+		ctxx()
+		if err != nil {
+			log.Printf("%v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "import":
+		err := importCSV(os.Stdin, os.Args[2:])
+		ctxx()
+		if err != nil {
+			log.Printf("%v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	default:
+		log.Printf("command %v not recognised, expected one of [validate schema export import]", command)
+		ctxx()
+		os.Exit(2)
+	}
+
 	err := run(ctx)
+	ctxx()
 	if err != nil {
-		log.Printf("%v", err)
-	} else {
-		log.Printf("exit without error?: %v", err)
+		logging.Default().Errorf("%v", err)
+		os.Exit(1)
 	}
-	ctxx()
-	os.Exit(1)
+	logging.Default().Infof("shutdown complete")
 }
 
 func run(ctx context.Context) error {
 
-	cTagList := os.Getenv("CONFIG_TAGLIST")
-	cConfigDriver := os.Getenv("CONFIG_DRIVER")
-	cDriver := os.Getenv("DRIVER")
-	cOpc := os.Getenv("OPC")
+	// SIGHUP is caught before loading, such that it cannot terminate the process while the drivers start
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
-	if cTagList == "" {
-		return fmt.Errorf("CONFIG_TAGLIST is not set")
+	s, err := load()
+	if err != nil {
+		return err
 	}
+	// the embedded server is stopped only once the drivers have stopped, or the shutdown time has expired,
+	// such that the drivers apply their fail-safes to it on shutdown
+	defer s.stop()
 
-	if cConfigDriver == "" {
-		return fmt.Errorf("CONFIG_DRIVERS is not set")
+	if s.opc.Provision {
+		err := provision(ctx, s.opc, s.tags)
+		if err != nil {
+			return fmt.Errorf("failed to provision opc: %w", err)
+		}
 	}
 
-	if cDriver == "" {
-		return fmt.Errorf("DRIVER is not set")
+	sup := supervisor.New(s.instances, s.runtime)
+	go reloads(ctx, hup, s, sup)
+
+	if s.loaded.http.Listen != "" {
+		err := serveHTTP(ctx, s.loaded.http, sup)
+		if err != nil {
+			return fmt.Errorf("failed to start http server: %w", err)
+		}
 	}
 
-	if cOpc == "" {
-		return fmt.Errorf("OPC is not set")
+	return sup.Run(ctx)
+}
+
+// setup is the configuration loaded from the environment, with a driver per configured instance
+type setup struct {
+	instances []drivers.Driver
+	runtime   config.Runtime
+	opc       config.OPCClient
+	tags      []config.TagListTag
+	// loaded is the configuration as loaded, before the endpoint of the embedded server is applied
+	loaded configuration
+	// digests is the digest of the configuration of each instance by name, by which a reload detects a change
+	digests map[string]string
+	// stop stops the embedded server, if started, and must be called once the drivers have stopped
+	stop func()
+}
+
+// configuration is the configuration loaded from the environment
+type configuration struct {
+	runtime config.Runtime
+	opc     config.OPC
+	tags    []config.TagListTag
+	log     config.Log
+	http    config.RuntimeHTTP
+}
+
+// load loads the configuration from the environment, and creates the drivers, and the embedded OPC server if configured.
+// The embedded server is served until setup.stop is called, independent of the context of the drivers.
+func load() (setup, error) {
+
+	c, err := configure()
+	if err != nil {
+		return setup{}, err
 	}
 
-	configTags, err := config.LoadTagList(cTagList)
+	err = setLogger(c.log)
 	if err != nil {
-		return fmt.Errorf("failed to load tags: %w", err)
+		return setup{}, err
 	}
 
-	var driver drivers.Driver
+	configOpc := c.opc
 
-	switch cDriver {
-	case "modbus":
+	// The embedded server is served to the drivers in-process, unless OPC is set to use another server
+	var server *opc.Server
+	if configOpc.Server.Endpoint != "" {
 
-		configModbus, err := config.LoadModbus(cConfigDriver)
+		server, err = opc.NewServer(configOpc.Server, c.tags)
 		if err != nil {
-			return fmt.Errorf("failed to load modbus configuration: %w", err)
+			return setup{}, fmt.Errorf("failed to create opc server: %w", err)
 		}
+		server.SetLogger(logging.Default().With("endpoint", configOpc.Server.Endpoint))
 
-		log.Printf("starting modbus as: %+v", configModbus.Modbus.Device)
+		if configOpc.Opc.Endpoint == "" {
+			configOpc.Opc.Endpoint = server.Endpoint()
+		}
+	}
 
-		d, err := drivers.NewModbus(configTags.Tags, configModbus.Modbus, cOpc)
+	if configOpc.Opc.Endpoint == "" {
+		return setup{}, fmt.Errorf("OPC is not set")
+	}
+
+	s := setup{
+		runtime: c.runtime,
+		opc:     configOpc.Opc,
+		tags:    c.tags,
+		loaded:  c,
+		digests: map[string]string{},
+	}
+
+	for _, v := range c.runtime.Drivers {
+		d, digest, err := create(v, c.tags, configOpc.Opc)
 		if err != nil {
-			return fmt.Errorf("failed to create modbus driver: %w", err)
+			return setup{}, err
 		}
-		driver = d
+		s.instances = append(s.instances, d)
+		s.digests[v.Name] = digest
+	}
+
+	s.stop = func() {}
+	if server == nil {
+		return s, nil
+	}
 
-	case "mqtt":
+	err = server.Listen()
+	if err != nil {
+		return setup{}, fmt.Errorf("failed to start opc server: %w", err)
+	}
 
-		configMqtt, err := config.LoadMqtt(cConfigDriver)
-		if err != nil {
-			return fmt.Errorf("failed to load mqtt configuration: %w", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		err := server.Serve(ctx)
+		if ctx.Err() == nil {
+			logging.Default().Errorf("opc server stopped: %v", err)
 		}
+	}()
+
+	s.stop = func() {
+		cancel()
+		<-stopped
+	}
+	return s, nil
+}
 
-		log.Printf("starting mqtt as: %+v", configMqtt.Mqtt.Device.Target)
+// configure loads the configuration from the environment.
+// CONFIG_RUNTIME lists multiple driver instances, else a single instance is configured by DRIVER and CONFIG_DRIVER.
+// CONFIG_RUNTIME may also set the OPC configuration and taglist, which CONFIG_OPC and CONFIG_TAGLIST override if set.
+func configure() (configuration, error) {
 
-		d, err := drivers.NewMQTT(configTags.Tags, configMqtt.Mqtt, cOpc)
+	cTagList := os.Getenv("CONFIG_TAGLIST")
+	cConfigDriver := os.Getenv("CONFIG_DRIVER")
+	cDriver := os.Getenv("DRIVER")
+	cOpc := os.Getenv("OPC")
+	cConfigOpc := os.Getenv("CONFIG_OPC")
+	cConfigRuntime := os.Getenv("CONFIG_RUNTIME")
+	cLogLevel := os.Getenv("LOG_LEVEL")
+	cLogFormat := os.Getenv("LOG_FORMAT")
+	cHTTPListen := os.Getenv("HTTP_LISTEN")
+
+	configRuntime := config.Runtime{}
+	if cConfigRuntime != "" {
+		c, err := config.LoadRuntime(cConfigRuntime)
 		if err != nil {
-			return fmt.Errorf("failed to create mqtt driver: %w", err)
+			return configuration{}, fmt.Errorf("failed to load runtime configuration: %w", err)
 		}
-		driver = d
+		configRuntime = c
+	} else {
 
-	case "goose":
+		if cConfigDriver == "" {
+			return configuration{}, fmt.Errorf("CONFIG_DRIVER is not set")
+		}
+
+		if cDriver == "" {
+			return configuration{}, fmt.Errorf("DRIVER is not set")
+		}
 
-		configGoose, err := config.LoadGoose(cConfigDriver)
+		configRuntime.Drivers = []config.RuntimeDriver{{Name: cDriver, Driver: cDriver, Config: cConfigDriver}}
+	}
+
+	configOpc := config.OPC{Opc: configRuntime.Opc, Server: configRuntime.Server}
+	if cConfigOpc != "" {
+		c, err := config.LoadOpc(cConfigOpc)
 		if err != nil {
-			return fmt.Errorf("failed to load goose configuration: %w", err)
+			return configuration{}, fmt.Errorf("failed to load opc configuration: %w", err)
 		}
+		configOpc = c
+	}
 
-		log.Printf("starting goose as: %+v", configGoose.Goose.Device)
+	// OPC overrides the endpoint within CONFIG_OPC, if both are set
+	if cOpc != "" {
+		configOpc.Opc.Endpoint = cOpc
+	}
 
-		d, err := drivers.NewGoose(configTags.Tags, configGoose.Goose, cOpc)
+	tags := configRuntime.Tags
+	if cTagList != "" {
+		configTags, err := config.LoadTagList(cTagList)
 		if err != nil {
-			return fmt.Errorf("failed to create goose driver: %w", err)
+			return configuration{}, fmt.Errorf("failed to load tags: %w", err)
 		}
-		driver = d
+		tags = configTags.Tags
+	}
 
-	default:
-		return fmt.Errorf("driver %v not recognised", cDriver)
+	if len(tags) == 0 {
+		return configuration{}, fmt.Errorf("CONFIG_TAGLIST is not set")
+	}
+
+	// LOG_LEVEL and LOG_FORMAT override the log configuration of CONFIG_RUNTIME, if set
+	configLog := configRuntime.Log
+	if cLogLevel != "" {
+		configLog.Level = cLogLevel
+	}
+	if cLogFormat != "" {
+		configLog.Format = cLogFormat
+	}
+
+	// HTTP_LISTEN overrides the address of the HTTP server of CONFIG_RUNTIME, if set
+	configHTTP := configRuntime.HTTP
+	if cHTTPListen != "" {
+		configHTTP.Listen = cHTTPListen
+	}
+
+	return configuration{runtime: configRuntime, opc: configOpc, tags: tags, log: configLog, http: configHTTP}, nil
+}
+
+// setLogger sets the logger of the process from c, through which the standard library log package is also redirected
+func setLogger(c config.Log) error {
+
+	level, err := logging.ParseLevel(c.Level)
+	if err != nil {
+		return err
+	}
+	format, err := logging.ParseFormat(c.Format)
+	if err != nil {
+		return err
+	}
+	window := logging.DefaultRateLimit
+	if c.RateLimitMs != 0 {
+		window = time.Duration(c.RateLimitMs) * time.Millisecond
+	}
+
+	logging.SetDefault(logging.New(os.Stderr, format, level, window))
+	log.SetOutput(logging.Writer())
+	return nil
+}
+
+// create creates and validates the driver instance v, returning it with a digest of its configuration and of the tags it uses
+func create(v config.RuntimeDriver, tags []config.TagListTag, opcConfig config.OPCClient) (drivers.Driver, string, error) {
+
+	d, cfg, err := drivers.New(v.Name, v.Driver, v.Config, tags, opcConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("%v: %w", v.Name, err)
+	}
+	err = d.Validate()
+	if err != nil {
+		return nil, "", fmt.Errorf("%v: invalid configuration: %w", v.Name, err)
+	}
+
+	// the digest is of the configuration the driver was created from, which is loaded once
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, "", fmt.Errorf("%v: failed to encode configuration: %w", v.Name, err)
+	}
+
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%v\n%s\n%+v", v.Driver, b, d.Tags())))
+	return d, hex.EncodeToString(digest[:]), nil
+}
+
+// provision creates the tags missing from the OPC server, before the drivers start
+func provision(ctx context.Context, cfg config.OPCClient, tags []config.TagListTag) error {
+
+	c := opc.NewClient(cfg)
+	err := c.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	created, err := c.Provision(ctx, tags)
+	if err != nil {
+		return err
 	}
 
-	return driver.Run(ctx)
+	logging.Default().Infof("provisioned %v of %v tags: %v", len(created), len(tags), created)
+	return nil
 }
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2022 Kaelan Thijs Fouwels <kaelan.thijs@fouwels.com>
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"tel/opc"
+	"text/tabwriter"
+)
+
+// validate checks each tag of the taglist against the OPC server, writing a report to w.
+// Tags any of the drivers write to OPC must be writable, an error is returned if any tag fails.
+func validate(ctx context.Context, w io.Writer) error {
+
+	s, err := load()
+	if err != nil {
+		return err
+	}
+	defer s.stop()
+	configOpc := s.opc
+	tags := s.tags
+
+	// a tag must be writable if written by any of the drivers
+	write := map[string]bool{}
+	used := map[string]bool{}
+	for _, d := range s.instances {
+		for _, v := range d.Tags() {
+			used[v.Tag.Name] = true
+			write[v.Tag.Name] = write[v.Tag.Name] || v.Write
+		}
+	}
+
+	writes := make([]bool, 0, len(tags))
+	for _, v := range tags {
+		writes = append(writes, write[v.Name])
+	}
+
+	c := opc.NewClient(configOpc)
+	err = c.Connect(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect OPC: %w", err)
+	}
+	defer c.Close()
+
+	results, err := c.Validate(ctx, tags, writes)
+	if err != nil {
+		return fmt.Errorf("failed to validate: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "TAG\tNODE\tTYPE\tDRIVER\tRESULT\n")
+
+	failed := 0
+	for _, v := range results {
+
+		usage := "-"
+		if used[v.Tag.Name] {
+			usage = "read"
+			if v.Write {
+				usage = "write"
+			}
+		}
+
+		node := v.Tag.Node
+		if v.Node != nil {
+			node = v.Node.String()
+		}
+
+		result := "ok"
+		if !v.OK() {
+			failed++
+			result = "FAIL: " + strings.Join(v.Problems, "; ")
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", v.Tag.Name, node, v.Tag.Type, usage, result)
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "validated %v tags against %v, %v failed\n", len(results), configOpc.Endpoint, failed)
+
+	if failed != 0 {
+		return fmt.Errorf("%v of %v tags failed validation", failed, len(results))
+	}
+	return nil
+}